@@ -0,0 +1,370 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v27.2.0
+// source: api/vendingmachine/v1/vendingmachine.proto
+
+package vendingmachinev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	VendingMachineService_CreateMachine_FullMethodName = "/vendingmachine.v1.VendingMachineService/CreateMachine"
+	VendingMachineService_InsertCoin_FullMethodName    = "/vendingmachine.v1.VendingMachineService/InsertCoin"
+	VendingMachineService_SelectProduct_FullMethodName = "/vendingmachine.v1.VendingMachineService/SelectProduct"
+	VendingMachineService_AbortOrder_FullMethodName    = "/vendingmachine.v1.VendingMachineService/AbortOrder"
+	VendingMachineService_Transition_FullMethodName    = "/vendingmachine.v1.VendingMachineService/Transition"
+	VendingMachineService_GetState_FullMethodName      = "/vendingmachine.v1.VendingMachineService/GetState"
+	VendingMachineService_StreamEvents_FullMethodName  = "/vendingmachine.v1.VendingMachineService/StreamEvents"
+)
+
+// VendingMachineServiceClient is the client API for VendingMachineService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// VendingMachineService exposes the same operations as the http api.
+type VendingMachineServiceClient interface {
+	CreateMachine(ctx context.Context, in *CreateMachineRequest, opts ...grpc.CallOption) (*CreateMachineResponse, error)
+	InsertCoin(ctx context.Context, in *InsertCoinRequest, opts ...grpc.CallOption) (*MachineState, error)
+	SelectProduct(ctx context.Context, in *SelectProductRequest, opts ...grpc.CallOption) (*MachineState, error)
+	AbortOrder(ctx context.Context, in *AbortOrderRequest, opts ...grpc.CallOption) (*MachineState, error)
+	Transition(ctx context.Context, in *TransitionRequest, opts ...grpc.CallOption) (*MachineState, error)
+	GetState(ctx context.Context, in *GetStateRequest, opts ...grpc.CallOption) (*MachineState, error)
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (VendingMachineService_StreamEventsClient, error)
+}
+
+type vendingMachineServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVendingMachineServiceClient(cc grpc.ClientConnInterface) VendingMachineServiceClient {
+	return &vendingMachineServiceClient{cc}
+}
+
+func (c *vendingMachineServiceClient) CreateMachine(ctx context.Context, in *CreateMachineRequest, opts ...grpc.CallOption) (*CreateMachineResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CreateMachineResponse)
+	err := c.cc.Invoke(ctx, VendingMachineService_CreateMachine_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vendingMachineServiceClient) InsertCoin(ctx context.Context, in *InsertCoinRequest, opts ...grpc.CallOption) (*MachineState, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MachineState)
+	err := c.cc.Invoke(ctx, VendingMachineService_InsertCoin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vendingMachineServiceClient) SelectProduct(ctx context.Context, in *SelectProductRequest, opts ...grpc.CallOption) (*MachineState, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MachineState)
+	err := c.cc.Invoke(ctx, VendingMachineService_SelectProduct_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vendingMachineServiceClient) AbortOrder(ctx context.Context, in *AbortOrderRequest, opts ...grpc.CallOption) (*MachineState, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MachineState)
+	err := c.cc.Invoke(ctx, VendingMachineService_AbortOrder_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vendingMachineServiceClient) Transition(ctx context.Context, in *TransitionRequest, opts ...grpc.CallOption) (*MachineState, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MachineState)
+	err := c.cc.Invoke(ctx, VendingMachineService_Transition_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vendingMachineServiceClient) GetState(ctx context.Context, in *GetStateRequest, opts ...grpc.CallOption) (*MachineState, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MachineState)
+	err := c.cc.Invoke(ctx, VendingMachineService_GetState_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vendingMachineServiceClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (VendingMachineService_StreamEventsClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &VendingMachineService_ServiceDesc.Streams[0], VendingMachineService_StreamEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &vendingMachineServiceStreamEventsClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type VendingMachineService_StreamEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type vendingMachineServiceStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *vendingMachineServiceStreamEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VendingMachineServiceServer is the server API for VendingMachineService service.
+// All implementations must embed UnimplementedVendingMachineServiceServer
+// for forward compatibility
+//
+// VendingMachineService exposes the same operations as the http api.
+type VendingMachineServiceServer interface {
+	CreateMachine(context.Context, *CreateMachineRequest) (*CreateMachineResponse, error)
+	InsertCoin(context.Context, *InsertCoinRequest) (*MachineState, error)
+	SelectProduct(context.Context, *SelectProductRequest) (*MachineState, error)
+	AbortOrder(context.Context, *AbortOrderRequest) (*MachineState, error)
+	Transition(context.Context, *TransitionRequest) (*MachineState, error)
+	GetState(context.Context, *GetStateRequest) (*MachineState, error)
+	StreamEvents(*StreamEventsRequest, VendingMachineService_StreamEventsServer) error
+	mustEmbedUnimplementedVendingMachineServiceServer()
+}
+
+// UnimplementedVendingMachineServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedVendingMachineServiceServer struct {
+}
+
+func (UnimplementedVendingMachineServiceServer) CreateMachine(context.Context, *CreateMachineRequest) (*CreateMachineResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateMachine not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) InsertCoin(context.Context, *InsertCoinRequest) (*MachineState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InsertCoin not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) SelectProduct(context.Context, *SelectProductRequest) (*MachineState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SelectProduct not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) AbortOrder(context.Context, *AbortOrderRequest) (*MachineState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AbortOrder not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) Transition(context.Context, *TransitionRequest) (*MachineState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Transition not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) GetState(context.Context, *GetStateRequest) (*MachineState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetState not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) StreamEvents(*StreamEventsRequest, VendingMachineService_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedVendingMachineServiceServer) mustEmbedUnimplementedVendingMachineServiceServer() {}
+
+// UnsafeVendingMachineServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VendingMachineServiceServer will
+// result in compilation errors.
+type UnsafeVendingMachineServiceServer interface {
+	mustEmbedUnimplementedVendingMachineServiceServer()
+}
+
+func RegisterVendingMachineServiceServer(s grpc.ServiceRegistrar, srv VendingMachineServiceServer) {
+	s.RegisterService(&VendingMachineService_ServiceDesc, srv)
+}
+
+func _VendingMachineService_CreateMachine_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateMachineRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VendingMachineServiceServer).CreateMachine(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VendingMachineService_CreateMachine_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VendingMachineServiceServer).CreateMachine(ctx, req.(*CreateMachineRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VendingMachineService_InsertCoin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InsertCoinRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VendingMachineServiceServer).InsertCoin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VendingMachineService_InsertCoin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VendingMachineServiceServer).InsertCoin(ctx, req.(*InsertCoinRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VendingMachineService_SelectProduct_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SelectProductRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VendingMachineServiceServer).SelectProduct(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VendingMachineService_SelectProduct_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VendingMachineServiceServer).SelectProduct(ctx, req.(*SelectProductRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VendingMachineService_AbortOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AbortOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VendingMachineServiceServer).AbortOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VendingMachineService_AbortOrder_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VendingMachineServiceServer).AbortOrder(ctx, req.(*AbortOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VendingMachineService_Transition_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransitionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VendingMachineServiceServer).Transition(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VendingMachineService_Transition_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VendingMachineServiceServer).Transition(ctx, req.(*TransitionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VendingMachineService_GetState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VendingMachineServiceServer).GetState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VendingMachineService_GetState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VendingMachineServiceServer).GetState(ctx, req.(*GetStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VendingMachineService_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VendingMachineServiceServer).StreamEvents(m, &vendingMachineServiceStreamEventsServer{ServerStream: stream})
+}
+
+type VendingMachineService_StreamEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type vendingMachineServiceStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *vendingMachineServiceStreamEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// VendingMachineService_ServiceDesc is the grpc.ServiceDesc for VendingMachineService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var VendingMachineService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "vendingmachine.v1.VendingMachineService",
+	HandlerType: (*VendingMachineServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateMachine",
+			Handler:    _VendingMachineService_CreateMachine_Handler,
+		},
+		{
+			MethodName: "InsertCoin",
+			Handler:    _VendingMachineService_InsertCoin_Handler,
+		},
+		{
+			MethodName: "SelectProduct",
+			Handler:    _VendingMachineService_SelectProduct_Handler,
+		},
+		{
+			MethodName: "AbortOrder",
+			Handler:    _VendingMachineService_AbortOrder_Handler,
+		},
+		{
+			MethodName: "Transition",
+			Handler:    _VendingMachineService_Transition_Handler,
+		},
+		{
+			MethodName: "GetState",
+			Handler:    _VendingMachineService_GetState_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _VendingMachineService_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/vendingmachine/v1/vendingmachine.proto",
+}
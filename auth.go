@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	vendingmachinev1 "vendingmachine/api/vendingmachine/v1"
+	"vendingmachine/internal/auth"
+)
+
+const (
+	apiKeyHeader        = "X-Api-Key"
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+// Authenticator identifies callers by their api key, their bearer token or
+// the common name of their client certificate.
+type Authenticator struct {
+	keys *auth.KeyStore
+	// jwt is nil when bearer tokens are not accepted
+	jwt *auth.JWTManager
+
+	mu sync.RWMutex
+	// certs maps the common name of the client certificates to identities
+	certs map[string]auth.Identity
+}
+
+func NewAuthenticator(keys *auth.KeyStore, jwt *auth.JWTManager, certs map[string]auth.Identity) *Authenticator {
+	return &Authenticator{keys: keys, jwt: jwt, mu: sync.RWMutex{}, certs: certs}
+}
+
+// SetCertIdentities replaces the identities of the client certificates.
+func (a *Authenticator) SetCertIdentities(certs map[string]auth.Identity) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.certs = certs
+}
+
+// credentials are what a caller presented to identify itself.
+type credentials struct {
+	apiKey string
+	// authorization is the value of the authorization header
+	authorization string
+	// commonName is the common name of the verified client certificate
+	commonName string
+}
+
+// authenticate checks the credentials against the required role, the
+// bearer token is preferred over the api key over the client certificate.
+func (a *Authenticator) authenticate(creds credentials, required auth.Role) (auth.Identity, error) {
+	var (
+		id  auth.Identity
+		err error
+	)
+
+	a.mu.RLock()
+	certID, hasCert := a.certs[creds.commonName]
+	a.mu.RUnlock()
+
+	switch {
+	case strings.HasPrefix(creds.authorization, bearerPrefix) && a.jwt != nil:
+		id, err = a.jwt.Verify(strings.TrimPrefix(creds.authorization, bearerPrefix))
+	case creds.apiKey != "":
+		id, err = a.keys.Authenticate(creds.apiKey)
+	case creds.commonName != "" && hasCert:
+		id = certID
+	default:
+		err = auth.ErrUnauthenticated
+	}
+
+	if err != nil {
+		return auth.Identity{}, err
+	}
+
+	if !id.Role.Allows(required) {
+		return auth.Identity{}, auth.ErrForbidden
+	}
+
+	return id, nil
+}
+
+// Router registers the routes on the mux together with the minimum role
+// required to call them.
+type Router struct {
+	mux *http.ServeMux
+	// policy maps the mux pattern to the role required to call it
+	policy map[string]auth.Role
+	// middlewares wrap every route, they run after routing so the path
+	// values of the request are set
+	middlewares []func(http.Handler) http.Handler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		mux:    http.NewServeMux(),
+		policy: make(map[string]auth.Role),
+	}
+}
+
+// Use adds a middleware to all the routes, including the ones already registered.
+func (rt *Router) Use(mw func(http.Handler) http.Handler) {
+	rt.middlewares = append(rt.middlewares, mw)
+}
+
+// HandleFunc registers the handler, callers scoped to a single machine are
+// only let through if the request targets that machine.
+func (rt *Router) HandleFunc(pattern string, role auth.Role, h http.HandlerFunc) {
+	scoped := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := auth.FromContext(r.Context()); ok && id.MachineID != "" {
+			machineID := machineIDFromContext(r.Context())
+			if !id.CanAccess(machineID) {
+				http.Error(w, fmt.Sprintf("%s: token is not valid for machine %q", auth.ErrForbidden, machineID),
+					http.StatusForbidden)
+				return
+			}
+		}
+
+		h(w, r)
+	})
+
+	rt.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		// the middlewares and the scope check share the machine id
+		machineID, err := requestMachineID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r = r.WithContext(withMachineID(r.Context(), machineID))
+
+		var next http.Handler = scoped
+		for i := len(rt.middlewares) - 1; i >= 0; i-- {
+			next = rt.middlewares[i](next)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+	rt.policy[pattern] = role
+}
+
+// AuthMiddleware authenticates each request and checks the caller's role
+// against the role required by the matched route. Routes without a policy
+// require the admin role.
+func AuthMiddleware(a *Authenticator, rt *Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := rt.mux.Handler(r)
+		if pattern == "" {
+			// let the mux reply with not found or method not allowed
+			rt.mux.ServeHTTP(w, r)
+			return
+		}
+
+		required, ok := rt.policy[pattern]
+		if !ok {
+			required = auth.RoleAdmin
+		}
+
+		if required == auth.RoleAnonymous {
+			rt.mux.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := a.authenticate(credentials{
+			apiKey:        r.Header.Get(apiKeyHeader),
+			authorization: r.Header.Get(authorizationHeader),
+			commonName:    certCommonName(r.TLS),
+		}, required)
+		if err != nil {
+			http.Error(w, err.Error(), authStatus(err))
+			return
+		}
+
+		rt.mux.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), id)))
+	})
+}
+
+// certCommonName returns the common name of the client certificate if the
+// client presented one that was verified.
+func certCommonName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+func authStatus(err error) int {
+	if errors.Is(err, auth.ErrForbidden) {
+		return http.StatusForbidden
+	}
+
+	return http.StatusUnauthorized
+}
+
+// grpcPolicy maps the grpc methods to the role required to call them.
+func grpcPolicy() map[string]auth.Role {
+	return map[string]auth.Role{
+		vendingmachinev1.VendingMachineService_CreateMachine_FullMethodName: auth.RoleOperator,
+		vendingmachinev1.VendingMachineService_InsertCoin_FullMethodName:    auth.RoleCustomer,
+		vendingmachinev1.VendingMachineService_SelectProduct_FullMethodName: auth.RoleCustomer,
+		vendingmachinev1.VendingMachineService_AbortOrder_FullMethodName:    auth.RoleCustomer,
+		vendingmachinev1.VendingMachineService_Transition_FullMethodName:    auth.RoleCustomer,
+		vendingmachinev1.VendingMachineService_GetState_FullMethodName:      auth.RoleCustomer,
+		vendingmachinev1.VendingMachineService_StreamEvents_FullMethodName:  auth.RoleCustomer,
+	}
+}
+
+// GRPCAuthOptions returns the interceptors enforcing the roles on the grpc
+// server, the credentials are read from the x-api-key and authorization
+// metadata.
+func GRPCAuthOptions(a *Authenticator) []grpc.ServerOption {
+	policy := grpcPolicy()
+
+	check := func(ctx context.Context, method string) (context.Context, error) {
+		required, ok := policy[method]
+		if !ok {
+			required = auth.RoleAdmin
+		}
+
+		var creds credentials
+		if md, ok := metadata.FromIncomingContext(ctx); ok { //nolint: govet // shadowing is not a problem here
+			if v := md.Get(apiKeyHeader); len(v) > 0 {
+				creds.apiKey = v[0]
+			}
+			if v := md.Get(authorizationHeader); len(v) > 0 {
+				creds.authorization = v[0]
+			}
+		}
+		if p, ok := peer.FromContext(ctx); ok { //nolint: govet // shadowing is not a problem here
+			if info, ok := p.AuthInfo.(grpccreds.TLSInfo); ok {
+				creds.commonName = certCommonName(&info.State)
+			}
+		}
+
+		id, err := a.authenticate(creds, required)
+		if err != nil {
+			return nil, grpcAuthError(err)
+		}
+
+		return auth.NewContext(ctx, id), nil
+	}
+
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (any, error) {
+			ctx, err := check(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := checkGRPCScope(ctx, req); err != nil {
+				return nil, err
+			}
+
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler,
+		) error {
+			ctx, err := check(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+
+			return handler(srv, &authServerStream{ServerStream: ss, ctx: ctx})
+		}),
+	}
+}
+
+// checkGRPCScope rejects requests of machine scoped callers that target
+// another machine.
+func checkGRPCScope(ctx context.Context, req any) error {
+	id, ok := auth.FromContext(ctx)
+	if !ok || id.MachineID == "" {
+		return nil
+	}
+
+	var machineID string
+	if r, ok := req.(interface{ GetMachineId() string }); ok {
+		machineID = r.GetMachineId()
+	}
+
+	if !id.CanAccess(machineID) {
+		return status.Errorf(codes.PermissionDenied, "%s: token is not valid for machine %q",
+			auth.ErrForbidden, machineID)
+	}
+
+	return nil
+}
+
+func grpcAuthError(err error) error {
+	if errors.Is(err, auth.ErrForbidden) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	return status.Error(codes.Unauthenticated, err.Error())
+}
+
+// authServerStream carries the authenticated identity in its context and
+// checks the machine scope of the received requests.
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return checkGRPCScope(s.ctx, m)
+}
+
+// #######
+// Admin Handlers
+// #######
+
+type CreateKeyRequest struct {
+	Name string    `json:"name"`
+	Role auth.Role `json:"role"`
+}
+
+func (r CreateKeyRequest) validate(v *ValidationError) {
+	v.check(r.Name != "", "name", "must not be empty")
+	v.check(r.Role.Valid(), "role", "must be one of customer, operator or admin")
+}
+
+type CreateKeyResponse struct {
+	Name string    `json:"name"`
+	Role auth.Role `json:"role"`
+	// Key is only returned once, it is not stored in plain text
+	Key string `json:"key"`
+}
+
+func (s *Handler) ListKeysHandler(w http.ResponseWriter, _ *http.Request) {
+	encode(w, http.StatusOK, s.keys.List())
+}
+
+func (s *Handler) CreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[CreateKeyRequest](r)
+	if err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	key, err := s.keys.Create(req.Name, req.Role)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidKey) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, auth.ErrDuplicateKey) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encode(w, http.StatusCreated, CreateKeyResponse{Name: req.Name, Role: req.Role, Key: key})
+}
+
+func (s *Handler) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.keys.Delete(r.PathValue("name"))
+	if err != nil {
+		if errors.Is(err, auth.ErrKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type CreateTokenRequest struct {
+	MachineID string `json:"machine_id"`
+	// Subject identifies the customer the token is issued to, optional
+	Subject    string `json:"subject"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+func (r CreateTokenRequest) validate(v *ValidationError) {
+	v.check(r.MachineID != "", "machine_id", "must not be empty")
+	v.check(r.TTLSeconds >= 0, "ttl_seconds", "must not be negative")
+}
+
+type CreateTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateTokenHandler mints a short lived customer token valid only for
+// the requested machine, e.g. for a user that scanned the machine's QR code.
+func (s *Handler) CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[CreateTokenRequest](r)
+	if err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	if s.jwt == nil {
+		http.Error(w, auth.ErrMintingDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	_, err = s.machineState(r.Context(), req.MachineID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	tokenCfg := s.tokenConfig()
+	ttl := tokenCfg.DefaultTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > tokenCfg.MaxTTL {
+		ttl = tokenCfg.MaxTTL
+	}
+
+	token, expiresAt, err := s.jwt.Mint(req.Subject, req.MachineID, ttl)
+	if err != nil {
+		if errors.Is(err, auth.ErrMintingDisabled) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encode(w, http.StatusCreated, CreateTokenResponse{Token: token, ExpiresAt: expiresAt.UTC()})
+}
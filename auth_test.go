@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/auth"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	ks, err := auth.NewKeyStore([]auth.Key{
+		{Name: "kiosk", Hash: auth.HashKey("customer-key"), Role: auth.RoleCustomer},
+		{Name: "ops", Hash: auth.HashKey("operator-key"), Role: auth.RoleOperator},
+		{Name: "root", Hash: auth.HashKey("admin-key"), Role: auth.RoleAdmin},
+	})
+	require.NoError(t, err)
+
+	h := NewHandler(getVMStorageMock(t), getSMStorageMock(t), WithKeyStore(ks))
+	rt := NewRouter()
+	registerRoutes(rt, h)
+	srv := AuthMiddleware(NewAuthenticator(ks, nil, nil), rt)
+
+	insert := `{"machine_id":"123","inserted_amount":100}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		key    string
+		status int
+	}{
+		{"missing key", http.MethodPost, "/insert", insert, "", http.StatusUnauthorized},
+		{"invalid key", http.MethodPost, "/insert", insert, "nope", http.StatusUnauthorized},
+		{"customer inserts", http.MethodPost, "/insert", insert, "customer-key", http.StatusOK},
+		{"customer creates", http.MethodPost, "/addvm", `{"inventory":[]}`, "customer-key", http.StatusForbidden},
+		{"operator creates", http.MethodPost, "/addvm", `{"inventory":[]}`, "operator-key", http.StatusOK},
+		{"operator lists keys", http.MethodGet, "/v1/admin/keys", "", "operator-key", http.StatusForbidden},
+		{"admin lists keys", http.MethodGet, "/v1/admin/keys", "", "admin-key", http.StatusOK},
+		{"unknown route", http.MethodGet, "/unknown", "", "", http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.key != "" {
+				r.Header.Set(apiKeyHeader, tc.key)
+			}
+			srv.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
+
+func TestCreateKeyHandler(t *testing.T) {
+	ks, err := auth.NewKeyStore(nil)
+	require.NoError(t, err)
+	h := NewHandler(nil, nil, WithKeyStore(ks))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/admin/keys",
+		strings.NewReader(`{"name":"kiosk-2","role":"customer"}`))
+	h.CreateKeyHandler(w, r)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var res CreateKeyResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	id, err := ks.Authenticate(res.Key)
+	require.NoError(t, err)
+	assert.Equal(t, auth.Identity{Name: "kiosk-2", Role: auth.RoleCustomer}, id)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/v1/admin/keys",
+		strings.NewReader(`{"name":"kiosk-2","role":"customer"}`))
+	h.CreateKeyHandler(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestMachineScopedTokens(t *testing.T) {
+	ks, err := auth.NewKeyStore([]auth.Key{
+		{Name: "ops", Hash: auth.HashKey("operator-key"), Role: auth.RoleOperator},
+	})
+	require.NoError(t, err)
+	jwtManager, err := auth.NewJWTManager(auth.JWTConfig{HS256Secret: []byte("secret"), Issuer: "test"})
+	require.NoError(t, err)
+
+	h := NewHandler(getVMStorageMock(t), getSMStorageMock(t), WithKeyStore(ks), WithJWT(jwtManager, TokenConfig{}))
+	rt := NewRouter()
+	registerRoutes(rt, h)
+	srv := AuthMiddleware(NewAuthenticator(ks, jwtManager, nil), rt)
+
+	// the operator mints a token for machine 123
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens", strings.NewReader(`{"machine_id":"123"}`))
+	r.Header.Set(apiKeyHeader, "operator-key")
+	srv.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var res CreateTokenResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"own machine in body", http.MethodPost, "/insert", `{"machine_id":"123","inserted_amount":100}`, http.StatusOK},
+		{"own machine in path", http.MethodGet, "/v1/machines/123", "", http.StatusOK},
+		{"other machine in body", http.MethodPost, "/abort", `{"machine_id":"456"}`, http.StatusForbidden},
+		{"other machine in path", http.MethodGet, "/v1/machines/456", "", http.StatusForbidden},
+		{"operator route", http.MethodPost, "/addvm", `{"inventory":[]}`, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			r.Header.Set(authorizationHeader, bearerPrefix+res.Token)
+			srv.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
+
+func TestClientCertIdentities(t *testing.T) {
+	ks, err := auth.NewKeyStore(nil)
+	require.NoError(t, err)
+
+	h := NewHandler(getVMStorageMock(t), getSMStorageMock(t), WithKeyStore(ks))
+	rt := NewRouter()
+	registerRoutes(rt, h)
+	srv := AuthMiddleware(NewAuthenticator(ks, nil, map[string]auth.Identity{
+		"kiosk-123": {Name: "kiosk-123", Role: auth.RoleCustomer, MachineID: "123"},
+		"ops":       {Name: "ops", Role: auth.RoleOperator},
+	}), rt)
+
+	tests := []struct {
+		name   string
+		cn     string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"machine cert", "kiosk-123", http.MethodPost, "/insert", `{"machine_id":"123","inserted_amount":100}`,
+			http.StatusOK},
+		{"machine cert other machine", "kiosk-123", http.MethodPost, "/abort", `{"machine_id":"456"}`,
+			http.StatusForbidden},
+		{"operator cert", "ops", http.MethodPost, "/addvm", `{"inventory":[]}`, http.StatusOK},
+		{"unmapped cert", "stranger", http.MethodPost, "/addvm", `{"inventory":[]}`, http.StatusUnauthorized},
+		{"no cert", "", http.MethodPost, "/addvm", `{"inventory":[]}`, http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.cn != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: tc.cn}}
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+			srv.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
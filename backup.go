@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"vendingmachine/internal/backup"
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+const (
+	// maxBackupBytes caps the size of the backups restored through the api
+	maxBackupBytes = 256 << 20
+	// maxArchiveBytes caps the size of the backups once decompressed
+	maxArchiveBytes = 1 << 30
+)
+
+var (
+	errStorageNotEmpty  = errors.New("the storage has machines, restoring onto it must be forced")
+	errDuplicateMachine = errors.New("the machine is in the archive more than once")
+)
+
+// RestoreResult lists the ids of the machines restored from a backup.
+type RestoreResult struct {
+	Restored []string `json:"restored"`
+}
+
+// Backup reads every machine, its events and its metadata into an archive.
+// The machines are read one after the other, so the changes made while
+// backing up may be left out.
+func (s *Handler) Backup(ctx context.Context) (backup.Archive, error) {
+	ids, err := s.storedIDs(ctx)
+	if err != nil {
+		return backup.Archive{}, err
+	}
+
+	a := backup.Archive{CreatedAt: time.Now().UTC(), Machines: make([]backup.Machine, 0, len(ids))}
+	for _, id := range ids {
+		m, err := s.backupMachine(ctx, id)
+		if err != nil {
+			return backup.Archive{}, fmt.Errorf("failed to back up machine %q: %w", id, err)
+		}
+
+		// deleted since it was listed
+		if m.VM == nil && m.SM == nil && m.Metadata == nil {
+			continue
+		}
+
+		a.Machines = append(a.Machines, m)
+	}
+
+	return a, nil
+}
+
+func (s *Handler) backupMachine(ctx context.Context, id string) (backup.Machine, error) {
+	m := backup.Machine{ID: id}
+
+	vm, err := s.getVM(ctx, id)
+	if err == nil {
+		snap := vm.Snapshot()
+		m.VM = &snap
+
+		if m.Events, err = s.vmEvents(ctx, id); err != nil {
+			return backup.Machine{}, err
+		}
+	} else if !isNotFound(err) {
+		return backup.Machine{}, err
+	}
+
+	sm, err := s.getSM(ctx, id)
+	if err == nil {
+		snap := sm.Snapshot()
+		m.SM = &snap
+	} else if !isNotFound(err) {
+		return backup.Machine{}, err
+	}
+
+	md, err := s.getMetadata(ctx, id)
+	if err == nil {
+		m.Metadata = &md
+	} else if !errors.Is(err, storage.ErrMetadataNotFound) {
+		return backup.Machine{}, err
+	}
+
+	return m, nil
+}
+
+// Restore creates the machines of the archive. It fails with
+// errStorageNotEmpty if the storages have machines, unless forced, in which
+// case the machines of the archive replace the stored ones sharing their ids
+// and the others are kept. The restored machines start again at version 1.
+// An archive with a machine that can not be rebuilt fails with
+// backup.ErrInvalidBackup before any machine is changed.
+func (s *Handler) Restore(ctx context.Context, a backup.Archive, force bool) (RestoreResult, error) {
+	if !force {
+		ids, err := s.storedIDs(ctx)
+		if err != nil {
+			return RestoreResult{}, err
+		}
+
+		if len(ids) > 0 {
+			return RestoreResult{}, fmt.Errorf("%w: %d machines", errStorageNotEmpty, len(ids))
+		}
+	}
+
+	// every machine is rebuilt before any is written, so that a bad archive
+	// leaves the stored machines alone
+	machines := make([]restoredMachine, 0, len(a.Machines))
+	seen := make(map[string]bool, len(a.Machines))
+	for _, m := range a.Machines {
+		rm, err := s.rebuildMachine(m)
+		if err == nil && seen[m.ID] {
+			err = errDuplicateMachine
+		}
+		if err != nil {
+			return RestoreResult{}, fmt.Errorf("%w: machine %q: %w", backup.ErrInvalidBackup, m.ID, err)
+		}
+
+		seen[m.ID] = true
+		machines = append(machines, rm)
+	}
+
+	// the fleet file would otherwise be reconciled with half a restore
+	s.fleetMu.Lock()
+	defer s.fleetMu.Unlock()
+
+	res := RestoreResult{Restored: make([]string, 0, len(machines))}
+	for _, rm := range machines {
+		if err := s.restoreMachine(ctx, rm); err != nil {
+			return res, fmt.Errorf("failed to restore machine %q: %w", rm.id, err)
+		}
+		res.Restored = append(res.Restored, rm.id)
+	}
+
+	return res, nil
+}
+
+// restoredMachine is a machine of an archive, rebuilt and ready to be
+// stored. A nil twin or metadata is missing from the archive.
+type restoredMachine struct {
+	id string
+	vm *internalVM.VendingMachine
+	sm *statemachine.Machine
+	md *fleet.Metadata
+}
+
+func (s *Handler) rebuildMachine(m backup.Machine) (restoredMachine, error) {
+	if !fleet.ValidID(m.ID) {
+		return restoredMachine{}, fleet.ErrInvalidID
+	}
+
+	rm := restoredMachine{id: m.ID, md: m.Metadata}
+	if m.VM != nil {
+		vm, err := internalVM.Restore(*m.VM, internalVM.WithEvents(m.Events))
+		if err != nil {
+			return restoredMachine{}, fmt.Errorf("failed to restore vending machine: %w", err)
+		}
+		rm.vm = vm
+	}
+
+	if m.SM != nil {
+		sm, err := statemachine.Restore(*m.SM)
+		if err != nil {
+			return restoredMachine{}, fmt.Errorf("failed to restore state machine: %w", err)
+		}
+		rm.sm = sm
+	}
+
+	return rm, nil
+}
+
+// restoreMachine replaces the stored twins and metadata with the ones of the
+// archive, each in a single storage operation, and deletes the ones missing
+// from the archive.
+func (s *Handler) restoreMachine(ctx context.Context, rm restoredMachine) error {
+	var restored []machine
+
+	if rm.vm != nil {
+		if err := s.replaceVM(ctx, rm.id, rm.vm); err != nil {
+			return err
+		}
+		restored = append(restored, rm.vm)
+	} else if err := s.deleteVM(ctx, rm.id); err != nil {
+		return err
+	}
+
+	if rm.sm != nil {
+		if err := s.replaceSM(ctx, rm.id, rm.sm); err != nil {
+			return err
+		}
+		restored = append(restored, rm.sm)
+	} else if err := s.deleteSM(ctx, rm.id); err != nil {
+		return err
+	}
+
+	if rm.md != nil {
+		if err := s.setMetadata(ctx, rm.id, *rm.md); err != nil {
+			return err
+		}
+	} else if err := s.deleteMetadata(ctx, rm.id); err != nil {
+		return err
+	}
+
+	// the events of the replaced machine must not be replayed to the clients
+	s.events.Forget(rm.id)
+	s.observeMachines(rm.id, restored...)
+
+	return nil
+}
+
+// storedIDs returns the ids of the stored machines and of the metadata,
+// sorted.
+func (s *Handler) storedIDs(ctx context.Context) ([]string, error) {
+	vmIDs, err := s.vmStorage.ListVMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vending machines: %w", err)
+	}
+
+	smIDs, err := s.smStorage.ListSMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list state machines: %w", err)
+	}
+
+	mdIDs, err := s.listMachines(ctx, fleet.Filter{})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := slices.Concat(vmIDs, smIDs, mdIDs)
+	slices.Sort(ids)
+
+	return slices.Compact(ids), nil
+}
+
+// BackupHandler downloads a backup of every machine.
+func (s *Handler) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := s.Backup(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="vendingmachine-backup.json.gz"`)
+	if err := backup.Write(w, a); err != nil {
+		// the status is sent, the client gets a truncated backup which
+		// fails its checksum
+		loggerFromContext(r.Context()).Error("failed to write backup", slog.String("error", err.Error()))
+	}
+}
+
+// RestoreHandler restores the backup in the body, force=true restores onto
+// storages that have machines.
+func (s *Handler) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	var v ValidationError
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		force, err = strconv.ParseBool(value)
+		v.check(err == nil, "force", "must be true or false")
+	}
+	if len(v.Fields) > 0 {
+		decodeError(w, &v)
+		return
+	}
+
+	a, err := backup.Read(http.MaxBytesReader(w, r.Body, maxBackupBytes), maxArchiveBytes)
+	if err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	res, err := s.Restore(r.Context(), a, force)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	encode(w, http.StatusOK, res)
+}
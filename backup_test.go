@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/backup"
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// backedUpHandler returns a handler with a machine in the middle of a
+// purchase.
+func backedUpHandler(t *testing.T, vms VMStorage, sms SMStorage, md MetadataStorage) *Handler {
+	t.Helper()
+	ctx := context.Background()
+
+	h := NewHandler(vms, sms, WithMetadataStorage(md))
+	_, err := h.addVM(ctx, "lobby-1", fleet.Metadata{Site: "hq", Tags: []string{"cold"}},
+		[]internalVM.Item{{Name: "coke", Number: 2, Price: 100}})
+	require.NoError(t, err)
+	_, err = h.insertCoin(ctx, "lobby-1", 150)
+	require.NoError(t, err)
+	_, err = h.reprice(ctx, "lobby-1", "coke", 120, 0)
+	require.NoError(t, err)
+
+	return h
+}
+
+func TestBackupRestoreEndpoints(t *testing.T) {
+	ctx := context.Background()
+	from := backedUpHandler(t, storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(),
+		storage.NewInMemoryMetadataStorage())
+	fromRouter := NewRouter()
+	registerRoutes(fromRouter, from)
+
+	w := httptest.NewRecorder()
+	fromRouter.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/admin/backup", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	archive := w.Body.Bytes()
+
+	to := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	toRouter := NewRouter()
+	registerRoutes(toRouter, to)
+	restore := func(query string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		toRouter.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/admin/restore"+query,
+			bytes.NewReader(body)))
+
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, restore("", archive).Code)
+
+	want, err := from.machineState(ctx, "lobby-1")
+	require.NoError(t, err)
+	got, err := to.machineState(ctx, "lobby-1")
+	require.NoError(t, err)
+	want.Version, got.Version = 0, 0
+	assert.Equal(t, want, got)
+	assert.Equal(t, 150, got.InsertedAmount)
+
+	wantHistory, err := from.machineHistory(ctx, "lobby-1", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	gotHistory, err := to.machineHistory(ctx, "lobby-1", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, wantHistory, gotHistory)
+
+	md, err := to.machineMetadata(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, fleet.Metadata{Site: "hq", Tags: []string{"cold"}}, md)
+
+	// the machine is now there
+	assert.Equal(t, http.StatusConflict, restore("", archive).Code)
+	assert.Equal(t, http.StatusOK, restore("?force=true", archive).Code)
+	assert.Equal(t, http.StatusBadRequest, restore("?force=maybe", archive).Code)
+
+	corrupted := bytes.Clone(archive)
+	corrupted[len(corrupted)/2] ^= 0xff
+	assert.Equal(t, http.StatusBadRequest, restore("?force=true", corrupted).Code)
+}
+
+func TestRestoreInvalidArchive(t *testing.T) {
+	ctx := context.Background()
+	h := backedUpHandler(t, storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(),
+		storage.NewInMemoryMetadataStorage())
+
+	a, err := h.Backup(ctx)
+	require.NoError(t, err)
+	want, err := h.machineState(ctx, "lobby-1")
+	require.NoError(t, err)
+
+	broken := *a.Machines[0].VM
+	broken.State = "Broken"
+	a.Machines = append(a.Machines, backup.Machine{ID: "lobby-2", VM: &broken})
+
+	_, err = h.Restore(ctx, a, true)
+	require.ErrorIs(t, err, backup.ErrInvalidBackup)
+	assert.Equal(t, http.StatusBadRequest, httpStatus(err))
+
+	got, err := h.machineState(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, want, got, "the stored machines must be left alone")
+
+	a.Machines[1] = a.Machines[0]
+	_, err = h.Restore(ctx, a, true)
+	require.ErrorIs(t, err, errDuplicateMachine)
+}
+
+// writeSQLiteConfig writes a config storing the machines in a new sqlite
+// database.
+func writeSQLiteConfig(t *testing.T) (string, *Config) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	db := filepath.Join(dir, "vm.db")
+	require.NoError(t, os.WriteFile(path, []byte("storage: {backend: sqlite, sqlite: {path: "+db+"}}"), 0o600))
+
+	cfg := &Config{}
+	cfg.Storage.Backend = backendSQLite
+	cfg.Storage.SQLite.Path = db
+
+	return path, cfg
+}
+
+func TestBackupRestoreCommands(t *testing.T) {
+	ctx := context.Background()
+
+	fromConfig, cfg := writeSQLiteConfig(t)
+	stores, err := openStorages(ctx, cfg)
+	require.NoError(t, err)
+	backedUpHandler(t, stores.vm, stores.sm, stores.metadata)
+	require.NoError(t, stores.close())
+
+	archive := filepath.Join(t.TempDir(), "fleet.json.gz")
+	require.NoError(t, runCommand(ctx, cmdBackup, []string{"-configpath", fromConfig, "-out", archive}))
+
+	toConfig, cfg := writeSQLiteConfig(t)
+	restore := []string{"-configpath", toConfig, "-in", archive}
+	require.NoError(t, runCommand(ctx, cmdRestore, restore))
+	require.ErrorIs(t, runCommand(ctx, cmdRestore, restore), errStorageNotEmpty)
+	require.NoError(t, runCommand(ctx, cmdRestore, append(restore, "-force")))
+
+	stores, err = openStorages(ctx, cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, stores.close()) })
+
+	snap, err := NewHandler(stores.vm, stores.sm, WithMetadataStorage(stores.metadata)).machineState(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Selecting, snap.State)
+	assert.Equal(t, 150, snap.InsertedAmount)
+	coke, _ := snap.Item("coke")
+	assert.Equal(t, 120, coke.Price)
+
+	require.ErrorIs(t, runCommand(ctx, cmdBackup, []string{"-configpath", fromConfig}), errNoBackupPath)
+}
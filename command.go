@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"vendingmachine/internal/backup"
+)
+
+// the subcommands back up the storages of the config and restore them
+const (
+	cmdBackup  = "backup"
+	cmdRestore = "restore"
+)
+
+var (
+	errNoBackupPath  = errors.New("the path of the backup is required")
+	errMemoryBackend = errors.New("the memory storage lives in the server, use the admin backup and restore endpoints")
+)
+
+// runCommand runs the backup or restore subcommand with its arguments,
+// against the storage backend of the config.
+func runCommand(ctx context.Context, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("configpath", defaultConfigPath, "path to config yaml file")
+
+	var (
+		path  string
+		force bool
+	)
+	if name == cmdBackup {
+		flags.StringVar(&path, "out", "", "path of the backup to write")
+	} else {
+		flags.StringVar(&path, "in", "", "path of the backup to restore")
+		flags.BoolVar(&force, "force", false, "restore even if the storage has machines")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if path == "" {
+		return errNoBackupPath
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if cfg.Storage.Backend == backendMemory {
+		return errMemoryBackend
+	}
+
+	stores, err := openStorages(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer stores.close() //nolint: errcheck // nothing is left to write once the command is done
+
+	h := NewHandler(stores.vm, stores.sm, WithMetadataStorage(stores.metadata))
+	if name == cmdBackup {
+		return backupTo(ctx, h, path)
+	}
+
+	return restoreFrom(ctx, h, path, force)
+}
+
+// backupTo writes the backup next to path and renames it, so that path is
+// never a partial backup.
+func backupTo(ctx context.Context, h *Handler, path string) error {
+	a, err := h.Backup(ctx)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+	defer os.Remove(tmp) //nolint: errcheck // the removal fails once the backup is renamed
+
+	if err := backup.Write(f, a); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	slog.Info("backed up", slog.String("path", path), slog.Int("machines", len(a.Machines)))
+
+	return nil
+}
+
+func restoreFrom(ctx context.Context, h *Handler, path string, force bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+
+	a, err := backup.Read(f, maxArchiveBytes)
+	if err != nil {
+		return err
+	}
+
+	res, err := h.Restore(ctx, a, force)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("restored", slog.String("path", path), slog.Int("machines", len(res.Restored)),
+		slog.Time("backed_up_at", a.CreatedAt))
+
+	return nil
+}
@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
+// maxBodyBytes caps the size of the request bodies.
+const maxBodyBytes = 1 << 20
+
 func encode[T any](w http.ResponseWriter, status int, v T) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -15,10 +20,31 @@ func encode[T any](w http.ResponseWriter, status int, v T) {
 	}
 }
 
+// decode reads the json body into T, rejecting unknown fields and bodies
+// larger than maxBodyBytes, and validates it if T is a validator.
 func decode[T any](r *http.Request) (T, error) {
 	var v T
-	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+
+	// the tracer of the request's span, a no-op one if it is not traced
+	tracer := trace.SpanFromContext(r.Context()).TracerProvider().Tracer(tracerName)
+	_, span := tracer.Start(r.Context(), "decode")
+	defer span.End()
+
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		recordError(span, err)
 		return v, fmt.Errorf("failed to decode json: %w", err)
 	}
+
+	if val, ok := any(v).(validator); ok {
+		verr := &ValidationError{}
+		val.validate(verr)
+		if len(verr.Fields) > 0 {
+			recordError(span, verr)
+			return v, verr
+		}
+	}
+
 	return v, nil
 }
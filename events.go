@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vendingmachine/internal/events"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+const (
+	defaultEventBufferSize = 100
+	sseKeepAliveInterval   = 15 * time.Second
+)
+
+// EventsHandler streams the events of a machine as Server-Sent Events.
+// Clients may resume a broken stream by sending the Last-Event-ID header,
+// as long as the missed events are still in the machine's buffer.
+func (s *Handler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	_, err := s.machineState(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastEventID uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		lastEventID, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID: %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	backlog, ch, cancel := s.events.Subscribe(id, lastEventID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range backlog {
+		if err := writeSSE(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			// the broker closes the channel of subscribers that fall behind,
+			// the client is expected to reconnect with its Last-Event-ID
+			if !ok {
+				return
+			}
+
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w io.Writer, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	if err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+
+	return nil
+}
+
+// publishTransition publishes the events implied by a machine of the kind
+// moving from the before snapshot to the after snapshot.
+func (s *Handler) publishTransition(id, kind string, before, after internalVM.Snapshot) {
+	switch {
+	case before.State == internalVM.Idle && after.State == internalVM.Selecting:
+		s.events.Publish(id, events.CoinInserted, events.Data{
+			Kind:           kind,
+			State:          string(after.State),
+			InsertedAmount: after.InsertedAmount,
+		})
+	case before.State == internalVM.Selecting && after.State == internalVM.Delivering:
+		item, _ := after.Item(after.SelectedProduct)
+		s.events.Publish(id, events.ProductSelected, events.Data{
+			Kind:           kind,
+			State:          string(after.State),
+			InsertedAmount: after.InsertedAmount,
+			Product:        item.Name,
+			Price:          item.Price,
+		})
+	case before.State == internalVM.Delivering && after.State == internalVM.Idle:
+		item, _ := after.Item(before.SelectedProduct)
+		s.events.Publish(id, events.ProductDelivered, events.Data{
+			Kind:           kind,
+			State:          string(after.State),
+			InsertedAmount: after.InsertedAmount,
+			Product:        item.Name,
+			Price:          item.Price,
+		})
+		s.events.Publish(id, events.StockChanged, events.Data{
+			Kind:    kind,
+			Product: item.Name,
+			Stock:   &item.Number,
+		})
+		s.metrics.observeSale(id, item)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"vendingmachine/internal/events"
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+	mock_main "vendingmachine/mocks"
+)
+
+func TestEventsHandler(t *testing.T) {
+	t.Run("resume from last event id", func(t *testing.T) {
+		broker := events.NewBroker(10)
+		broker.Publish("123", events.CoinInserted, events.Data{InsertedAmount: 100})
+		broker.Publish("123", events.Aborted, events.Data{State: "Idle"})
+
+		h := NewHandler(getVMStorageMock(t), getSMStorageMock(t), WithEventBroker(broker))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/machines/123/events", nil).WithContext(ctx)
+		r.SetPathValue("id", "123")
+		r.Header.Set("Last-Event-ID", "1")
+		h.EventsHandler(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		assert.NotContains(t, w.Body.String(), "id: 1\n")
+		assert.Contains(t, w.Body.String(), "id: 2\nevent: aborted\n")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		vmStorage := mock_main.NewMockVMStorage(ctrl)
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, storage.ErrVMNotFound)
+		smStorage := mock_main.NewMockSMStorage(ctrl)
+		smStorage.EXPECT().GetSM(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, storage.ErrSMNotFound)
+
+		h := NewHandler(vmStorage, smStorage)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/machines/unknown/events", nil)
+		r.SetPathValue("id", "unknown")
+		h.EventsHandler(w, r)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("deleted machine", func(t *testing.T) {
+		ctx := context.Background()
+		broker := events.NewBroker(10)
+		h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), WithEventBroker(broker))
+
+		_, err := h.addVM(ctx, "lobby-1", fleet.Metadata{}, []internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+		require.NoError(t, err)
+		_, err = h.insertCoin(ctx, "lobby-1", 100)
+		require.NoError(t, err)
+		require.NoError(t, h.deleteMachine(ctx, "lobby-1"))
+
+		backlog, _, cancel := broker.Subscribe("lobby-1", 0)
+		cancel()
+		assert.Empty(t, backlog)
+	})
+}
+
+func TestPublishedKinds(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	res, err := h.addVM(ctx, "", fleet.Metadata{}, []internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+	require.NoError(t, err)
+
+	_, err = h.insertCoin(ctx, res.VMID, 100)
+	require.NoError(t, err)
+	amount := 100
+	_, err = h.transition(ctx, res.SMID, statemachine.Data{InsertedAmount: &amount})
+	require.NoError(t, err)
+	_, err = h.restock(ctx, res.VMID, []internalVM.Item{{Name: "coke", Number: 1}}, 0)
+	require.NoError(t, err)
+
+	backlog, _, cancel := h.events.Subscribe(res.VMID, 0)
+	cancel()
+
+	kinds := make([]string, 0, len(backlog))
+	for _, e := range backlog {
+		kinds = append(kinds, e.Data.Kind)
+	}
+	// the restock applies to both twins
+	assert.Equal(t, []string{kindVM, kindSM, ""}, kinds)
+}
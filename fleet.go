@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"vendingmachine/internal/events"
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+)
+
+var (
+	errFleetDisabled = errors.New("no fleet file is configured")
+	errNoFilter      = errors.New("a site or a tag is required")
+	errNotManaged    = errors.New("machine was not created from the fleet file")
+)
+
+// ReconcileResult lists the ids of the machines changed to match the fleet file.
+type ReconcileResult struct {
+	Created []string `json:"created"`
+	// Changed are the machines whose metadata, prices or products changed
+	Changed []string `json:"changed"`
+	// Removed are the machines no longer in the file, the machines created
+	// through the api are never removed
+	Removed []string `json:"removed"`
+	// Conflicts are the machines of the file whose id is taken by a machine
+	// created through the api, they are left untouched
+	Conflicts []string `json:"conflicts"`
+}
+
+func WithFleetFile(path string) HandlerOption {
+	return func(h *Handler) {
+		h.fleetFile = path
+	}
+}
+
+// ReconcileFleet reads the fleet file and creates, updates and removes the
+// machines to match it.
+func (s *Handler) ReconcileFleet(ctx context.Context) (ReconcileResult, error) {
+	if s.fleetFile == "" {
+		return ReconcileResult{}, errFleetDisabled
+	}
+
+	machines, err := fleet.Load(s.fleetFile)
+	if err != nil {
+		return ReconcileResult{}, err
+	}
+
+	v := &ValidationError{}
+	for i, m := range machines {
+		validateMetadata(v, fmt.Sprintf("machines[%d].metadata", i), m.Metadata)
+		validateItems(v, fmt.Sprintf("machines[%d].inventory", i), m.Inventory, false)
+	}
+	if len(v.Fields) > 0 {
+		return ReconcileResult{}, fmt.Errorf("%w: %w", fleet.ErrInvalidFleet, v)
+	}
+
+	return s.reconcileFleet(ctx, machines)
+}
+
+// reconcileFleet stops at the first error, the result lists what was done
+// until then.
+func (s *Handler) reconcileFleet(ctx context.Context, machines []fleet.Machine) (ReconcileResult, error) {
+	s.fleetMu.Lock()
+	defer s.fleetMu.Unlock()
+
+	res := ReconcileResult{Created: []string{}, Changed: []string{}, Removed: []string{}, Conflicts: []string{}}
+	declared := make(map[string]bool, len(machines))
+
+	for _, m := range machines {
+		declared[m.ID] = true
+
+		created, changed, err := s.syncMachine(ctx, m)
+		if errors.Is(err, errNotManaged) {
+			res.Conflicts = append(res.Conflicts, m.ID)
+			continue
+		} else if err != nil {
+			return res, fmt.Errorf("failed to reconcile machine %q: %w", m.ID, err)
+		}
+
+		switch {
+		case created:
+			res.Created = append(res.Created, m.ID)
+		case changed:
+			res.Changed = append(res.Changed, m.ID)
+		}
+	}
+
+	managed, err := s.listMachines(ctx, fleet.Filter{Managed: true})
+	if err != nil {
+		return res, err
+	}
+
+	for _, id := range managed {
+		if declared[id] {
+			continue
+		}
+
+		if err := s.deleteMachine(ctx, id); err != nil {
+			return res, fmt.Errorf("failed to remove machine %q: %w", id, err)
+		}
+		res.Removed = append(res.Removed, id)
+	}
+
+	return res, nil
+}
+
+// syncMachine creates the machine if it does not exist yet, otherwise it
+// applies the metadata and prices and adds the missing products. It fails
+// with errNotManaged if the machine was created through the api.
+func (s *Handler) syncMachine(ctx context.Context, m fleet.Machine) (bool, bool, error) {
+	declared := m.Metadata
+	declared.Managed = true
+
+	vm, err := s.getVM(ctx, m.ID)
+	if errors.Is(err, storage.ErrVMNotFound) {
+		if err := s.createMachine(ctx, m.ID, declared, m.Inventory); err != nil {
+			return false, false, err
+		}
+
+		return true, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+
+	md, err := s.getMetadata(ctx, m.ID)
+	if err != nil && !errors.Is(err, storage.ErrMetadataNotFound) {
+		return false, false, err
+	}
+
+	// the machine belongs to whoever created it through the api
+	if !md.Managed {
+		return false, false, errNotManaged
+	}
+
+	changed := !md.Equal(declared)
+	if changed {
+		if err := s.setMetadata(ctx, m.ID, declared); err != nil {
+			return false, false, err
+		}
+	}
+
+	type change struct {
+		apply func(ctx context.Context, target machine) error
+		event events.Type
+		data  events.Data
+	}
+
+	var changes []change
+	before := vm.Snapshot()
+	for _, item := range m.Inventory {
+		current, ok := before.Item(item.Name)
+
+		switch {
+		case !ok && item.Number > 0:
+			// products without stock can only be added by a restock
+			changes = append(changes, change{
+				apply: func(ctx context.Context, target machine) error { return target.Restock(ctx, item) },
+				event: events.StockChanged,
+				data:  events.Data{Product: item.Name, Price: item.Price, Stock: &item.Number},
+			})
+		case ok && current.Price != item.Price:
+			changes = append(changes, change{
+				apply: func(ctx context.Context, target machine) error {
+					return target.SetPrice(ctx, item.Name, item.Price)
+				},
+				event: events.PriceChanged,
+				data:  events.Data{Product: item.Name, Price: item.Price},
+			})
+		}
+	}
+
+	if len(changes) == 0 {
+		return false, changed, nil
+	}
+
+	_, err = s.changeMachines(ctx, m.ID, "fleet.Reconcile", 0, func(ctx context.Context, target machine) error {
+		for _, c := range changes {
+			if err := c.apply(ctx, target); err != nil {
+				return fmt.Errorf("failed to update %q: %w", c.data.Product, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, c := range changes {
+		s.events.Publish(m.ID, c.event, c.data)
+	}
+
+	return false, true, nil
+}
+
+func (s *Handler) ReconcileFleetHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.ReconcileFleet(r.Context())
+	switch {
+	case errors.Is(err, errFleetDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, fleet.ErrInvalidFleet):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case err != nil:
+		writeError(w, r, err)
+	default:
+		encode(w, http.StatusOK, res)
+	}
+}
+
+// BulkResult lists the machines a bulk operation was applied to, the
+// failures do not stop the other machines from being updated.
+type BulkResult struct {
+	Updated []string      `json:"updated"`
+	Failed  []BulkFailure `json:"failed"`
+}
+
+type BulkFailure struct {
+	MachineID string `json:"machine_id"`
+	Error     string `json:"error"`
+}
+
+// bulkFilter reads the machines targeted by a bulk operation, targeting
+// every machine by mistake is prevented by requiring a site or a tag.
+func bulkFilter(w http.ResponseWriter, r *http.Request) (fleet.Filter, bool) {
+	f := filterFromQuery(r)
+	if f.Empty() {
+		http.Error(w, errNoFilter.Error(), http.StatusBadRequest)
+		return fleet.Filter{}, false
+	}
+
+	return f, true
+}
+
+func (s *Handler) BulkRestockHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := bulkFilter(w, r)
+	if !ok {
+		return
+	}
+
+	req, err := decode[RestockRequest](r)
+	if err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	res, err := s.bulkRestock(r.Context(), f, req.Items)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	encode(w, http.StatusOK, res)
+}
+
+func (s *Handler) BulkRepriceHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := bulkFilter(w, r)
+	if !ok {
+		return
+	}
+
+	req, err := decode[RepriceRequest](r)
+	if err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	res, err := s.bulkReprice(r.Context(), f, req.Product, req.Price)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	encode(w, http.StatusOK, res)
+}
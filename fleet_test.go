@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+func TestReconcileFleet(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fleet.yaml")
+	writeFleet := func(yaml string) {
+		require.NoError(t, os.WriteFile(path, []byte(yaml), 0o600))
+	}
+
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), WithFleetFile(path))
+	unmanaged, err := h.addVM(ctx, "", fleet.Metadata{}, nil)
+	require.NoError(t, err)
+
+	writeFleet(`
+machines:
+  - id: lobby-1
+    metadata: {site: hq, tags: [indoor]}
+    inventory: [{name: coffee, number: 5, price: 150}]
+  - id: garage-1
+    inventory: [{name: coke, number: 5, price: 120}]
+`)
+	res, err := h.ReconcileFleet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lobby-1", "garage-1"}, res.Created)
+
+	md, err := h.getMetadata(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, fleet.Metadata{Site: "hq", Tags: []string{"indoor"}, Managed: true}, md)
+
+	// sales are not undone by a reconciliation
+	_, err = h.insertCoin(ctx, "lobby-1", 150)
+	require.NoError(t, err)
+	_, err = h.selectProduct(ctx, "lobby-1", "coffee")
+	require.NoError(t, err)
+
+	res, err = h.ReconcileFleet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ReconcileResult{Created: []string{}, Changed: []string{}, Removed: []string{}, Conflicts: []string{}},
+		res)
+
+	writeFleet(`
+machines:
+  - id: lobby-1
+    metadata: {site: hq, tags: [indoor]}
+    inventory: [{name: coffee, number: 5, price: 200}, {name: tea, number: 3, price: 100}]
+`)
+	res, err = h.ReconcileFleet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ReconcileResult{
+		Created: []string{}, Changed: []string{"lobby-1"}, Removed: []string{"garage-1"}, Conflicts: []string{},
+	}, res)
+
+	vm, err := h.getVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	sm, err := h.getSM(ctx, "lobby-1")
+	require.NoError(t, err)
+
+	coffee, _ := vm.Snapshot().Item("coffee")
+	assert.Equal(t, internalVM.Item{Name: "coffee", Number: 4, Price: 200}, coffee)
+	assert.Equal(t, vm.Snapshot().Inventory[1:], sm.Snapshot().Inventory[1:])
+	coffee, _ = sm.Snapshot().Item("coffee")
+	assert.Equal(t, 200, coffee.Price)
+
+	_, err = h.machineState(ctx, "garage-1")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+	_, err = h.machineState(ctx, unmanaged.VMID)
+	require.NoError(t, err, "machines created through the api must be kept")
+
+	// a machine created through the api is not taken over by the file
+	writeFleet(`
+machines:
+  - id: lobby-1
+    metadata: {site: hq, tags: [indoor]}
+    inventory: [{name: coffee, number: 5, price: 200}, {name: tea, number: 3, price: 100}]
+  - id: ` + unmanaged.VMID + `
+    metadata: {site: hq}
+    inventory: [{name: coke, number: 5, price: 120}]
+`)
+	res, err = h.ReconcileFleet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{unmanaged.VMID}, res.Conflicts)
+
+	md, err = h.getMetadata(ctx, unmanaged.VMID)
+	require.NoError(t, err)
+	assert.Equal(t, fleet.Metadata{}, md)
+	snap, err := h.machineState(ctx, unmanaged.VMID)
+	require.NoError(t, err)
+	assert.Empty(t, snap.Inventory)
+}
+
+func TestReconcileFleetHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fleet.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+machines:
+  - id: lobby-1
+    inventory: [{name: coffee, number: 5, price: 0}]
+`), 0o600))
+
+	tests := []struct {
+		name   string
+		opts   []HandlerOption
+		status int
+	}{
+		{"disabled", nil, http.StatusNotFound},
+		{"invalid inventory", []HandlerOption{WithFleetFile(path)}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), tc.opts...)
+
+			w := httptest.NewRecorder()
+			h.ReconcileFleetHandler(w, httptest.NewRequest(http.MethodPost, "/v1/fleet/reconcile", nil))
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("machines: [{id: lobby-1}]"), 0o600))
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), WithFleetFile(path))
+	w := httptest.NewRecorder()
+	h.ReconcileFleetHandler(w, httptest.NewRequest(http.MethodPost, "/v1/fleet/reconcile", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var res ReconcileResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, []string{"lobby-1"}, res.Created)
+}
+
+func TestListMachinesHandler(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	inventory := []internalVM.Item{{Name: "coke", Number: 5, Price: 100}}
+
+	for id, md := range map[string]fleet.Metadata{
+		"hq-1":   {Site: "hq", Tags: []string{"cold", "indoor"}},
+		"hq-2":   {Site: "hq", Tags: []string{"indoor"}},
+		"dock-1": {Site: "dock", Tags: []string{"cold"}},
+	} {
+		_, err := h.addVM(ctx, id, md, inventory)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{"dock-1", "hq-1", "hq-2"}},
+		{"?site=hq", []string{"hq-1", "hq-2"}},
+		{"?tag=cold", []string{"dock-1", "hq-1"}},
+		{"?site=hq&tag=cold", []string{"hq-1"}},
+		{"?tag=cold&tag=indoor", []string{"hq-1"}},
+		{"?site=nowhere", []string{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ListMachinesHandler(w, httptest.NewRequest(http.MethodGet, "/v1/machines"+tc.query, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var res ListMachinesResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+			ids := []string{}
+			for _, m := range res.Machines {
+				ids = append(ids, m.ID)
+			}
+			assert.Equal(t, tc.ids, ids)
+		})
+	}
+}
+
+func TestUpdateMetadataHandler(t *testing.T) {
+	rt := NewRouter()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	registerRoutes(rt, h)
+
+	_, err := h.addVM(context.Background(), "hq-1", fleet.Metadata{Site: "hq"}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"valid", "hq-1", `{"site":"dock","geo":{"lat":52.5,"lon":13.4},"installed_on":"2024-03-01","tags":["cold"]}`,
+			http.StatusOK},
+		{"invalid date", "hq-1", `{"installed_on":"yesterday"}`, http.StatusBadRequest},
+		{"invalid geo", "hq-1", `{"geo":{"lat":91,"lon":0}}`, http.StatusBadRequest},
+		{"duplicate tag", "hq-1", `{"tags":["cold","cold"]}`, http.StatusBadRequest},
+		{"unknown machine", "hq-2", `{"site":"dock"}`, http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/v1/machines/"+tc.id+"/metadata", strings.NewReader(tc.body))
+			rt.mux.ServeHTTP(w, r)
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+		})
+	}
+
+	ids, err := h.listMachines(context.Background(), fleet.Filter{Site: "dock", Tags: []string{"cold"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hq-1"}, ids, "the indexes must follow the updates")
+}
+
+func TestBulkRepriceHandler(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+
+	_, err := h.addVM(ctx, "cold-1", fleet.Metadata{Tags: []string{"cold"}},
+		[]internalVM.Item{{Name: "coke", Number: 5, Price: 100}})
+	require.NoError(t, err)
+	_, err = h.addVM(ctx, "cold-2", fleet.Metadata{Tags: []string{"cold"}},
+		[]internalVM.Item{{Name: "water", Number: 5, Price: 80}})
+	require.NoError(t, err)
+	_, err = h.addVM(ctx, "warm-1", fleet.Metadata{}, []internalVM.Item{{Name: "coke", Number: 5, Price: 100}})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h.BulkRepriceHandler(w, httptest.NewRequest(http.MethodPost, "/v1/fleet/reprice",
+		strings.NewReader(`{"product":"coke","price":150}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "a filter is required")
+
+	w = httptest.NewRecorder()
+	h.BulkRepriceHandler(w, httptest.NewRequest(http.MethodPost, "/v1/fleet/reprice?tag=cold",
+		strings.NewReader(`{"product":"coke","price":150}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var res BulkResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, []string{"cold-1"}, res.Updated)
+	require.Len(t, res.Failed, 1)
+	assert.Equal(t, "cold-2", res.Failed[0].MachineID)
+
+	for id, price := range map[string]int{"cold-1": 150, "warm-1": 100} {
+		snap, err := h.machineState(ctx, id)
+		require.NoError(t, err)
+		coke, _ := snap.Item("coke")
+		assert.Equal(t, price, coke.Price, id)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	vendingmachinev1 "vendingmachine/api/vendingmachine/v1"
+	"vendingmachine/internal/events"
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// GRPCServer serves the same operations as the Handler over grpc, sharing
+// its storages and event broker.
+type GRPCServer struct {
+	vendingmachinev1.UnimplementedVendingMachineServiceServer
+
+	h *Handler
+}
+
+func NewGRPCServer(h *Handler, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	vendingmachinev1.RegisterVendingMachineServiceServer(srv, &GRPCServer{h: h})
+
+	return srv
+}
+
+func (g *GRPCServer) CreateMachine(ctx context.Context, req *vendingmachinev1.CreateMachineRequest,
+) (*vendingmachinev1.CreateMachineResponse, error) {
+	inventory := make([]internalVM.Item, 0, len(req.GetInventory()))
+	for _, item := range req.GetInventory() {
+		inventory = append(inventory, internalVM.Item{
+			Name:   item.GetName(),
+			Number: int(item.GetNumber()),
+			Price:  int(item.GetPrice()),
+		})
+	}
+
+	res, err := g.h.addVM(ctx, req.GetMachineId(), fleet.Metadata{}, inventory)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &vendingmachinev1.CreateMachineResponse{
+		MachineId:      res.VMID,
+		StatemachineId: res.SMID,
+	}, nil
+}
+
+func (g *GRPCServer) InsertCoin(ctx context.Context, req *vendingmachinev1.InsertCoinRequest,
+) (*vendingmachinev1.MachineState, error) {
+	snap, err := g.h.insertCoin(ctx, req.GetMachineId(), int(req.GetInsertedAmount()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return machineStateProto(req.GetMachineId(), snap), nil
+}
+
+func (g *GRPCServer) SelectProduct(ctx context.Context, req *vendingmachinev1.SelectProductRequest,
+) (*vendingmachinev1.MachineState, error) {
+	snap, err := g.h.selectProduct(ctx, req.GetMachineId(), req.GetSelectedProduct())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return machineStateProto(req.GetMachineId(), snap), nil
+}
+
+func (g *GRPCServer) AbortOrder(ctx context.Context, req *vendingmachinev1.AbortOrderRequest,
+) (*vendingmachinev1.MachineState, error) {
+	snap, _, err := g.h.abortOrder(ctx, req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return machineStateProto(req.GetMachineId(), snap), nil
+}
+
+func (g *GRPCServer) Transition(ctx context.Context, req *vendingmachinev1.TransitionRequest,
+) (*vendingmachinev1.MachineState, error) {
+	var data statemachine.Data
+	if req.InsertedAmount != nil {
+		amount := int(req.GetInsertedAmount())
+		data.InsertedAmount = &amount
+	}
+	if req.SelectedProduct != nil {
+		product := req.GetSelectedProduct()
+		data.SelectedProd = &product
+	}
+
+	snap, err := g.h.transition(ctx, req.GetMachineId(), data)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return machineStateProto(req.GetMachineId(), snap), nil
+}
+
+func (g *GRPCServer) GetState(ctx context.Context, req *vendingmachinev1.GetStateRequest,
+) (*vendingmachinev1.MachineState, error) {
+	snap, err := g.h.machineState(ctx, req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return machineStateProto(req.GetMachineId(), snap), nil
+}
+
+func (g *GRPCServer) StreamEvents(req *vendingmachinev1.StreamEventsRequest,
+	stream vendingmachinev1.VendingMachineService_StreamEventsServer,
+) error {
+	_, err := g.h.machineState(stream.Context(), req.GetMachineId())
+	if err != nil {
+		return grpcError(err)
+	}
+
+	backlog, ch, cancel := g.h.events.Subscribe(req.GetMachineId(), req.GetLastEventId())
+	defer cancel()
+
+	for _, e := range backlog {
+		if err := stream.Send(eventProto(e)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-ch:
+			if !ok {
+				if g.h.draining.Load() {
+					return grpcError(errShuttingDown)
+				}
+
+				return status.Error(codes.ResourceExhausted,
+					"subscriber fell behind, resume with the last received event id")
+			}
+
+			if err := stream.Send(eventProto(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcError maps the errors returned by the operations to grpc status errors.
+func grpcError(err error) error {
+	var code codes.Code
+
+	switch {
+	case errors.Is(err, storage.ErrVMNotFound), errors.Is(err, storage.ErrSMNotFound):
+		code = codes.NotFound
+	case errors.Is(err, errNoAmount), errors.Is(err, errNoProduct),
+		errors.Is(err, internalVM.ErrInvalidProduct), errors.Is(err, statemachine.ErrInvalidProduct),
+		errors.Is(err, internalVM.ErrInvalidItem), errors.Is(err, statemachine.ErrInvalidItem):
+		code = codes.InvalidArgument
+	case errors.Is(err, internalVM.ErrOutOfStock), errors.Is(err, statemachine.ErrOutOfStock),
+		errors.Is(err, internalVM.ErrInsufficientFunds), errors.Is(err, statemachine.ErrInsufficientFunds),
+		errors.Is(err, internalVM.ErrBadState), errors.Is(err, statemachine.ErrBadState):
+		code = codes.FailedPrecondition
+	case errors.Is(err, fleet.ErrInvalidID), errors.Is(err, errInvalidRequest):
+		code = codes.InvalidArgument
+	case errors.Is(err, storage.ErrVMExists), errors.Is(err, storage.ErrSMExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, errSessionActive), errors.Is(err, storage.ErrVersionConflict):
+		code = codes.Aborted
+	case errors.Is(err, errShuttingDown):
+		code = codes.Unavailable
+	default:
+		code = codes.Internal
+	}
+
+	return status.Error(code, err.Error())
+}
+
+func machineStateProto(id string, snap internalVM.Snapshot) *vendingmachinev1.MachineState {
+	inventory := make([]*vendingmachinev1.Item, 0, len(snap.Inventory))
+	for _, item := range snap.Inventory {
+		inventory = append(inventory, &vendingmachinev1.Item{
+			Name:   item.Name,
+			Number: int64(item.Number),
+			Price:  int64(item.Price),
+		})
+	}
+
+	return &vendingmachinev1.MachineState{
+		MachineId:       id,
+		State:           string(snap.State),
+		InsertedAmount:  int64(snap.InsertedAmount),
+		SelectedProduct: snap.SelectedProduct,
+		Inventory:       inventory,
+		Version:         snap.Version,
+	}
+}
+
+func eventProto(e events.Event) *vendingmachinev1.Event {
+	pe := &vendingmachinev1.Event{
+		Id:             e.ID,
+		MachineId:      e.MachineID,
+		Kind:           e.Data.Kind,
+		Type:           string(e.Type),
+		TimeUnixNano:   e.Time.UnixNano(),
+		State:          e.Data.State,
+		InsertedAmount: int64(e.Data.InsertedAmount),
+		Product:        e.Data.Product,
+		Price:          int64(e.Data.Price),
+	}
+
+	if e.Data.Stock != nil {
+		stock := int64(*e.Data.Stock)
+		pe.Stock = &stock
+	}
+
+	return pe
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	vendingmachinev1 "vendingmachine/api/vendingmachine/v1"
+	"vendingmachine/internal/storage"
+)
+
+func TestGRPCServer(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewGRPCServer(h)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := vendingmachinev1.NewVendingMachineServiceClient(conn)
+	ctx := context.Background()
+
+	created, err := client.CreateMachine(ctx, &vendingmachinev1.CreateMachineRequest{
+		Inventory: []*vendingmachinev1.Item{
+			{Name: "coke", Number: 1, Price: 100},
+			{Name: "milk", Number: 0, Price: 80},
+		},
+	})
+	require.NoError(t, err)
+	id := created.GetMachineId()
+
+	t.Run("purchase", func(t *testing.T) {
+		state, err := client.InsertCoin(ctx, &vendingmachinev1.InsertCoinRequest{MachineId: id, InsertedAmount: 150})
+		require.NoError(t, err)
+		assert.Equal(t, "Selecting", state.GetState())
+
+		state, err = client.SelectProduct(ctx, &vendingmachinev1.SelectProductRequest{
+			MachineId: id, SelectedProduct: "coke",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "Idle", state.GetState())
+		assert.Equal(t, int64(50), state.GetInsertedAmount())
+
+		state, err = client.GetState(ctx, &vendingmachinev1.GetStateRequest{MachineId: id})
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), state.GetInventory()[0].GetNumber())
+	})
+
+	t.Run("status codes", func(t *testing.T) {
+		_, err := client.GetState(ctx, &vendingmachinev1.GetStateRequest{MachineId: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		_, err = client.InsertCoin(ctx, &vendingmachinev1.InsertCoinRequest{MachineId: id})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = client.InsertCoin(ctx, &vendingmachinev1.InsertCoinRequest{MachineId: id, InsertedAmount: 100})
+		require.NoError(t, err)
+		_, err = client.SelectProduct(ctx, &vendingmachinev1.SelectProductRequest{
+			MachineId: id, SelectedProduct: "milk",
+		})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		_, err := client.CreateMachine(ctx, &vendingmachinev1.CreateMachineRequest{
+			Inventory: []*vendingmachinev1.Item{
+				{Name: "coke", Number: -1, Price: 100},
+				{Name: "coke", Number: 1, Price: -100},
+			},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = client.InsertCoin(ctx, &vendingmachinev1.InsertCoinRequest{MachineId: id, InsertedAmount: -100})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		amount := int64(-100)
+		_, err = client.Transition(ctx, &vendingmachinev1.TransitionRequest{MachineId: id, InsertedAmount: &amount})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("stream events", func(t *testing.T) {
+		stream, err := client.StreamEvents(ctx, &vendingmachinev1.StreamEventsRequest{MachineId: id})
+		require.NoError(t, err)
+
+		e, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), e.GetId())
+		assert.Equal(t, "coin_inserted", e.GetType())
+		assert.Equal(t, kindVM, e.GetKind())
+	})
+}
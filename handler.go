@@ -1,245 +1,642 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"log/slog"
 	"net/http"
-
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"vendingmachine/internal/auth"
+	"vendingmachine/internal/backup"
+	"vendingmachine/internal/events"
+	"vendingmachine/internal/fleet"
 	"vendingmachine/internal/statemachine"
 	"vendingmachine/internal/storage"
 	internalVM "vendingmachine/internal/vendingmachine"
 )
 
+const (
+	defaultTokenTTL    = 5 * time.Minute
+	defaultMaxTokenTTL = time.Hour
+)
+
 type VMStorage interface {
-	GetVM(id string) (*internalVM.VendingMachine, error)
-	SaveVM(vm *internalVM.VendingMachine) (id string, err error)
+	// GetVM returns a copy of the stored machine, its snapshot carries the
+	// version it was read at
+	GetVM(ctx context.Context, id string) (*internalVM.VendingMachine, error)
+	// CreateVM stores the machine under the id at version 1, it fails with
+	// storage.ErrVMExists if the id is taken
+	CreateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	// ReplaceVM stores the machine under the id at version 1 in a single
+	// operation, replacing the stored machine and its events if there is one
+	ReplaceVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	// UpdateVM saves a machine read by GetVM if the stored one is still at
+	// the version it was read at, failing with storage.ErrVersionConflict
+	// otherwise. The saved machine's version is one more.
+	UpdateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	// VMEvents returns the events of the machine, oldest first, the storages
+	// append the events of the machines they create and update
+	VMEvents(ctx context.Context, id string) ([]internalVM.Event, error)
+	DeleteVM(ctx context.Context, id string) error
+	ListVMs(ctx context.Context) ([]string, error)
 }
 
+// SMStorage is VMStorage for the state machines.
 type SMStorage interface {
-	GetSM(id string) (*statemachine.Machine, error)
-	SaveSM(sm *statemachine.Machine) (id string, err error)
+	GetSM(ctx context.Context, id string) (*statemachine.Machine, error)
+	CreateSM(ctx context.Context, id string, sm *statemachine.Machine) error
+	ReplaceSM(ctx context.Context, id string, sm *statemachine.Machine) error
+	UpdateSM(ctx context.Context, id string, sm *statemachine.Machine) error
+	DeleteSM(ctx context.Context, id string) error
+	ListSMs(ctx context.Context) ([]string, error)
+}
+
+type MetadataStorage interface {
+	// GetMetadata fails with storage.ErrMetadataNotFound for an unknown machine
+	GetMetadata(ctx context.Context, id string) (fleet.Metadata, error)
+	SetMetadata(ctx context.Context, id string, md fleet.Metadata) error
+	DeleteMetadata(ctx context.Context, id string) error
+	// ListMachines returns the ids of the machines matching the filter, sorted
+	ListMachines(ctx context.Context, f fleet.Filter) ([]string, error)
 }
 
 type Handler struct {
 	vmStorage VMStorage
 	smStorage SMStorage
+	// metadata keeps the site, model and tags of the machines
+	metadata MetadataStorage
+	events   *events.Broker
+
+	// cfgMu guards the configs that can be changed while serving
+	cfgMu      sync.RWMutex
+	sessions   *sessionRegistry
+	sessionCfg SessionConfig
+
+	keys *auth.KeyStore
+	// jwt is nil when bearer tokens are disabled
+	jwt      *auth.JWTManager
+	tokenCfg TokenConfig
+
+	// limiter is nil when rate limiting is disabled
+	limiter *RateLimiter
+
+	metrics *Metrics
+	tracer  trace.Tracer
+	health  *Health
+
+	// fleetMu serializes the reconciliations of the fleet file
+	fleetMu   sync.Mutex
+	fleetFile string
+
+	// draining is set on shutdown, new sessions and purchases are rejected
+	draining atomic.Bool
+}
+
+// HandlerOption is used to customize the Handler dependencies.
+type HandlerOption func(*Handler)
+
+func WithEventBroker(b *events.Broker) HandlerOption {
+	return func(h *Handler) {
+		h.events = b
+	}
+}
+
+func WithMetadataStorage(ms MetadataStorage) HandlerOption {
+	return func(h *Handler) {
+		h.metadata = ms
+	}
+}
+
+func WithKeyStore(ks *auth.KeyStore) HandlerOption {
+	return func(h *Handler) {
+		h.keys = ks
+	}
+}
+
+func WithMetrics(m *Metrics) HandlerOption {
+	return func(h *Handler) {
+		h.metrics = m
+	}
+}
+
+func WithRateLimiter(rl *RateLimiter) HandlerOption {
+	return func(h *Handler) {
+		h.limiter = rl
+	}
 }
 
-func NewHandler(vmStorage VMStorage, smStorage SMStorage) *Handler {
-	return &Handler{
+// TokenConfig configures the lifetime of the minted session tokens.
+type TokenConfig struct {
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
+// withDefaults returns the config with the unset ttls defaulted.
+func (c TokenConfig) withDefaults() TokenConfig {
+	if c.DefaultTTL <= 0 {
+		c.DefaultTTL = defaultTokenTTL
+	}
+	if c.MaxTTL <= 0 {
+		c.MaxTTL = defaultMaxTokenTTL
+	}
+
+	return c
+}
+
+func WithJWT(m *auth.JWTManager, cfg TokenConfig) HandlerOption {
+	return func(h *Handler) {
+		h.jwt = m
+		h.tokenCfg = cfg.withDefaults()
+	}
+}
+
+// SetTokenConfig changes the lifetime of the tokens minted from now on.
+func (s *Handler) SetTokenConfig(cfg TokenConfig) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	s.tokenCfg = cfg.withDefaults()
+}
+
+func (s *Handler) tokenConfig() TokenConfig {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+
+	return s.tokenCfg
+}
+
+func NewHandler(vmStorage VMStorage, smStorage SMStorage, opts ...HandlerOption) *Handler {
+	h := &Handler{
 		vmStorage: vmStorage,
 		smStorage: smStorage,
+		events:    events.NewBroker(defaultEventBufferSize),
+		sessions:  newSessionRegistry(),
+		metadata:  storage.NewInMemoryMetadataStorage(),
+		metrics:   NewMetrics(),
+		health:    NewHealth(),
+		tracer:    noop.NewTracerProvider().Tracer(tracerName),
+		tokenCfg:  TokenConfig{}.withDefaults(),
+	}
+
+	for _, o := range opts {
+		o(h)
 	}
+
+	if h.keys == nil {
+		h.keys, _ = auth.NewKeyStore(nil)
+	}
+
+	return h
 }
 
 type AddVMRequest struct {
+	// MachineID is chosen by the caller, e.g. the serial number of the
+	// cabinet, a random one is generated if it is empty
+	MachineID string `json:"machine_id,omitempty"`
+	// Metadata is optional, its managed field is ignored
+	Metadata  fleet.Metadata    `json:"metadata"`
 	Inventory []internalVM.Item `json:"inventory"`
 }
 
+func (r AddVMRequest) validate(v *ValidationError) {
+	v.check(r.MachineID == "" || fleet.ValidID(r.MachineID), "machine_id",
+		"must be 1 to 64 letters, digits, dots, dashes or underscores")
+	validateMetadata(v, "metadata", r.Metadata)
+	validateItems(v, "inventory", r.Inventory, false)
+}
+
+// AddVMResponse holds the id addressing both the vending machine and its
+// state machine twin.
 type AddVMResponse struct {
 	VMID string `json:"machine_id"`
+	// SMID is the same as VMID, it is kept for the clients reading it
 	SMID string `json:"statemachine_id"`
 }
 
 func (s *Handler) AddVMHandler(w http.ResponseWriter, r *http.Request) {
 	req, err := decode[AddVMRequest](r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		decodeError(w, err)
 		return
 	}
 
-	vm, err := internalVM.New(req.Inventory)
+	res, err := s.addVM(r.Context(), req.MachineID, req.Metadata, req.Inventory)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	vmID, err := s.vmStorage.SaveVM(vm)
+	encode(w, http.StatusOK, res)
+}
+
+type InsertCoinRequest struct {
+	ID     string `json:"machine_id"`
+	Amount int    `json:"inserted_amount"`
+}
+
+func (r InsertCoinRequest) validate(v *ValidationError) {
+	v.check(r.ID != "", "machine_id", "must not be empty")
+	v.check(r.Amount > 0, "inserted_amount", "must be positive")
+}
+
+func (s *Handler) InsertCoinHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[InsertCoinRequest](r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		decodeError(w, err)
 		return
 	}
 
-	sm, err := statemachine.New(req.Inventory)
+	_, err = s.insertCoin(r.Context(), req.ID, req.Amount)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	smID, err := s.smStorage.SaveSM(sm)
+	_, err = w.Write([]byte("inserted coin successfully"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
+}
 
-	encode(w, http.StatusOK, AddVMResponse{VMID: vmID, SMID: smID})
+type SelectProductRequest struct {
+	ID      string `json:"machine_id"`
+	Product string `json:"selected_product"`
 }
 
-type InsertCoinRequest struct {
-	ID     string `json:"machine_id"`
-	Amount int    `json:"inserted_amount"`
+func (r SelectProductRequest) validate(v *ValidationError) {
+	v.check(r.ID != "", "machine_id", "must not be empty")
+	v.check(r.Product != "", "selected_product", "must not be empty")
 }
 
-func (s *Handler) InsertCoinHandler(w http.ResponseWriter, r *http.Request) {
-	req, err := decode[InsertCoinRequest](r)
+func (s *Handler) SelectProductHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[SelectProductRequest](r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		decodeError(w, err)
 		return
 	}
 
-	if req.Amount == 0 {
-		http.Error(w, "no amount inserted", http.StatusBadRequest)
+	_, err = s.selectProduct(r.Context(), req.ID, req.Product)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	vm, err := s.vmStorage.GetVM(req.ID)
+	_, err = w.Write([]byte("selected and delivered product successfully"))
 	if err != nil {
-		if errors.Is(err, storage.ErrVMNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type AbortOrderRequest struct {
+	ID string `json:"machine_id"`
+}
+
+func (r AbortOrderRequest) validate(v *ValidationError) {
+	v.check(r.ID != "", "machine_id", "must not be empty")
+}
+
+func (s *Handler) AbortOrderHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[AbortOrderRequest](r)
+	if err != nil {
+		decodeError(w, err)
 		return
 	}
 
-	err = vm.InsertCoin(req.Amount)
+	_, _, err = s.abortOrder(r.Context(), req.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	_, err = w.Write([]byte("inserted coin successfully"))
+	_, err = w.Write([]byte("aborted successfully"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-type SelectProductRequest struct {
-	ID      string `json:"machine_id"`
-	Product string `json:"selected_product"`
+// #######
+// State Machine Handlers
+// #######
+
+type TransitionRequest struct {
+	ID   string            `json:"machine_id"`
+	Data statemachine.Data `json:"data"`
 }
 
-func (s *Handler) SelectProductHandler(w http.ResponseWriter, r *http.Request) {
-	req, err := decode[SelectProductRequest](r)
+func (r TransitionRequest) validate(v *ValidationError) {
+	v.check(r.ID != "", "machine_id", "must not be empty")
+	v.check(r.Data.InsertedAmount == nil || *r.Data.InsertedAmount >= 0, "data.inserted_amount",
+		"must not be negative")
+	v.check(r.Data.SelectedProd == nil || *r.Data.SelectedProd != "", "data.selected_product", "must not be empty")
+}
+
+func (s *Handler) TransitionHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[TransitionRequest](r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		decodeError(w, err)
 		return
 	}
 
-	if req.Product == "" {
-		http.Error(w, "no product was selected", http.StatusBadRequest)
+	_, err = s.transition(r.Context(), req.ID, req.Data)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	vm, err := s.vmStorage.GetVM(req.ID)
+	_, err = w.Write([]byte("transitioned successfully"))
 	if err != nil {
-		if errors.Is(err, storage.ErrVMNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
+}
+
+// #######
+// Operator Handlers
+// #######
 
-	err = vm.SelectProduct(req.Product)
+// The machine responses carry the version of the machine as their ETag, the
+// edits sending it back in If-Match fail with 412 if the machine has been
+// changed since.
+
+func (s *Handler) GetMachineHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.machineState(r.Context(), r.PathValue("id"))
 	if err != nil {
-		if errors.Is(err, internalVM.ErrInvalidProduct) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		} else if errors.Is(err, internalVM.ErrInsufficientFunds) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+		writeError(w, r, err)
+		return
+	}
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	setETag(w, snap)
+	encode(w, http.StatusOK, snap)
+}
+
+func setETag(w http.ResponseWriter, snap internalVM.Snapshot) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(snap.Version, 10)))
+}
+
+// ifMatch returns the version in the If-Match header, zero if there is no
+// header or it matches any version. The etags are strong, so a weak or an
+// unknown etag never matches.
+func ifMatch(r *http.Request) (int64, error) {
+	tag := r.Header.Get("If-Match")
+	if tag == "" || tag == "*" {
+		return 0, nil
+	}
+
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil || !strings.HasPrefix(tag, `"`) {
+		return 0, errVersionMismatch
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, errVersionMismatch
+	}
+
+	return version, nil
+}
+
+// HistoryResponse is the event stream of a vending machine, oldest first.
+type HistoryResponse struct {
+	ID     string             `json:"machine_id"`
+	Events []internalVM.Event `json:"events"`
+}
+
+// HistoryHandler returns the events of the vending machine, the optional
+// from and to parameters bound the times of the events.
+func (s *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var v ValidationError
+	from := queryTime(&v, r, "from")
+	to := queryTime(&v, r, "to")
+	if len(v.Fields) > 0 {
+		decodeError(w, &v)
 		return
 	}
 
-	err = vm.DeliverProduct()
+	id := r.PathValue("id")
+	history, err := s.machineHistory(r.Context(), id, from, to)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	_, err = w.Write([]byte("selected and delivered product successfully"))
+	encode(w, http.StatusOK, HistoryResponse{ID: id, Events: history})
+}
+
+// MachineAtHandler returns the vending machine as it was at the time of the
+// at parameter, rebuilt from its events.
+func (s *Handler) MachineAtHandler(w http.ResponseWriter, r *http.Request) {
+	var v ValidationError
+	at := queryTime(&v, r, "at")
+	v.check(!at.IsZero(), "at", "is required")
+	if len(v.Fields) > 0 {
+		decodeError(w, &v)
+		return
+	}
+
+	snap, err := s.machineAt(r.Context(), r.PathValue("id"), at)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
 	}
+
+	encode(w, http.StatusOK, snap)
 }
 
-type AbortOrderRequest struct {
+// queryTime returns the RFC 3339 time of the query parameter, zero if it is
+// not set.
+func queryTime(v *ValidationError, r *http.Request, param string) time.Time {
+	value := r.URL.Query().Get(param)
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	v.check(err == nil, param, "must be an RFC 3339 time")
+
+	return t
+}
+
+// MachineMetadata is the metadata of a machine along with its id.
+type MachineMetadata struct {
 	ID string `json:"machine_id"`
+	fleet.Metadata
 }
 
-func (s *Handler) AbortOrderHandler(w http.ResponseWriter, r *http.Request) {
-	req, err := decode[AbortOrderRequest](r)
+type ListMachinesResponse struct {
+	Machines []MachineMetadata `json:"machines"`
+}
+
+// filterFromQuery reads the site and tag query parameters, repeating the
+// tag selects the machines having all the tags.
+func filterFromQuery(r *http.Request) fleet.Filter {
+	q := r.URL.Query()
+
+	return fleet.Filter{Site: q.Get("site"), Tags: q["tag"]}
+}
+
+func (s *Handler) ListMachinesHandler(w http.ResponseWriter, r *http.Request) {
+	machines, err := s.listMachineMetadata(r.Context(), filterFromQuery(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	vm, err := s.vmStorage.GetVM(req.ID)
+	encode(w, http.StatusOK, ListMachinesResponse{Machines: machines})
+}
+
+func (s *Handler) GetMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	md, err := s.machineMetadata(r.Context(), r.PathValue("id"))
 	if err != nil {
-		if errors.Is(err, storage.ErrVMNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	vm.AbortAndReset()
-	_, err = w.Write([]byte("aborted successfully"))
+	encode(w, http.StatusOK, md)
+}
+
+// UpdateMetadataRequest replaces the whole metadata, its managed field is
+// ignored.
+type UpdateMetadataRequest struct {
+	fleet.Metadata
+}
+
+func (r UpdateMetadataRequest) validate(v *ValidationError) {
+	validateMetadata(v, "", r.Metadata)
+}
+
+func (s *Handler) UpdateMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[UpdateMetadataRequest](r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		decodeError(w, err)
+		return
 	}
+
+	md, err := s.updateMetadata(r.Context(), r.PathValue("id"), req.Metadata)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	encode(w, http.StatusOK, md)
 }
 
-// #######
-// State Machine Handlers
-// #######
+type RestockRequest struct {
+	Items []internalVM.Item `json:"items"`
+}
 
-type TransitionRequest struct {
-	ID   string            `json:"machine_id"`
-	Data statemachine.Data `json:"data"`
+func (r RestockRequest) validate(v *ValidationError) {
+	v.check(len(r.Items) > 0, "items", "must not be empty")
+	validateItems(v, "items", r.Items, true)
 }
 
-func (s *Handler) TransitionHandler(w http.ResponseWriter, r *http.Request) {
-	req, err := decode[TransitionRequest](r)
+func (s *Handler) RestockHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[RestockRequest](r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to decode request: %+v", err.Error()), http.StatusBadRequest)
+		decodeError(w, err)
 		return
 	}
 
-	sm, err := s.smStorage.GetSM(req.ID)
+	version, err := ifMatch(r)
 	if err != nil {
-		if errors.Is(err, storage.ErrSMNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	err = sm.Transit(req.Data)
+	snap, err := s.restock(r.Context(), r.PathValue("id"), req.Items, version)
 	if err != nil {
-		if errors.Is(err, statemachine.ErrInvalidProduct) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		} else if errors.Is(err, statemachine.ErrOutOfStock) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		} else if errors.Is(err, statemachine.ErrInsufficientFunds) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+		writeError(w, r, err)
+		return
+	}
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	setETag(w, snap)
+	encode(w, http.StatusOK, snap)
+}
+
+type RepriceRequest struct {
+	Product string `json:"product"`
+	Price   int    `json:"price"`
+}
+
+func (r RepriceRequest) validate(v *ValidationError) {
+	v.check(r.Product != "", "product", "must not be empty")
+	v.check(r.Price > 0, "price", "must be positive")
+}
+
+func (s *Handler) RepriceHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decode[RepriceRequest](r)
+	if err != nil {
+		decodeError(w, err)
 		return
 	}
 
-	_, err = w.Write([]byte("transitioned successfully"))
+	version, err := ifMatch(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	snap, err := s.reprice(r.Context(), r.PathValue("id"), req.Product, req.Price, version)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setETag(w, snap)
+	encode(w, http.StatusOK, snap)
+}
+
+func (s *Handler) DeleteMachineHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.deleteMachine(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError replies with the status of the error, the unexpected errors
+// are logged since the client can not do anything about them.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := httpStatus(err)
+	if status >= http.StatusInternalServerError {
+		loggerFromContext(r.Context()).Error("request failed", slog.String("error", err.Error()))
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// httpStatus maps the errors returned by the operations to http status codes.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrVMNotFound), errors.Is(err, storage.ErrSMNotFound), errors.Is(err, errNoHistory):
+		return http.StatusNotFound
+	case errors.Is(err, errNoAmount), errors.Is(err, errNoProduct),
+		errors.Is(err, internalVM.ErrInvalidProduct), errors.Is(err, statemachine.ErrInvalidProduct),
+		errors.Is(err, internalVM.ErrOutOfStock), errors.Is(err, statemachine.ErrOutOfStock),
+		errors.Is(err, internalVM.ErrInsufficientFunds), errors.Is(err, statemachine.ErrInsufficientFunds),
+		errors.Is(err, internalVM.ErrInvalidItem), errors.Is(err, statemachine.ErrInvalidItem):
+		return http.StatusBadRequest
+	case errors.Is(err, fleet.ErrInvalidID), errors.Is(err, errInvalidRequest), errors.Is(err, backup.ErrInvalidBackup):
+		return http.StatusBadRequest
+	case errors.Is(err, errSessionActive), errors.Is(err, storage.ErrVMExists), errors.Is(err, storage.ErrSMExists),
+		errors.Is(err, storage.ErrVersionConflict), errors.Is(err, errStorageNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, internalVM.ErrBadState), errors.Is(err, statemachine.ErrBadState):
+		// the machine is not in a state allowing the operation
+		return http.StatusConflict
+	case errors.Is(err, errVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
 	}
 }
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 
+	"vendingmachine/internal/fleet"
 	"vendingmachine/internal/statemachine"
 	"vendingmachine/internal/storage"
 	internalVM "vendingmachine/internal/vendingmachine"
@@ -27,7 +32,7 @@ func TestAddVMHandler(t *testing.T) {
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest(http.MethodPost, "/addvm",
-			strings.NewReader("{\"inventory\":[{\"name\":\"coke\",\"number\":1,\"price\":100},{\"name\":\"coffee\",\"number\":2,\"price\":50},{\"name\":\"milk\",\"number\":0,\"price\":80}]}")) //nolint: lll
+			strings.NewReader("{\"machine_id\":\"123\",\"inventory\":[{\"name\":\"coke\",\"number\":1,\"price\":100},{\"name\":\"coffee\",\"number\":2,\"price\":50},{\"name\":\"milk\",\"number\":0,\"price\":80}]}")) //nolint: lll
 		h.AddVMHandler(w, r)
 		res := w.Result()
 		defer res.Body.Close()
@@ -42,10 +47,10 @@ func TestAddVMHandler(t *testing.T) {
 	t.Run("faulty storage", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().SaveVM(gomock.Any()).AnyTimes().Return("", errors.New("some error"))
+		vmStorage.EXPECT().CreateVM(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(errors.New("some error"))
 
 		smStorage := mock_main.NewMockSMStorage(ctrl)
-		smStorage.EXPECT().SaveSM(gomock.Any()).AnyTimes().Return("", errors.New("some error"))
+		smStorage.EXPECT().CreateSM(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(errors.New("some error"))
 
 		h := NewHandler(vmStorage, smStorage)
 
@@ -60,6 +65,35 @@ func TestAddVMHandler(t *testing.T) {
 	})
 }
 
+func TestAddVMHandlerWithMachineID(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	rt := NewRouter()
+	registerRoutes(rt, h)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"create", "/addvm", `{"machine_id":"cab-001","inventory":[{"name":"coke","number":1,"price":100}]}`,
+			http.StatusOK},
+		{"duplicate", "/addvm", `{"machine_id":"cab-001","inventory":[]}`, http.StatusConflict},
+		{"invalid id", "/addvm", `{"machine_id":"cab/001","inventory":[]}`, http.StatusBadRequest},
+		// the id addresses both the vending machine and the state machine
+		{"vending machine", "/insert", `{"machine_id":"cab-001","inserted_amount":100}`, http.StatusOK},
+		{"state machine", "/sm/insert", `{"machine_id":"cab-001","data":{"inserted_amount":100}}`, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+		})
+	}
+}
+
 func TestInsertCoinHandler(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		vmStorage := getVMStorageMock(t)
@@ -90,7 +124,8 @@ func TestInsertCoinHandler(t *testing.T) {
 	t.Run("faulty storage", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(nil, errors.New("some error"))
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, errors.New("some error"))
+		expectUpdateVM(vmStorage, errors.New("some error"))
 
 		h := NewHandler(vmStorage, nil)
 
@@ -108,7 +143,8 @@ func TestInsertCoinHandler(t *testing.T) {
 	t.Run("not found", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(nil, storage.ErrVMNotFound)
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, storage.ErrVMNotFound)
+		expectUpdateVM(vmStorage, storage.ErrVMNotFound)
 
 		h := NewHandler(vmStorage, nil)
 
@@ -122,6 +158,31 @@ func TestInsertCoinHandler(t *testing.T) {
 
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
+
+	t.Run("bad state", func(t *testing.T) {
+		h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+		_, err := h.addVM(context.Background(), "123", fleet.Metadata{},
+			[]internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+		require.NoError(t, err)
+
+		insert := func() int {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/insert",
+				strings.NewReader("{\"machine_id\":\"123\", \"inserted_amount\":100}"))
+			h.InsertCoinHandler(w, r)
+
+			return w.Code
+		}
+
+		require.Equal(t, http.StatusOK, insert())
+		assert.Equal(t, http.StatusConflict, insert(), "a coin can not be inserted while selecting")
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/transition",
+			strings.NewReader("{\"machine_id\":\"123\", \"data\":{\"selected_product\":\"coke\"}}"))
+		h.TransitionHandler(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code, "a product can not be selected without credit")
+	})
 }
 
 func TestSelectProductHandler(t *testing.T) {
@@ -129,7 +190,8 @@ func TestSelectProductHandler(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vm := getVMForSelect(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(vm, nil)
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(vm, nil)
+		expectUpdateVM(vmStorage, nil)
 
 		h := NewHandler(vmStorage, nil)
 
@@ -145,7 +207,8 @@ func TestSelectProductHandler(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vm := getVMForSelect(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(vm, nil)
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(vm, nil)
+		expectUpdateVM(vmStorage, nil)
 
 		h := NewHandler(vmStorage, nil)
 
@@ -161,7 +224,8 @@ func TestSelectProductHandler(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vm := getVMForSelect(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(vm, nil)
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(vm, nil)
+		expectUpdateVM(vmStorage, nil)
 
 		h := NewHandler(vmStorage, nil)
 
@@ -176,7 +240,8 @@ func TestSelectProductHandler(t *testing.T) {
 	t.Run("vm not found", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(nil, storage.ErrVMNotFound)
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, storage.ErrVMNotFound)
+		expectUpdateVM(vmStorage, storage.ErrVMNotFound)
 
 		h := NewHandler(vmStorage, nil)
 
@@ -191,7 +256,8 @@ func TestSelectProductHandler(t *testing.T) {
 	t.Run("faulty storage", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		vmStorage := mock_main.NewMockVMStorage(ctrl)
-		vmStorage.EXPECT().GetVM(gomock.Any()).AnyTimes().Return(nil, errors.New("some error"))
+		vmStorage.EXPECT().GetVM(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, errors.New("some error"))
+		expectUpdateVM(vmStorage, errors.New("some error"))
 
 		h := NewHandler(vmStorage, nil)
 
@@ -207,7 +273,7 @@ func TestSelectProductHandler(t *testing.T) {
 func getVMStorageMock(t *testing.T) *mock_main.MockVMStorage {
 	ctrl := gomock.NewController(t)
 	m := mock_main.NewMockVMStorage(ctrl)
-	m.EXPECT().SaveVM(gomock.Any()).AnyTimes().Return("123", nil)
+	m.EXPECT().CreateVM(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
 	vm, err := internalVM.New([]internalVM.Item{
 		{
 			Name:   "coke",
@@ -226,11 +292,17 @@ func getVMStorageMock(t *testing.T) *mock_main.MockVMStorage {
 		},
 	})
 	require.NoError(t, err)
-	m.EXPECT().GetVM("123").AnyTimes().Return(vm, nil)
+	m.EXPECT().GetVM(gomock.Any(), "123").AnyTimes().Return(vm, nil)
+	expectUpdateVM(m, nil)
 
 	return m
 }
 
+// expectUpdateVM makes the updates return err.
+func expectUpdateVM(m *mock_main.MockVMStorage, err error) {
+	m.EXPECT().UpdateVM(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(err)
+}
+
 func getSMStorageMock(t *testing.T) *mock_main.MockSMStorage {
 	ctrl := gomock.NewController(t)
 	m := mock_main.NewMockSMStorage(ctrl)
@@ -252,8 +324,9 @@ func getSMStorageMock(t *testing.T) *mock_main.MockSMStorage {
 		},
 	})
 	require.NoError(t, err)
-	m.EXPECT().SaveSM(gomock.Any()).AnyTimes().Return("123", nil)
-	m.EXPECT().GetSM("123").AnyTimes().Return(sm, nil)
+	m.EXPECT().CreateSM(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	m.EXPECT().GetSM(gomock.Any(), "123").AnyTimes().Return(sm, nil)
+	m.EXPECT().UpdateSM(gomock.Any(), "123", gomock.Any()).AnyTimes().Return(nil)
 
 	return m
 }
@@ -288,3 +361,190 @@ func getVMForSelect(t *testing.T) *internalVM.VendingMachine {
 
 	return vm
 }
+
+func TestRestockHandler(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		h := NewHandler(getVMStorageMock(t), getSMStorageMock(t))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/machines/123/restock",
+			strings.NewReader("{\"items\":[{\"name\":\"milk\",\"number\":5}]}"))
+		r.SetPathValue("id", "123")
+		h.RestockHandler(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "{\"name\":\"milk\",\"number\":5,\"price\":80}")
+	})
+
+	t.Run("invalid item", func(t *testing.T) {
+		h := NewHandler(getVMStorageMock(t), getSMStorageMock(t))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/machines/123/restock",
+			strings.NewReader("{\"items\":[{\"name\":\"tea\",\"number\":5}]}"))
+		r.SetPathValue("id", "123")
+		h.RestockHandler(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestChangeRetriesVersionConflicts(t *testing.T) {
+	t.Run("retried", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		vmStorage := mock_main.NewMockVMStorage(ctrl)
+		vmStorage.EXPECT().GetVM(gomock.Any(), "123").Times(2).DoAndReturn(
+			func(context.Context, string) (*internalVM.VendingMachine, error) {
+				return internalVM.New([]internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+			})
+		gomock.InOrder(
+			vmStorage.EXPECT().UpdateVM(gomock.Any(), "123", gomock.Any()).Return(storage.ErrVersionConflict),
+			vmStorage.EXPECT().UpdateVM(gomock.Any(), "123", gomock.Any()).Return(nil),
+		)
+
+		m := NewMetrics()
+		h := NewHandler(vmStorage, nil, WithMetrics(m))
+		snap, err := h.insertCoin(context.Background(), "123", 100)
+		require.NoError(t, err)
+		assert.Equal(t, 100, snap.InsertedAmount)
+
+		w := httptest.NewRecorder()
+		h.MetricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Contains(t, w.Body.String(), `vendingmachine_version_conflicts_total{kind="vm"} 1`)
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		vmStorage := mock_main.NewMockVMStorage(ctrl)
+		vmStorage.EXPECT().GetVM(gomock.Any(), "123").Times(maxChangeAttempts).DoAndReturn(
+			func(context.Context, string) (*internalVM.VendingMachine, error) {
+				return internalVM.New(nil)
+			})
+		vmStorage.EXPECT().UpdateVM(gomock.Any(), "123", gomock.Any()).Times(maxChangeAttempts).
+			Return(storage.ErrVersionConflict)
+
+		h := NewHandler(vmStorage, nil)
+		w := httptest.NewRecorder()
+		h.InsertCoinHandler(w, httptest.NewRequest(http.MethodPost, "/insert",
+			strings.NewReader(`{"machine_id":"123","inserted_amount":100}`)))
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+func TestSelectProductSavesOnce(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	vmStorage := mock_main.NewMockVMStorage(ctrl)
+	vmStorage.EXPECT().GetVM(gomock.Any(), "123").DoAndReturn(
+		func(ctx context.Context, _ string) (*internalVM.VendingMachine, error) {
+			vm, err := internalVM.New([]internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+			if err != nil {
+				return nil, err
+			}
+
+			return vm, vm.InsertCoin(ctx, 100)
+		})
+	// a failed save must leave the stored machine selecting, never delivering
+	vmStorage.EXPECT().UpdateVM(gomock.Any(), "123", gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, vm *internalVM.VendingMachine) error {
+			assert.Equal(t, internalVM.Idle, vm.Snapshot().State, "select and deliver should be saved together")
+			return errors.New("some error")
+		})
+
+	h := NewHandler(vmStorage, nil)
+	_, err := h.selectProduct(context.Background(), "123", "coke")
+	require.Error(t, err)
+}
+
+func TestRepriceIfMatch(t *testing.T) {
+	rt := NewRouter()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	registerRoutes(rt, h)
+
+	_, err := h.addVM(context.Background(), "lobby-1", fleet.Metadata{},
+		[]internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	rt.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/machines/lobby-1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	reprice := func(ifMatch string, price int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/machines/lobby-1/reprice",
+			strings.NewReader(fmt.Sprintf(`{"product":"coke","price":%d}`, price)))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		rt.mux.ServeHTTP(w, r)
+
+		return w
+	}
+
+	w = reprice(`"1"`, 120)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	// the machine has been repriced since version 1 was read
+	assert.Equal(t, http.StatusPreconditionFailed, reprice(`"1"`, 90).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, reprice(`W/"2"`, 90).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, reprice("2", 90).Code)
+
+	snap, err := h.machineState(context.Background(), "lobby-1")
+	require.NoError(t, err)
+	coke, _ := snap.Item("coke")
+	assert.Equal(t, 120, coke.Price)
+
+	assert.Equal(t, http.StatusOK, reprice("*", 90).Code)
+	assert.Equal(t, http.StatusOK, reprice("", 80).Code)
+}
+
+func TestHistory(t *testing.T) {
+	rt := NewRouter()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	registerRoutes(rt, h)
+
+	_, err := h.addVM(context.Background(), "lobby-1", fleet.Metadata{},
+		[]internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+	require.NoError(t, err)
+	_, err = h.reprice(context.Background(), "lobby-1", "coke", 120, 0)
+	require.NoError(t, err)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rt.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		return w
+	}
+
+	w := get("/v1/machines/lobby-1/history")
+	require.Equal(t, http.StatusOK, w.Code)
+	var history HistoryResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&history))
+	assert.Equal(t, "lobby-1", history.ID)
+	require.Len(t, history.Events, 2)
+	assert.Equal(t, internalVM.Restocked, history.Events[0].Type)
+	assert.Equal(t, internalVM.PriceChanged, history.Events[1].Type)
+	assert.Equal(t, 120, history.Events[1].Price)
+
+	// the machine as it was created, before the reprice
+	created := history.Events[0].At
+	w = get("/v1/machines/lobby-1/history/state?at=" + created.Format(time.RFC3339Nano))
+	require.Equal(t, http.StatusOK, w.Code)
+	var snap internalVM.Snapshot
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&snap))
+	coke, _ := snap.Item("coke")
+	assert.Equal(t, 100, coke.Price)
+
+	w = get("/v1/machines/lobby-1/history?from=" + created.Add(time.Hour).Format(time.RFC3339))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&history))
+	assert.Empty(t, history.Events)
+
+	before := created.Add(-time.Hour).Format(time.RFC3339)
+	assert.Equal(t, http.StatusNotFound, get("/v1/machines/lobby-1/history/state?at="+before).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v1/machines/lobby-1/history/state").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v1/machines/lobby-1/history?to=yesterday").Code)
+	assert.Equal(t, http.StatusNotFound, get("/v1/machines/missing/history").Code)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessTimeout bounds each readiness check.
+const readinessTimeout = 2 * time.Second
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+	errNotRecovered = errors.New("recovery has not finished")
+)
+
+// pinger is implemented by the storage backends that can be unreachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Health tracks whether the server is ready to serve traffic.
+type Health struct {
+	// recovered is set once the machines have been restored on startup
+	recovered    atomic.Bool
+	shuttingDown atomic.Bool
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// SetRecovered marks the startup recovery as finished.
+func (h *Health) SetRecovered() {
+	h.recovered.Store(true)
+}
+
+// SetShuttingDown makes the readiness probe fail, so that the load balancer
+// stops sending new requests before the server closes its connections.
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+func WithHealth(health *Health) HandlerOption {
+	return func(h *Handler) {
+		h.health = health
+	}
+}
+
+// ReadinessCheck is the result of one of the readiness checks.
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// HealthzHandler reports that the process is alive.
+func (s *Handler) HealthzHandler(w http.ResponseWriter, _ *http.Request) {
+	_, err := w.Write([]byte("ok"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ReadyzHandler reports whether the server can serve traffic: it is not
+// shutting down, it has finished recovering and its storage is reachable.
+func (s *Handler) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	res := ReadinessResponse{Ready: true}
+
+	check := func(name string, err error) {
+		c := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			res.Ready = false
+		}
+		res.Checks = append(res.Checks, c)
+	}
+
+	var err error
+	if s.health.shuttingDown.Load() {
+		err = errShuttingDown
+	}
+	check("shutdown", err)
+
+	err = nil
+	if !s.health.recovered.Load() {
+		err = errNotRecovered
+	}
+	check("recovery", err)
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	check("vm_storage", ping(ctx, s.vmStorage))
+	check("sm_storage", ping(ctx, s.smStorage))
+
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	encode(w, status, res)
+}
+
+// ping checks that the storage is reachable, storages that can not be
+// unreachable, e.g. the in memory ones, always are.
+func ping(ctx context.Context, storage any) error {
+	p, ok := storage.(pinger)
+	if !ok {
+		return nil
+	}
+
+	if err := p.Ping(ctx); err != nil {
+		return fmt.Errorf("storage is unreachable: %w", err)
+	}
+
+	return nil
+}
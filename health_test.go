@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/storage"
+)
+
+type unreachableVMStorage struct {
+	*storage.InMemoryVMStorage
+}
+
+func (unreachableVMStorage) Ping(context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	readyz := func(h *Handler) (int, ReadinessResponse) {
+		w := httptest.NewRecorder()
+		h.ReadyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var res ReadinessResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+		return w.Code, res
+	}
+
+	t.Run("healthz", func(t *testing.T) {
+		h := NewHandler(nil, nil)
+
+		w := httptest.NewRecorder()
+		h.HealthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("ready after recovery until shutdown", func(t *testing.T) {
+		health := NewHealth()
+		h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), WithHealth(health))
+
+		status, res := readyz(h)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.False(t, res.Ready)
+
+		health.SetRecovered()
+		status, res = readyz(h)
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, res.Ready)
+
+		health.SetShuttingDown()
+		status, res = readyz(h)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, ReadinessCheck{Name: "shutdown", Error: errShuttingDown.Error()}, res.Checks[0])
+	})
+
+	t.Run("unreachable storage", func(t *testing.T) {
+		health := NewHealth()
+		health.SetRecovered()
+		h := NewHandler(unreachableVMStorage{storage.NewInMemoryVMStorage()}, storage.NewInMemorySMStorage(),
+			WithHealth(health))
+
+		status, res := readyz(h)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Contains(t, res.Checks, ReadinessCheck{
+			Name:  "vm_storage",
+			Error: "storage is unreachable: connection refused",
+		})
+	})
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Role string
+
+const (
+	// RoleAnonymous is required by the public routes, any caller has it.
+	RoleAnonymous Role = "anonymous"
+
+	// RoleCustomer may only drive a machine: insert, select and abort.
+	RoleCustomer Role = "customer"
+
+	// RoleOperator may also create, restock, reprice and delete machines.
+	RoleOperator Role = "operator"
+
+	// RoleAdmin may also manage the api keys.
+	RoleAdmin Role = "admin"
+)
+
+const (
+	hashPrefix = "sha256:"
+	keyBytes   = 32
+)
+
+// rank orders the roles, each role is allowed everything the lower ranked
+// roles are allowed.
+func (r Role) rank() int {
+	switch r {
+	case RoleCustomer:
+		return 1
+	case RoleOperator:
+		return 2 //nolint: mnd // ranks are only meaningful relative to each other
+	case RoleAdmin:
+		return 3 //nolint: mnd // ranks are only meaningful relative to each other
+	default:
+		return 0
+	}
+}
+
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows reports whether the role is allowed to do what the required role can.
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && r.rank() >= required.rank()
+}
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name string
+	Role Role
+	// MachineID restricts the identity to a single machine, empty means any
+	MachineID string
+}
+
+// CanAccess reports whether the identity may act on the given machine.
+func (id Identity) CanAccess(machineID string) bool {
+	return id.MachineID == "" || id.MachineID == machineID
+}
+
+type identityKey struct{}
+
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// HashKey returns the hash of the raw api key in the format stored in the config.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Key is a stored api key, only its hash is kept.
+type Key struct {
+	Name string `json:"name"`
+	Hash string `json:"-"`
+	Role Role   `json:"role"`
+}
+
+// KeyStore holds the api keys that are allowed to call the server.
+type KeyStore struct {
+	mu sync.RWMutex
+	// keys maps the key name to the key
+	keys map[string]Key
+	// configured are the names of the keys loaded from the config, the
+	// others were created through the api
+	configured map[string]bool
+}
+
+func NewKeyStore(keys []Key) (*KeyStore, error) {
+	ks := &KeyStore{
+		mu:         sync.RWMutex{},
+		keys:       make(map[string]Key),
+		configured: make(map[string]bool),
+	}
+
+	for _, k := range keys {
+		if err := ks.add(k); err != nil {
+			return nil, err
+		}
+		ks.configured[k.Name] = true
+	}
+
+	return ks, nil
+}
+
+// ReplaceConfigured replaces the keys loaded from the config, the keys
+// created through the api are kept. Nothing is replaced on error.
+func (ks *KeyStore) ReplaceConfigured(keys []Key) error {
+	next, err := NewKeyStore(keys)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for name, k := range ks.keys {
+		if ks.configured[name] {
+			continue
+		}
+
+		if err := next.add(k); err != nil {
+			return err
+		}
+	}
+
+	ks.keys = next.keys
+	ks.configured = next.configured
+
+	return nil
+}
+
+func (ks *KeyStore) add(k Key) error {
+	if k.Name == "" {
+		return fmt.Errorf("%w: key name is empty", ErrInvalidKey)
+	}
+
+	if !k.Role.Valid() {
+		return fmt.Errorf("%w: key %q has unknown role %q", ErrInvalidKey, k.Name, k.Role)
+	}
+
+	if !strings.HasPrefix(k.Hash, hashPrefix) || len(k.Hash) != len(hashPrefix)+2*sha256.Size {
+		return fmt.Errorf("%w: key %q hash must be %q followed by the hex encoded sha256 of the key",
+			ErrInvalidKey, k.Name, hashPrefix)
+	}
+
+	if _, ok := ks.keys[k.Name]; ok {
+		return fmt.Errorf("%w: %q", ErrDuplicateKey, k.Name)
+	}
+
+	ks.keys[k.Name] = k
+
+	return nil
+}
+
+// Authenticate returns the identity of the raw api key.
+func (ks *KeyStore) Authenticate(key string) (Identity, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	hash := []byte(HashKey(key))
+	for _, k := range ks.keys {
+		if subtle.ConstantTimeCompare(hash, []byte(k.Hash)) == 1 {
+			return Identity{Name: k.Name, Role: k.Role}, nil
+		}
+	}
+
+	return Identity{}, ErrUnauthenticated
+}
+
+// Create generates a new random api key and returns the raw key, which is
+// not stored and can not be recovered later.
+func (ks *KeyStore) Create(name string, role Role) (string, error) {
+	buf := make([]byte, keyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	raw := hex.EncodeToString(buf)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := ks.add(Key{Name: name, Hash: HashKey(raw), Role: role}); err != nil {
+		return "", err
+	}
+
+	return raw, nil
+}
+
+func (ks *KeyStore) Delete(name string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.keys[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, name)
+	}
+
+	delete(ks.keys, name)
+	delete(ks.configured, name)
+
+	return nil
+}
+
+// List returns the keys sorted by name.
+func (ks *KeyStore) List() []Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]Key, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+
+	return keys
+}
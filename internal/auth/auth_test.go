@@ -0,0 +1,81 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/auth"
+)
+
+func TestRoleAllows(t *testing.T) {
+	assert.True(t, auth.RoleAdmin.Allows(auth.RoleOperator))
+	assert.True(t, auth.RoleOperator.Allows(auth.RoleCustomer))
+	assert.True(t, auth.RoleCustomer.Allows(auth.RoleCustomer))
+	assert.False(t, auth.RoleCustomer.Allows(auth.RoleOperator))
+	assert.False(t, auth.RoleOperator.Allows(auth.RoleAdmin))
+	assert.False(t, auth.Role("unknown").Allows(auth.RoleCustomer))
+}
+
+func TestKeyStore(t *testing.T) {
+	ks, err := auth.NewKeyStore([]auth.Key{
+		{Name: "kiosk", Hash: auth.HashKey("secret"), Role: auth.RoleCustomer},
+	})
+	require.NoError(t, err)
+
+	id, err := ks.Authenticate("secret")
+	require.NoError(t, err)
+	assert.Equal(t, auth.Identity{Name: "kiosk", Role: auth.RoleCustomer}, id)
+
+	_, err = ks.Authenticate("wrong")
+	require.ErrorIs(t, err, auth.ErrUnauthenticated)
+
+	raw, err := ks.Create("ops", auth.RoleOperator)
+	require.NoError(t, err)
+	id, err = ks.Authenticate(raw)
+	require.NoError(t, err)
+	assert.Equal(t, auth.RoleOperator, id.Role)
+
+	_, err = ks.Create("ops", auth.RoleOperator)
+	require.ErrorIs(t, err, auth.ErrDuplicateKey)
+	_, err = ks.Create("bad", auth.Role("superuser"))
+	require.ErrorIs(t, err, auth.ErrInvalidKey)
+
+	require.NoError(t, ks.Delete("ops"))
+	_, err = ks.Authenticate(raw)
+	require.ErrorIs(t, err, auth.ErrUnauthenticated)
+	require.ErrorIs(t, ks.Delete("ops"), auth.ErrKeyNotFound)
+}
+
+func TestNewKeyStoreRejectsPlainKeys(t *testing.T) {
+	_, err := auth.NewKeyStore([]auth.Key{{Name: "kiosk", Hash: "secret", Role: auth.RoleCustomer}})
+	require.ErrorIs(t, err, auth.ErrInvalidKey)
+}
+
+func TestReplaceConfiguredKeepsCreatedKeys(t *testing.T) {
+	ks, err := auth.NewKeyStore([]auth.Key{
+		{Name: "kiosk", Hash: auth.HashKey("old"), Role: auth.RoleCustomer},
+	})
+	require.NoError(t, err)
+
+	raw, err := ks.Create("ops", auth.RoleOperator)
+	require.NoError(t, err)
+
+	require.NoError(t, ks.ReplaceConfigured([]auth.Key{
+		{Name: "kiosk", Hash: auth.HashKey("new"), Role: auth.RoleCustomer},
+	}))
+
+	_, err = ks.Authenticate("old")
+	require.ErrorIs(t, err, auth.ErrUnauthenticated)
+	_, err = ks.Authenticate("new")
+	require.NoError(t, err)
+	_, err = ks.Authenticate(raw)
+	require.NoError(t, err, "keys created through the api must survive a reload")
+
+	// a configured key clashing with a created one replaces nothing
+	err = ks.ReplaceConfigured([]auth.Key{{Name: "ops", Hash: auth.HashKey("other"), Role: auth.RoleAdmin}})
+	require.ErrorIs(t, err, auth.ErrDuplicateKey)
+	_, err = ks.Authenticate("new")
+	require.NoError(t, err)
+}
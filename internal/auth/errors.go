@@ -0,0 +1,12 @@
+package auth
+
+import "errors"
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+	ErrInvalidKey      = errors.New("invalid api key")
+	ErrDuplicateKey    = errors.New("duplicate api key")
+	ErrKeyNotFound     = errors.New("api key not found")
+	ErrMintingDisabled = errors.New("token minting is disabled, no HS256 secret is configured")
+)
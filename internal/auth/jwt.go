@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the claims of the bearer tokens accepted by the server.
+type Claims struct {
+	// MachineID scopes the token to a single machine, empty means any machine
+	MachineID string `json:"machine_id,omitempty"`
+	Role      Role   `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type JWTConfig struct {
+	// HS256Secret verifies HS256 tokens and signs the minted tokens
+	HS256Secret []byte
+	// JWKSFile is a local JSON Web Key Set with the RS256 verification keys
+	JWKSFile string
+	// Issuer is set on minted tokens and, if not empty, required on verified ones
+	Issuer string
+}
+
+// JWTManager verifies bearer tokens and mints machine scoped session tokens.
+type JWTManager struct {
+	secret []byte
+	// rsaKeys maps the key id to the RS256 verification key
+	rsaKeys map[string]*rsa.PublicKey
+	issuer  string
+}
+
+func NewJWTManager(cfg JWTConfig) (*JWTManager, error) {
+	m := &JWTManager{
+		secret:  cfg.HS256Secret,
+		rsaKeys: make(map[string]*rsa.PublicKey),
+		issuer:  cfg.Issuer,
+	}
+
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load jwks: %w", err)
+		}
+		m.rsaKeys = keys
+	}
+
+	return m, nil
+}
+
+// Verify validates the token and returns the identity it was issued to.
+// Tokens without a role claim are customer tokens, which must be scoped
+// to a machine.
+func (m *JWTManager) Verify(token string) (Identity, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if m.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(m.issuer))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, m.keyFunc, opts...)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+
+	role := claims.Role
+	if role == "" {
+		role = RoleCustomer
+	}
+
+	if !role.Valid() {
+		return Identity{}, fmt.Errorf("%w: unknown role %q", ErrUnauthenticated, role)
+	}
+
+	if role == RoleCustomer && claims.MachineID == "" {
+		return Identity{}, fmt.Errorf("%w: customer tokens must be scoped to a machine", ErrUnauthenticated)
+	}
+
+	return Identity{Name: claims.Subject, Role: role, MachineID: claims.MachineID}, nil
+}
+
+func (m *JWTManager) keyFunc(t *jwt.Token) (any, error) {
+	switch t.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		if len(m.secret) == 0 {
+			return nil, fmt.Errorf("%w: HS256 tokens are not accepted", ErrUnauthenticated)
+		}
+		return m.secret, nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := m.rsaKeys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrUnauthenticated, kid)
+	default:
+		return nil, fmt.Errorf("%w: unexpected signing method %q", ErrUnauthenticated, t.Method.Alg())
+	}
+}
+
+// Mint returns an HS256 customer token for the subject valid only for the
+// given machine until the returned expiry.
+func (m *JWTManager) Mint(subject, machineID string, ttl time.Duration) (string, time.Time, error) {
+	if len(m.secret) == 0 {
+		return "", time.Time{}, ErrMintingDisabled
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	claims := Claims{
+		MachineID: machineID,
+		Role:      RoleCustomer,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return token, expiresAt, nil
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// loadJWKS reads the RSA keys of a JSON Web Key Set file, other key types
+// are skipped.
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks file: %w", err)
+	}
+
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode modulus of key %q: %w", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode exponent of key %q: %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,89 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/auth"
+)
+
+func TestMintAndVerifyHS256(t *testing.T) {
+	m, err := auth.NewJWTManager(auth.JWTConfig{HS256Secret: []byte("secret"), Issuer: "vendingmachine"})
+	require.NoError(t, err)
+
+	token, expiresAt, err := m.Mint("user-1", "123", time.Minute)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, time.Second)
+
+	id, err := m.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, auth.Identity{Name: "user-1", Role: auth.RoleCustomer, MachineID: "123"}, id)
+	assert.True(t, id.CanAccess("123"))
+	assert.False(t, id.CanAccess("456"))
+
+	expired, _, err := m.Mint("user-1", "123", -time.Minute)
+	require.NoError(t, err)
+	_, err = m.Verify(expired)
+	require.ErrorIs(t, err, auth.ErrUnauthenticated)
+
+	other, err := auth.NewJWTManager(auth.JWTConfig{HS256Secret: []byte("other"), Issuer: "vendingmachine"})
+	require.NoError(t, err)
+	_, err = other.Verify(token)
+	require.ErrorIs(t, err, auth.ErrUnauthenticated)
+}
+
+func TestVerifyRS256FromJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks := map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	b, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+
+	m, err := auth.NewJWTManager(auth.JWTConfig{JWKSFile: path})
+	require.NoError(t, err)
+
+	sign := func(claims auth.Claims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "key-1"
+		s, err := tok.SignedString(key) //nolint: govet // shadowing is not a problem here
+		require.NoError(t, err)
+		return s
+	}
+	exp := jwt.NewNumericDate(time.Now().Add(time.Minute))
+
+	id, err := m.Verify(sign(auth.Claims{
+		MachineID:        "123",
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "user-1", ExpiresAt: exp},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, auth.Identity{Name: "user-1", Role: auth.RoleCustomer, MachineID: "123"}, id)
+
+	_, err = m.Verify(sign(auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "user-1", ExpiresAt: exp}}))
+	require.ErrorIs(t, err, auth.ErrUnauthenticated, "customer tokens must be scoped to a machine")
+
+	_, _, err = m.Mint("user-1", "123", time.Minute)
+	require.ErrorIs(t, err, auth.ErrMintingDisabled)
+}
@@ -0,0 +1,129 @@
+// Package backup reads and writes the backups of the fleet. A backup is a
+// gzipped json archive of every machine, their inventories, inserted coins,
+// events and metadata, checksummed so that a corrupted file is never
+// restored.
+package backup
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"vendingmachine/internal/fleet"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+const (
+	// format tells the backups apart from the other gzipped json files
+	format = "vendingmachine-backup"
+	// Version is the version of the archives written, it changes every time
+	// the archive changes in a way the previous versions cannot read
+	Version = 1
+)
+
+var (
+	ErrInvalidBackup      = errors.New("not a vendingmachine backup")
+	ErrUnsupportedVersion = errors.New("unsupported backup version")
+	ErrChecksumMismatch   = errors.New("backup checksum does not match its content, the file is corrupted")
+)
+
+// Archive is the content of a backup.
+type Archive struct {
+	CreatedAt time.Time `json:"created_at"`
+	Machines  []Machine `json:"machines"`
+}
+
+// Machine is a backed up machine, the twins that do not exist are nil.
+type Machine struct {
+	ID string               `json:"id"`
+	VM *internalVM.Snapshot `json:"vm,omitempty"`
+	// Events are the events of the vending machine, oldest first
+	Events   []internalVM.Event   `json:"events,omitempty"`
+	SM       *internalVM.Snapshot `json:"sm,omitempty"`
+	Metadata *fleet.Metadata      `json:"metadata,omitempty"`
+}
+
+// envelope is the json of a backup file, the checksum is the sha256 of the
+// archive's json.
+type envelope struct {
+	Format   string          `json:"format"`
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Archive  json.RawMessage `json:"archive"`
+}
+
+// Write writes the archive to w as a backup of the current version.
+func Write(w io.Writer, a Archive) error {
+	archive, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to encode archive: %w", err)
+	}
+
+	zw := gzip.NewWriter(w)
+	err = json.NewEncoder(zw).Encode(envelope{
+		Format:   format,
+		Version:  Version,
+		Checksum: checksum(archive),
+		Archive:  archive,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	return nil
+}
+
+// Read reads a backup written by Write, checking its version and checksum.
+// A backup larger than maxBytes once decompressed is invalid, so that a
+// small file can not inflate into more than the memory allows.
+func Read(r io.Reader, maxBytes int64) (Archive, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return Archive{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	defer zr.Close()
+
+	// one byte past the limit tells a backup of exactly maxBytes apart
+	lr := &io.LimitedReader{R: zr, N: maxBytes + 1}
+
+	var env envelope
+	err = json.NewDecoder(lr).Decode(&env)
+	if lr.N <= 0 {
+		return Archive{}, fmt.Errorf("%w: larger than %d bytes decompressed", ErrInvalidBackup, maxBytes)
+	} else if err != nil {
+		return Archive{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	if env.Format != format {
+		return Archive{}, fmt.Errorf("%w: format %q", ErrInvalidBackup, env.Format)
+	}
+
+	if env.Version != Version {
+		return Archive{}, fmt.Errorf("%w: %d, expected %d", ErrUnsupportedVersion, env.Version, Version)
+	}
+
+	if env.Checksum != checksum(env.Archive) {
+		return Archive{}, ErrChecksumMismatch
+	}
+
+	var a Archive
+	if err := json.Unmarshal(env.Archive, &a); err != nil {
+		return Archive{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	return a, nil
+}
+
+func checksum(archive []byte) string {
+	sum := sha256.Sum256(archive)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,124 @@
+package backup_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/backup"
+	"vendingmachine/internal/fleet"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// maxBytes is the decompressed size the tests read at most.
+const maxBytes = 1 << 20
+
+func TestRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 7, 9, 0, 0, 0, time.UTC)
+	a := backup.Archive{
+		CreatedAt: at,
+		Machines: []backup.Machine{{
+			ID: "lobby-1",
+			VM: &internalVM.Snapshot{
+				State: internalVM.Selecting, InsertedAmount: 150,
+				Inventory: []internalVM.Item{{Name: "coke", Number: 1, Price: 100}}, Version: 3,
+			},
+			Events: []internalVM.Event{
+				{Type: internalVM.Restocked, At: at, Product: "coke", Number: 1, Price: 100},
+				{Type: internalVM.CoinInserted, At: at.Add(time.Minute), Amount: 150},
+			},
+			Metadata: &fleet.Metadata{Site: "hq", Tags: []string{"cold"}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, backup.Write(&buf, a))
+
+	read, err := backup.Read(&buf, maxBytes)
+	require.NoError(t, err)
+	assert.Equal(t, a, read)
+}
+
+// rewrite decompresses the backup, edits its json and compresses it again.
+func rewrite(t *testing.T, a backup.Archive, edit func(env map[string]any)) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, backup.Write(&buf, a))
+
+	zr, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	var env map[string]any
+	require.NoError(t, json.NewDecoder(zr).Decode(&env))
+
+	edit(env)
+
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	require.NoError(t, json.NewEncoder(zw).Encode(env))
+	require.NoError(t, zw.Close())
+
+	return &out
+}
+
+func TestReadRejects(t *testing.T) {
+	a := backup.Archive{Machines: []backup.Machine{{ID: "lobby-1", SM: &internalVM.Snapshot{State: internalVM.Idle}}}}
+
+	tests := []struct {
+		name   string
+		backup func(t *testing.T) *bytes.Buffer
+		err    error
+	}{
+		{"not gzipped", func(*testing.T) *bytes.Buffer {
+			return bytes.NewBufferString(`{"format":"vendingmachine-backup"}`)
+		}, backup.ErrInvalidBackup},
+		{"other format", func(t *testing.T) *bytes.Buffer {
+			return rewrite(t, a, func(env map[string]any) { env["format"] = "tarball" })
+		}, backup.ErrInvalidBackup},
+		{"newer version", func(t *testing.T) *bytes.Buffer {
+			return rewrite(t, a, func(env map[string]any) { env["version"] = backup.Version + 1 })
+		}, backup.ErrUnsupportedVersion},
+		{"corrupted", func(t *testing.T) *bytes.Buffer {
+			return rewrite(t, a, func(env map[string]any) {
+				archive := env["archive"].(map[string]any)
+				archive["machines"].([]any)[0].(map[string]any)["id"] = "lobby-2"
+			})
+		}, backup.ErrChecksumMismatch},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := backup.Read(tc.backup(t), maxBytes)
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	_, err := backup.Read(strings.NewReader(""), maxBytes)
+	require.ErrorIs(t, err, backup.ErrInvalidBackup)
+}
+
+func TestReadLimitsDecompressedSize(t *testing.T) {
+	// a few kilobytes of gzip inflating to megabytes
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	_, err := zw.Write([]byte(`{"format":"vendingmachine-backup","archive":"`))
+	require.NoError(t, err)
+	_, err = zw.Write(bytes.Repeat([]byte("a"), 4<<20))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	_, err = backup.Read(&bomb, maxBytes)
+	require.ErrorIs(t, err, backup.ErrInvalidBackup)
+	assert.Contains(t, err.Error(), "decompressed")
+
+	var buf bytes.Buffer
+	require.NoError(t, backup.Write(&buf, backup.Archive{}))
+	_, err = backup.Read(bytes.NewReader(buf.Bytes()), 16)
+	require.ErrorIs(t, err, backup.ErrInvalidBackup)
+}
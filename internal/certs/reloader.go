@@ -0,0 +1,190 @@
+// Package certs serves the server's tls certificate and verifies the client
+// certificates, reloading the files when they change on disk.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var errNoClientCAs = errors.New("no certificates found in client ca file")
+
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual tls, the client certificates must be
+	// signed by one of its certificates
+	ClientCAFile string
+	// RequireClientCert rejects the clients without a certificate, otherwise
+	// they are let through and authenticated by other means
+	RequireClientCert bool
+	MinVersion        uint16
+}
+
+// Reloader holds the certificates loaded from the files of the config.
+type Reloader struct {
+	mu  sync.RWMutex
+	cfg Config
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// modTimes maps each file to its modification time when it was loaded
+	modTimes map[string]time.Time
+}
+
+func NewReloader(cfg Config) (*Reloader, error) {
+	r := &Reloader{
+		mu:       sync.RWMutex{},
+		cfg:      cfg,
+		modTimes: make(map[string]time.Time),
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ParseVersion parses a tls version such as "1.2", an empty version is tls 1.2.
+func ParseVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2", "":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls version %q, expected 1.2 or 1.3", v)
+	}
+}
+
+// Reload loads the files again if any of them changed since they were last
+// loaded. The current certificates are kept if the new ones are invalid.
+func (r *Reloader) Reload() (bool, error) {
+	changed := false
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, fmt.Errorf("failed to stat %q: %w", f, err)
+		}
+
+		r.mu.RLock()
+		loaded := r.modTimes[f]
+		r.mu.RUnlock()
+
+		if !info.ModTime().Equal(loaded) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	if err := r.load(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Watch reloads the files every interval until the context is done,
+// onReload is called after each reload with its error, if any.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onReload func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if reloaded || err != nil {
+				onReload(err)
+			}
+		}
+	}
+}
+
+// TLSConfig returns the config of the server, each handshake uses the
+// certificates loaded last.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.cfg.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   r.cfg.MinVersion,
+				Certificates: []tls.Certificate{*r.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+
+			if r.clientCAs != nil {
+				cfg.ClientCAs = r.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if r.cfg.RequireClientCert {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+
+	return files
+}
+
+func (r *Reloader) load() error {
+	// stat before reading so that a file written in between is loaded again
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("failed to stat %q: %w", f, err)
+		}
+		modTimes[f] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client ca file: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errNoClientCAs
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/certs"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert returns a certificate signed by the parent, or a self signed ca
+// if the parent is nil.
+func newCert(t *testing.T, cn string, serial int64, parent *keyPair) keyPair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	signer := keyPair{cert: tmpl, key: key}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer = *parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return keyPair{cert: cert, key: key}
+}
+
+func writeCert(t *testing.T, cert *x509.Certificate, path string) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600))
+}
+
+func writePair(t *testing.T, kp keyPair, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(kp.key)
+	require.NoError(t, err)
+
+	writeCert(t, kp.cert, certFile)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newCert(t, "ca", 1, nil)
+	writeCert(t, ca.cert, caFile)
+	writePair(t, newCert(t, "server", 2, &ca), certFile, keyFile, time.Now().Add(-time.Minute))
+
+	r, err := certs.NewReloader(certs.Config{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      caFile,
+		RequireClientCert: true,
+		MinVersion:        tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	var commonName string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		commonName = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}))
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := newCert(t, "kiosk-1", 3, &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(withCert bool) (*http.Response, error) {
+		cfg := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if withCert {
+			cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}}
+		}
+
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		return c.Get(srv.URL)
+	}
+
+	res, err := get(true)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "kiosk-1", commonName)
+	assert.EqualValues(t, 2, res.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	_, err = get(false)
+	require.Error(t, err, "clients without a certificate must be rejected")
+
+	reloaded, err := r.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	writePair(t, newCert(t, "server", 4, &ca), certFile, keyFile, time.Now())
+	reloaded, err = r.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+
+	res, err = get(true)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.EqualValues(t, 4, res.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// an invalid certificate keeps the current one
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	_, err = r.Reload()
+	require.Error(t, err)
+
+	res, err = get(true)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.EqualValues(t, 4, res.TLS.PeerCertificates[0].SerialNumber.Int64())
+}
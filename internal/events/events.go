@@ -0,0 +1,193 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	CoinInserted     Type = "coin_inserted"
+	ProductSelected  Type = "product_selected"
+	ProductDelivered Type = "product_delivered"
+	Aborted          Type = "aborted"
+	StockChanged     Type = "stock_changed"
+	PriceChanged     Type = "price_changed"
+)
+
+type Event struct {
+	// ID is increasing per machine and is used as the SSE event id
+	ID        uint64    `json:"id"`
+	MachineID string    `json:"machine_id"`
+	Type      Type      `json:"type"`
+	Time      time.Time `json:"time"`
+	Data      Data      `json:"data"`
+}
+
+type Data struct {
+	// Kind tells the vending machine, vm, and its state machine twin, sm,
+	// apart. It is empty for the changes applied to both.
+	Kind           string `json:"kind,omitempty"`
+	State          string `json:"state,omitempty"`
+	InsertedAmount int    `json:"inserted_amount,omitempty"`
+	Product        string `json:"product,omitempty"`
+	Price          int    `json:"price,omitempty"`
+	// Stock is a pointer since zero is a meaningful stock level
+	Stock *int `json:"stock,omitempty"`
+}
+
+// Broker fans out the events of each machine to its subscribers and keeps
+// the last bufferSize events of every machine so that subscribers can resume.
+type Broker struct {
+	mu         sync.Mutex
+	bufferSize int
+	streams    map[string]*stream
+	// lastIDs keeps the last event id of the forgotten machines, so that
+	// the ids of a machine created again with the same id keep increasing
+	// and the clients resuming from an old id do not skip its events
+	lastIDs map[string]uint64
+	// closed is set by Close, the subscribers added afterwards get a closed
+	// channel
+	closed bool
+}
+
+type stream struct {
+	lastID uint64
+	// buffer holds at most bufferSize of the latest events, oldest first
+	buffer      []Event
+	subscribers map[chan Event]struct{}
+}
+
+func NewBroker(bufferSize int) *Broker {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	return &Broker{
+		mu:         sync.Mutex{},
+		bufferSize: bufferSize,
+		streams:    make(map[string]*stream),
+		lastIDs:    make(map[string]uint64),
+	}
+}
+
+func (b *Broker) getStream(machineID string) *stream {
+	st, ok := b.streams[machineID]
+	if !ok {
+		st = &stream{
+			lastID:      b.lastIDs[machineID],
+			subscribers: make(map[chan Event]struct{}),
+		}
+		b.streams[machineID] = st
+		delete(b.lastIDs, machineID)
+	}
+
+	return st
+}
+
+func (b *Broker) Publish(machineID string, typ Type, data Data) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.getStream(machineID)
+	st.lastID++
+
+	e := Event{
+		ID:        st.lastID,
+		MachineID: machineID,
+		Type:      typ,
+		Time:      time.Now().UTC(),
+		Data:      data,
+	}
+
+	st.buffer = append(st.buffer, e)
+	if len(st.buffer) > b.bufferSize {
+		st.buffer = st.buffer[len(st.buffer)-b.bufferSize:]
+	}
+
+	for ch := range st.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// the subscriber is too slow, drop it so it can reconnect
+			// and resume from the buffer using its last event id
+			delete(st.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return e
+}
+
+// Subscribe returns the buffered events of the machine newer than lastEventID
+// and a channel on which the following events are delivered. The channel is
+// closed if the subscriber falls behind. cancel must be called once the
+// subscriber is done.
+func (b *Broker) Subscribe(machineID string, lastEventID uint64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.getStream(machineID)
+
+	var backlog []Event
+	for _, e := range st.buffer {
+		if e.ID > lastEventID {
+			backlog = append(backlog, e)
+		}
+	}
+
+	ch := make(chan Event, b.bufferSize)
+	if b.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	st.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := st.subscribers[ch]; ok {
+			delete(st.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return backlog, ch, cancel
+}
+
+// Forget drops the stream of a deleted machine, its buffered events are
+// discarded and the channels of its subscribers are closed. Only its last
+// event id is kept.
+func (b *Broker) Forget(machineID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.streams[machineID]
+	if !ok {
+		return
+	}
+
+	for ch := range st.subscribers {
+		delete(st.subscribers, ch)
+		close(ch)
+	}
+	b.lastIDs[machineID] = st.lastID
+	delete(b.streams, machineID)
+}
+
+// Close closes the channels of all the subscribers, e.g. on shutdown so
+// that the streams end. The events are still published and buffered.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for _, st := range b.streams {
+		for ch := range st.subscribers {
+			delete(st.subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/events"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	b := events.NewBroker(10)
+
+	backlog, ch, cancel := b.Subscribe("123", 0)
+	defer cancel()
+	assert.Empty(t, backlog)
+
+	published := b.Publish("123", events.CoinInserted, events.Data{InsertedAmount: 100})
+	b.Publish("456", events.Aborted, events.Data{})
+
+	e := <-ch
+	assert.Equal(t, published, e)
+	assert.Equal(t, uint64(1), e.ID)
+	assert.Equal(t, "123", e.MachineID)
+	assert.Empty(t, ch, "events of other machines should not be delivered")
+}
+
+func TestSubscribeResumesFromBuffer(t *testing.T) {
+	b := events.NewBroker(3)
+
+	for range 5 {
+		b.Publish("123", events.CoinInserted, events.Data{})
+	}
+
+	backlog, _, cancel := b.Subscribe("123", 0)
+	cancel()
+	require.Len(t, backlog, 3, "buffer should be bounded")
+	assert.Equal(t, uint64(3), backlog[0].ID)
+
+	backlog, _, cancel = b.Subscribe("123", 4)
+	cancel()
+	require.Len(t, backlog, 1)
+	assert.Equal(t, uint64(5), backlog[0].ID)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := events.NewBroker(1)
+
+	_, ch, cancel := b.Subscribe("123", 0)
+	defer cancel()
+
+	b.Publish("123", events.CoinInserted, events.Data{})
+	b.Publish("123", events.Aborted, events.Data{})
+
+	e, ok := <-ch
+	require.True(t, ok)
+	assert.Equal(t, events.CoinInserted, e.Type)
+
+	_, ok = <-ch
+	assert.False(t, ok, "channel should be closed after falling behind")
+}
+
+func TestForget(t *testing.T) {
+	b := events.NewBroker(10)
+
+	b.Publish("123", events.CoinInserted, events.Data{})
+	_, ch, cancel := b.Subscribe("123", 0)
+	defer cancel()
+
+	b.Forget("123")
+	_, ok := <-ch
+	assert.False(t, ok, "channel should be closed once the machine is forgotten")
+
+	backlog, _, cancel := b.Subscribe("123", 0)
+	cancel()
+	assert.Empty(t, backlog, "events of a forgotten machine should not be replayed")
+
+	e := b.Publish("123", events.CoinInserted, events.Data{})
+	assert.Equal(t, uint64(2), e.ID, "event ids should keep increasing after forgetting the machine")
+
+	b.Forget("456")
+}
+
+func TestClose(t *testing.T) {
+	b := events.NewBroker(10)
+
+	_, ch, cancel := b.Subscribe("123", 0)
+	defer cancel()
+
+	b.Close()
+	_, ok := <-ch
+	assert.False(t, ok, "channel should be closed once the broker is closed")
+
+	b.Publish("123", events.CoinInserted, events.Data{})
+	backlog, ch, cancel := b.Subscribe("123", 0)
+	defer cancel()
+	assert.Len(t, backlog, 1)
+	_, ok = <-ch
+	assert.False(t, ok, "channel of a new subscriber should be closed")
+}
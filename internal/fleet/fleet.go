@@ -0,0 +1,145 @@
+package fleet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// maxIDLength bounds the machine ids, they are used in urls and metric labels.
+const maxIDLength = 64
+
+var (
+	ErrInvalidFleet = errors.New("invalid fleet file")
+	ErrInvalidID    = errors.New("machine id must be 1 to 64 letters, digits, dots, dashes or underscores")
+)
+
+// Metadata describes where a machine is and what it is.
+type Metadata struct {
+	Site string `yaml:"site" json:"site,omitempty"`
+	// Geo is nil when the location of the machine is unknown
+	Geo   *Geo   `yaml:"geo" json:"geo,omitempty"`
+	Model string `yaml:"model" json:"model,omitempty"`
+	// InstalledOn is the date the machine was installed, e.g. 2024-03-01
+	InstalledOn string `yaml:"installed_on" json:"installed_on,omitempty"`
+	// Tags group the machines, e.g. to reprice all the machines tagged cold
+	Tags []string `yaml:"tags" json:"tags,omitempty"`
+	// Managed is set for the machines declared in the fleet file, it can
+	// not be set through the api
+	Managed bool `yaml:"-" json:"managed"`
+}
+
+// Geo is a position in decimal degrees.
+type Geo struct {
+	Lat float64 `yaml:"lat" json:"lat"`
+	Lon float64 `yaml:"lon" json:"lon"`
+}
+
+// Equal reports whether the metadata are the same, the order of the tags
+// and whether the machines are managed do not matter.
+func (m Metadata) Equal(o Metadata) bool {
+	a, b := slices.Clone(m.Tags), slices.Clone(o.Tags)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	sameGeo := m.Geo == nil && o.Geo == nil || m.Geo != nil && o.Geo != nil && *m.Geo == *o.Geo
+
+	return m.Site == o.Site && sameGeo && m.Model == o.Model && m.InstalledOn == o.InstalledOn && slices.Equal(a, b)
+}
+
+// HasTag reports whether the machine is tagged with the tag.
+func (m Metadata) HasTag(tag string) bool {
+	return slices.Contains(m.Tags, tag)
+}
+
+// Filter selects machines by their metadata, the zero filter selects every
+// machine.
+type Filter struct {
+	Site string
+	// Tags selects the machines having all the tags
+	Tags []string
+	// Managed selects only the machines declared in the fleet file
+	Managed bool
+}
+
+// Empty reports whether the filter selects every machine.
+func (f Filter) Empty() bool {
+	return f.Site == "" && len(f.Tags) == 0 && !f.Managed
+}
+
+// Match reports whether the filter selects the machine.
+func (f Filter) Match(md Metadata) bool {
+	if f.Site != "" && md.Site != f.Site || f.Managed && !md.Managed {
+		return false
+	}
+
+	for _, tag := range f.Tags {
+		if !md.HasTag(tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Machine is the declared state of a machine of the fleet.
+type Machine struct {
+	ID       string   `yaml:"id"`
+	Metadata Metadata `yaml:"metadata"`
+	// Inventory is the initial inventory, its prices are kept in sync but
+	// its stock only applies to new machines and products
+	Inventory []internalVM.Item `yaml:"inventory"`
+}
+
+type file struct {
+	Machines []Machine `yaml:"machines"`
+}
+
+// Load reads the machines of a fleet file, the ids must be valid and unique.
+// The inventories are left to the caller to validate.
+func Load(path string) ([]Machine, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fleet file: %w", err)
+	}
+
+	var f file
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFleet, err)
+	}
+
+	seen := make(map[string]bool, len(f.Machines))
+	for i, m := range f.Machines {
+		if !ValidID(m.ID) {
+			return nil, fmt.Errorf("%w: machines[%d].id %q: %w", ErrInvalidFleet, i, m.ID, ErrInvalidID)
+		}
+
+		if seen[m.ID] {
+			return nil, fmt.Errorf("%w: duplicate machine id %q", ErrInvalidFleet, m.ID)
+		}
+		seen[m.ID] = true
+	}
+
+	return f.Machines, nil
+}
+
+// ValidID reports whether the id may be chosen for a machine.
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_'
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
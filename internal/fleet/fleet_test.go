@@ -0,0 +1,61 @@
+package fleet_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/fleet"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  error
+	}{
+		{"valid", "machines: [{id: lobby-1, metadata: {site: hq}}, {id: lobby-2}]", nil},
+		{"date", "machines: [{id: lobby-1, metadata: {installed_on: 2024-03-01, geo: {lat: 1.5, lon: 2}}}]", nil},
+		{"managed", "machines: [{id: lobby-1, metadata: {managed: true}}]", fleet.ErrInvalidFleet},
+		{"empty", "", nil},
+		{"missing id", "machines: [{metadata: {site: hq}}]", fleet.ErrInvalidID},
+		{"invalid id", "machines: [{id: lobby/1}]", fleet.ErrInvalidID},
+		{"duplicate id", "machines: [{id: lobby-1}, {id: lobby-1}]", fleet.ErrInvalidFleet},
+		{"unknown field", "machines: [{id: lobby-1, colour: red}]", fleet.ErrInvalidFleet},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fleet.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.yaml), 0o600))
+
+			_, err := fleet.Load(path)
+			if tc.err == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	md := fleet.Metadata{Site: "hq", Tags: []string{"cold", "indoor"}, Managed: true}
+
+	assert.True(t, fleet.Filter{}.Match(md))
+	assert.True(t, fleet.Filter{Site: "hq", Tags: []string{"indoor", "cold"}, Managed: true}.Match(md))
+	assert.False(t, fleet.Filter{Site: "dock"}.Match(md))
+	assert.False(t, fleet.Filter{Tags: []string{"cold", "outdoor"}}.Match(md))
+	assert.False(t, fleet.Filter{Managed: true}.Match(fleet.Metadata{Site: "hq"}))
+}
+
+func TestMetadataEqualIgnoresTagOrder(t *testing.T) {
+	a := fleet.Metadata{Site: "hq", Tags: []string{"indoor", "coffee"}}
+	assert.True(t, a.Equal(fleet.Metadata{Site: "hq", Tags: []string{"coffee", "indoor"}}))
+	assert.False(t, a.Equal(fleet.Metadata{Site: "hq", Tags: []string{"coffee"}}))
+	assert.False(t, a.Equal(fleet.Metadata{Site: "hq", Tags: a.Tags, Geo: &fleet.Geo{Lat: 1, Lon: 2}}))
+	assert.True(t, a.Equal(fleet.Metadata{Site: "hq", Tags: a.Tags, Managed: true}))
+}
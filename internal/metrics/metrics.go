@@ -0,0 +1,312 @@
+// Package metrics implements the few metric types the server exposes and
+// writes them in the Prometheus text exposition format, without depending
+// on the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets in seconds used for latencies.
+func DefaultBuckets() []float64 {
+	return []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// Registry holds the metrics and writes them in registration order.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*vec
+	// onCollect run before each write, they update the metrics mirroring
+	// values kept elsewhere
+	onCollect []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{mu: sync.Mutex{}}
+}
+
+func (r *Registry) register(v *vec) *vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, v)
+
+	return v
+}
+
+// OnCollect registers a function that runs before the metrics are written.
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onCollect = append(r.onCollect, fn)
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(newVec(name, help, counterType, nil, labels))}
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(newVec(name, help, gaugeType, nil, labels))}
+}
+
+// Histogram registers a histogram with the given upper bounds, sorted in
+// increasing order.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(newVec(name, help, histogramType, buckets, labels))}
+}
+
+// WriteText writes all the metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collect := append([]func(){}, r.onCollect...)
+	metrics := append([]*vec{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, fn := range collect {
+		fn()
+	}
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+
+	return nil
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// vec is a metric family, it keeps one series per combination of label values.
+type vec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts holds the number of observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+}
+
+func newVec(name, help string, typ metricType, buckets []float64, labels []string) *vec {
+	return &vec{
+		mu:      sync.Mutex{},
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// with returns the series of the label values, creating it if needed. The
+// caller must hold the lock.
+func (v *vec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if v.typ == histogramType {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+// deleteMatching removes the series whose label has the given value.
+func (v *vec) deleteMatching(label, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	i := indexOf(v.labels, label)
+	if i < 0 {
+		return
+	}
+
+	for key, s := range v.series {
+		if s.labelValues[i] == value {
+			delete(v.series, key)
+		}
+	}
+}
+
+func (v *vec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.typ != histogramType {
+			fmt.Fprintf(b, "%s%s %s\n", v.name, v.labelPairs(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelPairs(s.labelValues, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelPairs(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, v.labelPairs(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, v.labelPairs(s.labelValues, ""), s.count)
+	}
+}
+
+// labelPairs formats the labels, le is added for histogram buckets if not empty.
+func (v *vec) labelPairs(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, l := range v.labels {
+		pairs = append(pairs, l+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type CounterVec struct{ v *vec }
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter, negative values are ignored.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+
+	c.v.with(labelValues).value += value
+}
+
+// Set overwrites the counter, it is meant for counters mirroring a count
+// kept elsewhere.
+func (c *CounterVec) Set(value float64, labelValues ...string) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+
+	c.v.with(labelValues).value = value
+}
+
+func (c *CounterVec) DeleteMatching(label, value string) {
+	c.v.deleteMatching(label, value)
+}
+
+type GaugeVec struct{ v *vec }
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+
+	g.v.with(labelValues).value = value
+}
+
+func (g *GaugeVec) DeleteMatching(label, value string) {
+	g.v.deleteMatching(label, value)
+}
+
+type HistogramVec struct{ v *vec }
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+
+	s := h.v.with(labelValues)
+	s.value += value
+	s.count++
+
+	// observations above the last bucket are only counted in +Inf
+	i := sort.SearchFloat64s(h.v.buckets, value)
+	if i < len(h.v.buckets) {
+		s.counts[i]++
+	}
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,69 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/metrics"
+)
+
+func TestWriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := r.Counter("requests_total", "Number of requests.", "route", "status")
+	c.Inc("/insert", "200")
+	c.Add(2, "/insert", "200")
+	c.Inc("/select", "400")
+	c.Add(-1, "/select", "400")
+
+	g := r.Gauge("stock", "Items left.", "machine", "product")
+	g.Set(3, "123", "coke")
+	g.Set(1, "123", `say "hi"`)
+	g.Set(5, "456", "coke")
+	g.DeleteMatching("machine", "456")
+
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var b strings.Builder
+	require.NoError(t, r.WriteText(&b))
+
+	assert.Equal(t, `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/insert",status="200"} 3
+requests_total{route="/select",status="400"} 1
+# HELP stock Items left.
+# TYPE stock gauge
+stock{machine="123",product="coke"} 3
+stock{machine="123",product="say \"hi\""} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+`, b.String())
+}
+
+func TestOnCollect(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	var n float64
+	c := r.Counter("mirrored_total", "Mirrored count.")
+	r.OnCollect(func() {
+		n++
+		c.Set(n)
+	})
+
+	var b strings.Builder
+	require.NoError(t, r.WriteText(&b))
+	require.NoError(t, r.WriteText(&b))
+
+	assert.Contains(t, b.String(), "mirrored_total 2\n")
+}
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the buckets that refilled completely are
+// dropped, a full bucket is equivalent to a missing one.
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket rate limiter keeping one bucket per key.
+type Limiter struct {
+	mu sync.Mutex
+	// rate is the number of tokens added to each bucket per second
+	rate  float64
+	burst float64
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	allowed  uint64
+	rejected uint64
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Stats are the counters of a limiter since it was created.
+type Stats struct {
+	Allowed  uint64 `json:"allowed"`
+	Rejected uint64 `json:"rejected"`
+	// Keys is the number of keys currently being limited
+	Keys int `json:"keys"`
+}
+
+// New returns a limiter allowing rate requests per second per key with
+// bursts of up to burst requests.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		mu:      sync.Mutex{},
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the key's bucket. If the bucket is empty it
+// returns false and how long to wait until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		l.allowed++
+		return true, 0
+	}
+
+	l.rejected++
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+
+	return false, wait
+}
+
+// SetLimits changes the rate and burst of all the buckets.
+func (l *Limiter) SetLimits(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.burst = float64(burst)
+}
+
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Allowed:  l.allowed,
+		Rejected: l.rejected,
+		Keys:     len(l.buckets),
+	}
+}
+
+// sweep drops the buckets that have refilled completely.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
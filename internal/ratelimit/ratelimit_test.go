@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for range 3 {
+		ok, _ := l.Allow("a")
+		require.True(t, ok)
+	}
+
+	ok, wait := l.Allow("a")
+	require.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// other keys have their own bucket
+	ok, _ = l.Allow("b")
+	require.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	require.True(t, ok)
+
+	ok, _ = l.Allow("a")
+	require.False(t, ok)
+
+	assert.Equal(t, Stats{Allowed: 5, Rejected: 2, Keys: 2}, l.Stats())
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1)
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.Allow("a")
+	require.True(t, ok)
+
+	now = now.Add(sweepInterval)
+	ok, _ = l.Allow("b")
+	require.True(t, ok)
+
+	// a refilled and was dropped
+	assert.Equal(t, 1, l.Stats().Keys)
+}
+
+func TestSetLimits(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1)
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.Allow("a")
+	require.True(t, ok)
+
+	l.SetLimits(10, 1)
+	now = now.Add(100 * time.Millisecond)
+
+	ok, _ = l.Allow("a")
+	require.True(t, ok)
+}
@@ -6,4 +6,6 @@ var (
 	ErrInvalidProduct    = errors.New("invalid product")
 	ErrOutOfStock        = errors.New("out of stock")
 	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInvalidItem       = errors.New("invalid item")
+	ErrBadState          = errors.New("bad state")
 )
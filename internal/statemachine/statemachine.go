@@ -1,9 +1,12 @@
 package statemachine
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"vendingmachine/internal/vendingmachine"
 )
@@ -29,9 +32,35 @@ type Machine struct {
 	currentState State
 	mu           *sync.Mutex
 	data         *Data
+
+	// observeLock is called with the time each operation waited for the
+	// lock, nil disables the measurement. It is only set on creation, so it
+	// is read without the lock.
+	observeLock func(ctx context.Context, wait time.Duration)
+
+	// version is the version of the stored machine, the storages set it
+	version int64
+}
+
+// Option is used to customize the Machine.
+type Option func(*Machine)
+
+// WithLockObserver reports how long each operation waited for the machine's
+// lock, together with the context of the operation.
+func WithLockObserver(observe func(ctx context.Context, wait time.Duration)) Option {
+	return func(m *Machine) {
+		m.observeLock = observe
+	}
+}
+
+// WithVersion sets the version of the stored machine.
+func WithVersion(v int64) Option {
+	return func(m *Machine) {
+		m.version = v
+	}
 }
 
-func New(items []vendingmachine.Item) (*Machine, error) {
+func New(items []vendingmachine.Item, opts ...Option) (*Machine, error) {
 	cs := &idleState{}
 	m := &Machine{
 		mu:           &sync.Mutex{},
@@ -45,6 +74,10 @@ func New(items []vendingmachine.Item) (*Machine, error) {
 		m.data.prodMap[item.Name] = &item
 	}
 
+	for _, o := range opts {
+		o(m)
+	}
+
 	cs.m = m
 
 	err := cs.m.currentState.Enter()
@@ -55,8 +88,39 @@ func New(items []vendingmachine.Item) (*Machine, error) {
 	return m, nil
 }
 
-func (m *Machine) Transit(d Data) error {
-	m.mu.Lock()
+// Restore rebuilds a machine from its snapshot, e.g. one read from a storage.
+func Restore(snap vendingmachine.Snapshot, opts ...Option) (*Machine, error) {
+	m, err := New(snap.Inventory, append([]Option{WithVersion(snap.Version)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, product := snap.InsertedAmount, snap.SelectedProduct
+
+	switch snap.State {
+	case vendingmachine.Idle:
+	case vendingmachine.Selecting:
+		m.data.InsertedAmount = &amount
+		m.currentState = &selectingState{m: m}
+	case vendingmachine.Delivering:
+		prop := m.data.prodMap[product]
+		if prop == nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidProduct, product)
+		}
+
+		m.data.InsertedAmount = &amount
+		m.data.SelectedProd = &product
+		m.data.selectedProdProb = prop
+		m.currentState = &deliveringState{m: m}
+	default:
+		return nil, fmt.Errorf("%w: unknown state: %q", ErrBadState, snap.State)
+	}
+
+	return m, nil
+}
+
+func (m *Machine) Transit(ctx context.Context, d Data) error {
+	m.lock(ctx)
 	defer m.mu.Unlock()
 
 	err := m.currentState.Transit(m, d)
@@ -96,7 +160,7 @@ func (s *idleState) Enter() error {
 
 func (s *idleState) Transit(m *Machine, d Data) error {
 	if d.InsertedAmount == nil {
-		return errors.New("no coins inserted")
+		return fmt.Errorf("%w: no coins inserted", ErrBadState)
 	}
 
 	s.m.data.InsertedAmount = d.InsertedAmount
@@ -122,7 +186,7 @@ func (s *selectingState) Enter() error {
 
 func (s *selectingState) Transit(m *Machine, d Data) error {
 	if d.SelectedProd == nil {
-		return errors.New("no product was selected")
+		return fmt.Errorf("%w: no product was selected", ErrBadState)
 	}
 
 	prop := s.m.data.prodMap[*d.SelectedProd]
@@ -180,3 +244,109 @@ func (s *deliveringState) Transit(m *Machine, _ Data) error {
 
 	return nil
 }
+
+// AbortAndReset cancels the current purchase, the inserted amount is
+// refunded and the machine goes back to idle.
+func (m *Machine) AbortAndReset(ctx context.Context) {
+	m.lock(ctx)
+	defer m.mu.Unlock()
+
+	m.data.InsertedAmount = nil
+	m.data.SelectedProd = nil
+	m.data.selectedProdProb = nil
+	m.currentState = &idleState{m: m}
+}
+
+// Restock adds item.Number units of the item to the inventory. Products
+// that are not in the inventory yet are added with item.Price.
+func (m *Machine) Restock(ctx context.Context, item vendingmachine.Item) error {
+	m.lock(ctx)
+	defer m.mu.Unlock()
+
+	if item.Number < 1 {
+		return fmt.Errorf("%w: restock number must be positive: %d", ErrInvalidItem, item.Number)
+	}
+
+	prop, ok := m.data.prodMap[item.Name]
+	if !ok {
+		if item.Name == "" || item.Price < 1 {
+			return fmt.Errorf("%w: new product needs a name and a positive price", ErrInvalidItem)
+		}
+		m.data.prodMap[item.Name] = &item
+		return nil
+	}
+
+	prop.Number += item.Number
+
+	return nil
+}
+
+func (m *Machine) SetPrice(ctx context.Context, product string, price int) error {
+	m.lock(ctx)
+	defer m.mu.Unlock()
+
+	if price < 1 {
+		return fmt.Errorf("%w: price must be positive: %d", ErrInvalidItem, price)
+	}
+
+	prop, ok := m.data.prodMap[product]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidProduct, product)
+	}
+
+	prop.Price = price
+
+	return nil
+}
+
+// Snapshot returns a point in time copy of the machine's state.
+func (m *Machine) Snapshot() vendingmachine.Snapshot {
+	m.lock(context.Background())
+	defer m.mu.Unlock()
+
+	s := vendingmachine.Snapshot{
+		State:     stateName(m.currentState),
+		Inventory: make([]vendingmachine.Item, 0, len(m.data.prodMap)),
+		Version:   m.version,
+	}
+
+	if m.data.InsertedAmount != nil {
+		s.InsertedAmount = *m.data.InsertedAmount
+	}
+
+	if m.data.SelectedProd != nil {
+		s.SelectedProduct = *m.data.SelectedProd
+	}
+
+	for _, item := range m.data.prodMap {
+		s.Inventory = append(s.Inventory, *item)
+	}
+
+	sort.Slice(s.Inventory, func(i, j int) bool {
+		return s.Inventory[i].Name < s.Inventory[j].Name
+	})
+
+	return s
+}
+
+func stateName(s State) vendingmachine.State {
+	switch s.(type) {
+	case *selectingState:
+		return vendingmachine.Selecting
+	case *deliveringState:
+		return vendingmachine.Delivering
+	default:
+		return vendingmachine.Idle
+	}
+}
+
+func (m *Machine) lock(ctx context.Context) {
+	if m.observeLock == nil {
+		m.mu.Lock()
+		return
+	}
+
+	start := time.Now()
+	m.mu.Lock()
+	m.observeLock(ctx, time.Since(start))
+}
@@ -5,4 +5,11 @@ import "errors"
 var (
 	ErrVMNotFound = errors.New("vending machine not found")
 	ErrSMNotFound = errors.New("state machine not found")
+	ErrVMExists   = errors.New("vending machine already exists")
+	ErrSMExists   = errors.New("state machine already exists")
+	// ErrVersionConflict is returned by the updates of a machine saved
+	// since it was read
+	ErrVersionConflict = errors.New("machine was changed since it was read")
+
+	ErrMetadataNotFound = errors.New("machine metadata not found")
 )
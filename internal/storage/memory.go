@@ -1,94 +1,379 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
 	"sync"
 
-	"github.com/google/uuid"
-
+	"vendingmachine/internal/fleet"
 	"vendingmachine/internal/statemachine"
 	internalVM "vendingmachine/internal/vendingmachine"
 )
 
+// InMemoryVMStorage keeps the snapshots of the machines, every read
+// restores a copy so the changes must be saved with UpdateVM.
 type InMemoryVMStorage struct {
 	mu sync.RWMutex
-	// vmMap maps the machine id to the vending machine instance
-	vmMap map[string]*internalVM.VendingMachine
+	// vmMap maps the machine id to the snapshot of the vending machine
+	vmMap map[string]internalVM.Snapshot
+	// events maps the machine id to the events of the vending machine
+	events map[string][]internalVM.Event
 }
 
 func NewInMemoryVMStorage() *InMemoryVMStorage {
 	return &InMemoryVMStorage{
-		mu:    sync.RWMutex{},
-		vmMap: make(map[string]*internalVM.VendingMachine),
+		mu:     sync.RWMutex{},
+		vmMap:  make(map[string]internalVM.Snapshot),
+		events: make(map[string][]internalVM.Event),
 	}
 }
 
-func (s *InMemoryVMStorage) GetVM(id string) (*internalVM.VendingMachine, error) {
+func (s *InMemoryVMStorage) GetVM(_ context.Context, id string) (*internalVM.VendingMachine, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	snap, ok := s.vmMap[id]
+	s.mu.RUnlock()
 
-	vm, ok := s.vmMap[id]
 	if !ok {
 		return nil, ErrVMNotFound
 	}
 
+	vm, err := internalVM.Restore(snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore vending machine: %w", err)
+	}
+
 	return vm, nil
 }
 
-func (s *InMemoryVMStorage) SaveVM(vm *internalVM.VendingMachine) (string, error) {
+// CreateVM stores the vending machine under the given id at version 1.
+func (s *InMemoryVMStorage) CreateVM(_ context.Context, id string, vm *internalVM.VendingMachine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.vmMap[id]; ok {
+		return fmt.Errorf("%w: %q", ErrVMExists, id)
+	}
+
+	snap := vm.Snapshot()
+	snap.Version = 1
+	s.vmMap[id] = snap
+	s.events[id] = vm.Events()
+
+	return nil
+}
+
+// ReplaceVM stores the vending machine under the given id at version 1,
+// replacing the stored machine and its events if there is one.
+func (s *InMemoryVMStorage) ReplaceVM(_ context.Context, id string, vm *internalVM.VendingMachine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := vm.Snapshot()
+	snap.Version = 1
+	s.vmMap[id] = snap
+	s.events[id] = vm.Events()
+
+	return nil
+}
+
+// UpdateVM saves the machine if the stored one is still at the machine's
+// version, the saved machine's version is one more.
+func (s *InMemoryVMStorage) UpdateVM(_ context.Context, id string, vm *internalVM.VendingMachine) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// generate a new machine id
-	id := uuid.New().String()
-	_, isDuplicate := s.vmMap[id]
-	for isDuplicate {
-		id = uuid.New().String()
-		_, isDuplicate = s.vmMap[id]
+	stored, ok := s.vmMap[id]
+	if !ok {
+		return ErrVMNotFound
+	}
+
+	snap := vm.Snapshot()
+	if snap.Version != stored.Version {
+		return fmt.Errorf("%w: %q", ErrVersionConflict, id)
 	}
 
-	s.vmMap[id] = vm
+	snap.Version++
+	s.vmMap[id] = snap
+	s.events[id] = append(s.events[id], vm.Events()...)
 
-	return id, nil
+	return nil
 }
 
+// VMEvents returns the events of the vending machine, oldest first.
+func (s *InMemoryVMStorage) VMEvents(_ context.Context, id string) ([]internalVM.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.vmMap[id]; !ok {
+		return nil, ErrVMNotFound
+	}
+
+	return slices.Clone(s.events[id]), nil
+}
+
+// DeleteVM removes the vending machine and its events, deleting a missing
+// machine is a no-op.
+func (s *InMemoryVMStorage) DeleteVM(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.vmMap, id)
+	delete(s.events, id)
+
+	return nil
+}
+
+// ListVMs returns the ids of all the vending machines, sorted.
+func (s *InMemoryVMStorage) ListVMs(_ context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.vmMap))
+	for id := range s.vmMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// InMemorySMStorage is InMemoryVMStorage for the state machines.
 type InMemorySMStorage struct {
 	mu sync.RWMutex
-	// stMap is the machine id to the statemachine instance
-	smMap map[string]*statemachine.Machine
+	// smMap maps the machine id to the snapshot of the state machine
+	smMap map[string]internalVM.Snapshot
 }
 
 func NewInMemorySMStorage() *InMemorySMStorage {
 	return &InMemorySMStorage{
 		mu:    sync.RWMutex{},
-		smMap: make(map[string]*statemachine.Machine),
+		smMap: make(map[string]internalVM.Snapshot),
 	}
 }
 
-func (s *InMemorySMStorage) GetSM(id string) (*statemachine.Machine, error) {
+func (s *InMemorySMStorage) GetSM(_ context.Context, id string) (*statemachine.Machine, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	snap, ok := s.smMap[id]
+	s.mu.RUnlock()
 
-	sm, ok := s.smMap[id]
 	if !ok {
-		return nil, ErrVMNotFound
+		return nil, ErrSMNotFound
+	}
+
+	sm, err := statemachine.Restore(snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore state machine: %w", err)
 	}
 
 	return sm, nil
 }
 
-func (s *InMemorySMStorage) SaveSM(sm *statemachine.Machine) (string, error) {
+// CreateSM stores the state machine under the given id at version 1.
+func (s *InMemorySMStorage) CreateSM(_ context.Context, id string, sm *statemachine.Machine) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// generate a new machine id
-	id := uuid.New().String()
-	_, isDuplicate := s.smMap[id]
-	for isDuplicate {
-		id = uuid.New().String()
-		_, isDuplicate = s.smMap[id]
+	if _, ok := s.smMap[id]; ok {
+		return fmt.Errorf("%w: %q", ErrSMExists, id)
 	}
 
-	s.smMap[id] = sm
+	snap := sm.Snapshot()
+	snap.Version = 1
+	s.smMap[id] = snap
+
+	return nil
+}
+
+// ReplaceSM is ReplaceVM for the state machines.
+func (s *InMemorySMStorage) ReplaceSM(_ context.Context, id string, sm *statemachine.Machine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := sm.Snapshot()
+	snap.Version = 1
+	s.smMap[id] = snap
+
+	return nil
+}
+
+// UpdateSM saves the machine if the stored one is still at the machine's
+// version, the saved machine's version is one more.
+func (s *InMemorySMStorage) UpdateSM(_ context.Context, id string, sm *statemachine.Machine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.smMap[id]
+	if !ok {
+		return ErrSMNotFound
+	}
+
+	snap := sm.Snapshot()
+	if snap.Version != stored.Version {
+		return fmt.Errorf("%w: %q", ErrVersionConflict, id)
+	}
+
+	snap.Version++
+	s.smMap[id] = snap
+
+	return nil
+}
+
+// DeleteSM removes the state machine, deleting a missing machine is a no-op.
+func (s *InMemorySMStorage) DeleteSM(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.smMap, id)
+
+	return nil
+}
+
+// ListSMs returns the ids of all the state machines, sorted.
+func (s *InMemorySMStorage) ListSMs(_ context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.smMap))
+	for id := range s.smMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+type InMemoryMetadataStorage struct {
+	mu sync.RWMutex
+	// metadata maps the machine id to its metadata
+	metadata map[string]fleet.Metadata
+	// bySite and byTag map the sites and the tags to the ids of their machines
+	bySite map[string]map[string]struct{}
+	byTag  map[string]map[string]struct{}
+}
+
+func NewInMemoryMetadataStorage() *InMemoryMetadataStorage {
+	return &InMemoryMetadataStorage{
+		mu:       sync.RWMutex{},
+		metadata: make(map[string]fleet.Metadata),
+		bySite:   make(map[string]map[string]struct{}),
+		byTag:    make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *InMemoryMetadataStorage) GetMetadata(_ context.Context, id string) (fleet.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	md, ok := s.metadata[id]
+	if !ok {
+		return fleet.Metadata{}, ErrMetadataNotFound
+	}
+
+	return cloneMetadata(md), nil
+}
+
+// SetMetadata replaces the metadata of the machine.
+func (s *InMemoryMetadataStorage) SetMetadata(_ context.Context, id string, md fleet.Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.metadata[id]; ok {
+		s.unindex(id, old)
+	}
+
+	md = cloneMetadata(md)
+	s.metadata[id] = md
+	index(s.bySite, md.Site, id)
+	for _, tag := range md.Tags {
+		index(s.byTag, tag, id)
+	}
+
+	return nil
+}
+
+// DeleteMetadata forgets the machine, deleting a missing machine is a no-op.
+func (s *InMemoryMetadataStorage) DeleteMetadata(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.metadata[id]; ok {
+		s.unindex(id, old)
+		delete(s.metadata, id)
+	}
+
+	return nil
+}
+
+// ListMachines returns the ids of the machines matching the filter, sorted.
+// Only the machines of the smallest index entry of the filter are matched.
+func (s *InMemoryMetadataStorage) ListMachines(_ context.Context, f fleet.Filter) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// without a site or a tag to look up every machine is a candidate
+	candidates, indexed := map[string]struct{}(nil), false
+	if f.Site != "" {
+		candidates, indexed = s.bySite[f.Site], true
+	}
+	for _, tag := range f.Tags {
+		if ids := s.byTag[tag]; !indexed || len(ids) < len(candidates) {
+			candidates, indexed = ids, true
+		}
+	}
+
+	ids := []string{}
+	if !indexed {
+		for id, md := range s.metadata {
+			if f.Match(md) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for id := range candidates {
+		if f.Match(s.metadata[id]) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *InMemoryMetadataStorage) unindex(id string, md fleet.Metadata) {
+	unindex(s.bySite, md.Site, id)
+	for _, tag := range md.Tags {
+		unindex(s.byTag, tag, id)
+	}
+}
+
+func index(idx map[string]map[string]struct{}, key, id string) {
+	if key == "" {
+		return
+	}
+
+	if idx[key] == nil {
+		idx[key] = make(map[string]struct{})
+	}
+	idx[key][id] = struct{}{}
+}
+
+func unindex(idx map[string]map[string]struct{}, key, id string) {
+	delete(idx[key], id)
+	if len(idx[key]) == 0 {
+		delete(idx, key)
+	}
+}
+
+// cloneMetadata copies the metadata so the stored one is not shared with
+// the callers.
+func cloneMetadata(md fleet.Metadata) fleet.Metadata {
+	md.Tags = slices.Clone(md.Tags)
+	if md.Geo != nil {
+		geo := *md.Geo
+		md.Geo = &geo
+	}
 
-	return id, nil
+	return md
 }
@@ -1,10 +1,13 @@
 package storage_test
 
 import (
+	"context"
 	"testing"
 
+	"vendingmachine/internal/fleet"
 	"vendingmachine/internal/statemachine"
 	"vendingmachine/internal/storage"
+	"vendingmachine/internal/storage/storagetest"
 	internalVM "vendingmachine/internal/vendingmachine"
 
 	"github.com/stretchr/testify/assert"
@@ -16,10 +19,9 @@ func TestInMemoryVMStorage(t *testing.T) {
 	vm, err := internalVM.New(getDefaultItems())
 	require.NoError(t, err)
 	assert.NotNil(t, vm)
-	id, err := s.SaveVM(vm)
-	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(context.Background(), "123", vm))
 
-	fetchedVM, err := s.GetVM(id)
+	fetchedVM, err := s.GetVM(context.Background(), "123")
 	require.NoError(t, err)
 	assert.NotNil(t, fetchedVM)
 }
@@ -29,14 +31,63 @@ func TestInMemorySMStorage(t *testing.T) {
 	sm, err := statemachine.New(getDefaultItems())
 	require.NoError(t, err)
 	assert.NotNil(t, sm)
-	id, err := s.SaveSM(sm)
-	require.NoError(t, err)
+	require.NoError(t, s.CreateSM(context.Background(), "123", sm))
 
-	fetchedSM, err := s.GetSM(id)
+	fetchedSM, err := s.GetSM(context.Background(), "123")
 	require.NoError(t, err)
 	assert.NotNil(t, fetchedSM)
 }
 
+func TestInMemoryCreateWithID(t *testing.T) {
+	ctx := context.Background()
+
+	vms := storage.NewInMemoryVMStorage()
+	vm, err := internalVM.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, vms.CreateVM(ctx, "lobby-1", vm))
+	require.ErrorIs(t, vms.CreateVM(ctx, "lobby-1", vm), storage.ErrVMExists)
+
+	fetchedVM, err := vms.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.NotSame(t, vm, fetchedVM, "the storage must not hand out the stored machine")
+	assert.Equal(t, int64(1), fetchedVM.Snapshot().Version)
+
+	sms := storage.NewInMemorySMStorage()
+	sm, err := statemachine.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, sms.CreateSM(ctx, "lobby-1", sm))
+	require.ErrorIs(t, sms.CreateSM(ctx, "lobby-1", sm), storage.ErrSMExists)
+}
+
+func TestInMemoryUpdateVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewInMemoryVMStorage()
+	vm, err := internalVM.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+
+	first, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	second, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+
+	require.NoError(t, first.InsertCoin(ctx, 100))
+	require.NoError(t, s.UpdateVM(ctx, "lobby-1", first))
+
+	// the second copy was read before the first was saved
+	require.NoError(t, second.Restock(ctx, internalVM.Item{Name: "coke", Number: 1, Price: 100}))
+	require.ErrorIs(t, s.UpdateVM(ctx, "lobby-1", second), storage.ErrVersionConflict)
+
+	stored, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stored.Snapshot().Version)
+	assert.Equal(t, 100, stored.Snapshot().InsertedAmount)
+	coke, _ := stored.Snapshot().Item("coke")
+	assert.Equal(t, 1, coke.Number)
+
+	require.ErrorIs(t, s.UpdateVM(ctx, "missing", first), storage.ErrVMNotFound)
+}
+
 func getDefaultItems() []internalVM.Item {
 	return []internalVM.Item{
 		{
@@ -56,3 +107,54 @@ func getDefaultItems() []internalVM.Item {
 		},
 	}
 }
+
+func TestInMemoryMetadataStorage(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewInMemoryMetadataStorage()
+
+	require.NoError(t, s.SetMetadata(ctx, "a", fleet.Metadata{Site: "hq", Tags: []string{"cold"}}))
+	require.NoError(t, s.SetMetadata(ctx, "b", fleet.Metadata{Site: "hq", Tags: []string{"cold", "indoor"}}))
+	require.NoError(t, s.SetMetadata(ctx, "c", fleet.Metadata{Site: "dock", Managed: true}))
+
+	find := func(f fleet.Filter) []string {
+		ids, err := s.ListMachines(ctx, f)
+		require.NoError(t, err)
+		return ids
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, find(fleet.Filter{}))
+	assert.Equal(t, []string{"a", "b"}, find(fleet.Filter{Site: "hq", Tags: []string{"cold"}}))
+	assert.Equal(t, []string{"b"}, find(fleet.Filter{Tags: []string{"cold", "indoor"}}))
+	assert.Equal(t, []string{"c"}, find(fleet.Filter{Managed: true}))
+	assert.Empty(t, find(fleet.Filter{Tags: []string{"outdoor"}}))
+
+	// replacing the metadata moves the machine between the index entries
+	require.NoError(t, s.SetMetadata(ctx, "a", fleet.Metadata{Site: "dock"}))
+	assert.Equal(t, []string{"b"}, find(fleet.Filter{Tags: []string{"cold"}}))
+	assert.Equal(t, []string{"a", "c"}, find(fleet.Filter{Site: "dock"}))
+
+	require.NoError(t, s.DeleteMetadata(ctx, "c"))
+	require.NoError(t, s.DeleteMetadata(ctx, "c"))
+	assert.Equal(t, []string{"a"}, find(fleet.Filter{Site: "dock"}))
+	_, err := s.GetMetadata(ctx, "c")
+	require.ErrorIs(t, err, storage.ErrMetadataNotFound)
+
+	md, err := s.GetMetadata(ctx, "b")
+	require.NoError(t, err)
+	md.Tags[0] = "warm"
+	assert.Equal(t, []string{"b"}, find(fleet.Filter{Tags: []string{"cold"}}), "the stored tags must not be shared")
+}
+
+// inMemory is the in memory backend of the storage contract.
+type inMemory struct {
+	*storage.InMemoryVMStorage
+	*storage.InMemorySMStorage
+}
+
+func TestInMemoryContract(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Empty: func(*testing.T) func(*testing.T) storagetest.Storage {
+			s := inMemory{storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage()}
+			return func(*testing.T) storagetest.Storage { return s }
+		},
+	})
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrations embed.FS //nolint: gochecknoglobals // embedded files can only be package variables
+
+// migrator is implemented by both *sql.DB and *sql.Conn.
+type migrator interface {
+	querier
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// migrate applies the migrations of the directory that are newer than the
+// schema, each in its own transaction. The migrations are named after their
+// version, e.g. 0002_add_sales.sql, and are never changed once released.
+func migrate(ctx context.Context, db migrator, dir string) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create the migrations table: %w", err)
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read the schema version: %w", err)
+	}
+
+	entries, err := fs.ReadDir(migrations, path.Join("migrations", dir))
+	if err != nil {
+		return fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("failed to read the version of migration %q: %w", e.Name(), err)
+		}
+
+		if version <= current {
+			continue
+		}
+
+		if err := applyMigration(ctx, db, path.Join("migrations", dir, e.Name()), version); err != nil {
+			return fmt.Errorf("failed to apply migration %q: %w", e.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, db migrator, name string, version int) error {
+	script, err := fs.ReadFile(migrations, name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint: errcheck // the error of a rollback after a commit is expected
+
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)",
+		version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
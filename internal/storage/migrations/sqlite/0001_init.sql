@@ -0,0 +1,54 @@
+-- the vending machines (kind vm) and the state machines (kind sm) share the
+-- ids, each twin has its own row and inventory
+CREATE TABLE machines (
+	kind             TEXT    NOT NULL,
+	id               TEXT    NOT NULL,
+	state            TEXT    NOT NULL,
+	inserted_amount  INTEGER NOT NULL DEFAULT 0,
+	selected_product TEXT    NOT NULL DEFAULT '',
+	updated_at       TIMESTAMP NOT NULL,
+	PRIMARY KEY (kind, id)
+);
+
+CREATE TABLE inventory (
+	kind       TEXT    NOT NULL,
+	machine_id TEXT    NOT NULL,
+	product    TEXT    NOT NULL,
+	number     INTEGER NOT NULL,
+	price      INTEGER NOT NULL,
+	PRIMARY KEY (kind, machine_id, product),
+	FOREIGN KEY (kind, machine_id) REFERENCES machines (kind, id) ON DELETE CASCADE
+);
+
+-- the sales outlive the machines
+CREATE TABLE sales (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind       TEXT    NOT NULL,
+	machine_id TEXT    NOT NULL,
+	product    TEXT    NOT NULL,
+	price      INTEGER NOT NULL,
+	sold_at    TIMESTAMP NOT NULL
+);
+
+CREATE INDEX sales_machine_id ON sales (machine_id, sold_at);
+
+CREATE TABLE machine_metadata (
+	machine_id   TEXT    PRIMARY KEY,
+	site         TEXT    NOT NULL DEFAULT '',
+	lat          REAL,
+	lon          REAL,
+	model        TEXT    NOT NULL DEFAULT '',
+	installed_on TEXT    NOT NULL DEFAULT '',
+	managed      INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX machine_metadata_site ON machine_metadata (site);
+
+CREATE TABLE machine_tags (
+	machine_id TEXT    NOT NULL REFERENCES machine_metadata (machine_id) ON DELETE CASCADE,
+	tag        TEXT    NOT NULL,
+	position   INTEGER NOT NULL,
+	PRIMARY KEY (machine_id, tag)
+);
+
+CREATE INDEX machine_tags_tag ON machine_tags (tag, machine_id);
@@ -0,0 +1,3 @@
+-- the version of a machine changes every time it is saved, an update
+-- replacing a different version than the one it read is rejected
+ALTER TABLE machines ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
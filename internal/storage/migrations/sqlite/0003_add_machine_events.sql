@@ -0,0 +1,31 @@
+-- the events of the vending machines, oldest first, whose fold is the
+-- machine. They are deleted with their machine.
+CREATE TABLE machine_events (
+	id         INTEGER   PRIMARY KEY AUTOINCREMENT,
+	kind       TEXT      NOT NULL,
+	machine_id TEXT      NOT NULL,
+	type       TEXT      NOT NULL,
+	at         TIMESTAMP NOT NULL,
+	amount     INTEGER   NOT NULL DEFAULT 0,
+	product    TEXT      NOT NULL DEFAULT '',
+	number     INTEGER   NOT NULL DEFAULT 0,
+	price      INTEGER   NOT NULL DEFAULT 0,
+	FOREIGN KEY (kind, machine_id) REFERENCES machines (kind, id) ON DELETE CASCADE
+);
+
+CREATE INDEX machine_events_machine_id ON machine_events (kind, machine_id, id);
+
+-- the machines stored before the events start with the events rebuilding
+-- their state when they were last saved
+INSERT INTO machine_events (kind, machine_id, type, at, product, number, price)
+	SELECT m.kind, m.id, 'Restocked', m.updated_at, i.product, i.number, i.price
+	FROM machines m JOIN inventory i ON i.kind = m.kind AND i.machine_id = m.id
+	WHERE m.kind = 'vm' ORDER BY m.id, i.product;
+
+INSERT INTO machine_events (kind, machine_id, type, at, amount)
+	SELECT kind, id, 'CoinInserted', updated_at, inserted_amount FROM machines
+	WHERE kind = 'vm' AND state IN ('Selecting', 'Delivering') ORDER BY id;
+
+INSERT INTO machine_events (kind, machine_id, type, at, product)
+	SELECT kind, id, 'ProductSelected', updated_at, selected_product FROM machines
+	WHERE kind = 'vm' AND state = 'Delivering' ORDER BY id;
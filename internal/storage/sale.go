@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"time"
+
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// Sale is a product delivered by a machine.
+type Sale struct {
+	MachineID string    `json:"machine_id"`
+	Kind      string    `json:"kind"`
+	Product   string    `json:"product"`
+	Price     int       `json:"price"`
+	SoldAt    time.Time `json:"sold_at"`
+}
+
+// salesOf returns a unit of each product delivered by the change from
+// before to after. Only a delivery lowers the stock of a product.
+func salesOf(before, after internalVM.Snapshot) []internalVM.Item {
+	var sold []internalVM.Item
+	for _, item := range after.Inventory {
+		prev, ok := before.Item(item.Name)
+		if !ok {
+			continue
+		}
+
+		for range prev.Number - item.Number {
+			sold = append(sold, item)
+		}
+	}
+
+	return sold
+}
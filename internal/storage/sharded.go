@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+
+	"vendingmachine/internal/statemachine"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// ShardedVMStorage spreads the machines over in memory shards by the hash of
+// their id. Each shard has its own lock, so the operations on the machines
+// of different shards do not wait for each other.
+type ShardedVMStorage struct {
+	shards []*InMemoryVMStorage
+}
+
+// NewShardedVMStorage returns a storage of n shards, at least one.
+func NewShardedVMStorage(n int) *ShardedVMStorage {
+	shards := make([]*InMemoryVMStorage, max(n, 1))
+	for i := range shards {
+		shards[i] = NewInMemoryVMStorage()
+	}
+
+	return &ShardedVMStorage{shards: shards}
+}
+
+func (s *ShardedVMStorage) shard(id string) *InMemoryVMStorage {
+	return s.shards[shardOf(id, len(s.shards))]
+}
+
+func (s *ShardedVMStorage) GetVM(ctx context.Context, id string) (*internalVM.VendingMachine, error) {
+	return s.shard(id).GetVM(ctx, id)
+}
+
+// CreateVM stores the vending machine under the given id at version 1.
+func (s *ShardedVMStorage) CreateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	return s.shard(id).CreateVM(ctx, id, vm)
+}
+
+// ReplaceVM stores the vending machine under the given id at version 1,
+// replacing the stored machine and its events if there is one.
+func (s *ShardedVMStorage) ReplaceVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	return s.shard(id).ReplaceVM(ctx, id, vm)
+}
+
+// UpdateVM saves the machine if the stored one is still at the machine's
+// version, the saved machine's version is one more.
+func (s *ShardedVMStorage) UpdateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	return s.shard(id).UpdateVM(ctx, id, vm)
+}
+
+// VMEvents returns the events of the vending machine, oldest first.
+func (s *ShardedVMStorage) VMEvents(ctx context.Context, id string) ([]internalVM.Event, error) {
+	return s.shard(id).VMEvents(ctx, id)
+}
+
+// DeleteVM removes the vending machine and its events, deleting a missing
+// machine is a no-op.
+func (s *ShardedVMStorage) DeleteVM(ctx context.Context, id string) error {
+	return s.shard(id).DeleteVM(ctx, id)
+}
+
+// ListVMs returns the ids of all the vending machines, sorted. The shards
+// are listed one after the other, not at a single point in time.
+func (s *ShardedVMStorage) ListVMs(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	for _, shard := range s.shards {
+		shardIDs, err := shard.ListVMs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, shardIDs...)
+	}
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+// ShardedSMStorage is ShardedVMStorage for the state machines.
+type ShardedSMStorage struct {
+	shards []*InMemorySMStorage
+}
+
+// NewShardedSMStorage returns a storage of n shards, at least one.
+func NewShardedSMStorage(n int) *ShardedSMStorage {
+	shards := make([]*InMemorySMStorage, max(n, 1))
+	for i := range shards {
+		shards[i] = NewInMemorySMStorage()
+	}
+
+	return &ShardedSMStorage{shards: shards}
+}
+
+func (s *ShardedSMStorage) shard(id string) *InMemorySMStorage {
+	return s.shards[shardOf(id, len(s.shards))]
+}
+
+func (s *ShardedSMStorage) GetSM(ctx context.Context, id string) (*statemachine.Machine, error) {
+	return s.shard(id).GetSM(ctx, id)
+}
+
+// CreateSM stores the state machine under the given id at version 1.
+func (s *ShardedSMStorage) CreateSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	return s.shard(id).CreateSM(ctx, id, sm)
+}
+
+// ReplaceSM is ReplaceVM for the state machines.
+func (s *ShardedSMStorage) ReplaceSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	return s.shard(id).ReplaceSM(ctx, id, sm)
+}
+
+// UpdateSM is UpdateVM for the state machines.
+func (s *ShardedSMStorage) UpdateSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	return s.shard(id).UpdateSM(ctx, id, sm)
+}
+
+// DeleteSM removes the state machine, deleting a missing machine is a no-op.
+func (s *ShardedSMStorage) DeleteSM(ctx context.Context, id string) error {
+	return s.shard(id).DeleteSM(ctx, id)
+}
+
+// ListSMs returns the ids of all the state machines, sorted.
+func (s *ShardedSMStorage) ListSMs(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	for _, shard := range s.shards {
+		shardIDs, err := shard.ListSMs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, shardIDs...)
+	}
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+// shardOf returns the shard of the id among n, the twins sharing an id are
+// in the same shard of their storages.
+func shardOf(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id)) //nolint: errcheck // writing to a hash never fails
+
+	return int(h.Sum32() % uint32(n)) //nolint: gosec // n is the number of shards, a small positive int
+}
@@ -0,0 +1,96 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/storage"
+	"vendingmachine/internal/storage/storagetest"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// benchShards is the number of shards of the benchmarked sharded storage.
+const benchShards = 64
+
+// sharded is the sharded backend of the storage contract.
+type sharded struct {
+	*storage.ShardedVMStorage
+	*storage.ShardedSMStorage
+}
+
+func TestShardedContract(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Empty: func(*testing.T) func(*testing.T) storagetest.Storage {
+			s := sharded{storage.NewShardedVMStorage(8), storage.NewShardedSMStorage(8)}
+			return func(*testing.T) storagetest.Storage { return s }
+		},
+	})
+}
+
+// vmStorage is the vending machine storage benchmarked.
+type vmStorage interface {
+	GetVM(ctx context.Context, id string) (*internalVM.VendingMachine, error)
+	CreateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	UpdateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+}
+
+// BenchmarkMixed reads machines and, one time in ten, saves a change to
+// them from parallel goroutines, e.g. with
+// go test -race -run '^$' -bench Mixed -cpu 1,8 ./internal/storage/
+func BenchmarkMixed(b *testing.B) {
+	for _, machines := range []int{1_000, 100_000} {
+		b.Run(fmt.Sprintf("memory/%d", machines), func(b *testing.B) {
+			benchmarkMixed(b, storage.NewInMemoryVMStorage(), machines)
+		})
+		b.Run(fmt.Sprintf("sharded/%d", machines), func(b *testing.B) {
+			benchmarkMixed(b, storage.NewShardedVMStorage(benchShards), machines)
+		})
+	}
+}
+
+func benchmarkMixed(b *testing.B, s vmStorage, machines int) {
+	ctx := context.Background()
+	for i := range machines {
+		vm, err := internalVM.New(getDefaultItems())
+		require.NoError(b, err)
+		require.NoError(b, s.CreateVM(ctx, fmt.Sprintf("machine-%d", i), vm))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			id := fmt.Sprintf("machine-%d", rand.IntN(machines)) //nolint: gosec // picking machines needs no secure random
+
+			vm, err := s.GetVM(ctx, id)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			const (
+				saveEvery = 10
+				prices    = 3
+			)
+			if i%saveEvery != 0 {
+				continue
+			}
+
+			if err := vm.SetPrice(ctx, "coke", 100+i%prices); err != nil {
+				b.Error(err)
+				return
+			}
+
+			// another goroutine may have saved the machine since it was read
+			if err := s.UpdateVM(ctx, id, vm); err != nil && !errors.Is(err, storage.ErrVersionConflict) {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,606 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// the kinds tell apart the vending machine and the state machine sharing an id
+const (
+	kindVM = "vm"
+	kindSM = "sm"
+)
+
+// sqlStore keeps the machines, their metadata and their sales in an sql
+// database. The machines are read into new instances, so the changes must be
+// saved with UpdateVM and UpdateSM.
+type sqlStore struct {
+	db *sql.DB
+	// lockRow is appended to the query reading the machine to change, e.g.
+	// FOR UPDATE, for the databases locking rows so that the machine is not
+	// changed by anyone else until the change is saved
+	lockRow string
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) GetVM(ctx context.Context, id string) (*internalVM.VendingMachine, error) {
+	snap, err := loadMachine(ctx, s.db, kindVM, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return internalVM.Restore(snap)
+}
+
+// CreateVM stores the vending machine under the given id at version 1.
+func (s *sqlStore) CreateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	return s.createMachine(ctx, kindVM, id, vm.Snapshot(), vm.Events(), false)
+}
+
+// ReplaceVM stores the vending machine under the given id at version 1,
+// replacing the stored machine and its events if there is one, in a single
+// transaction.
+func (s *sqlStore) ReplaceVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	return s.createMachine(ctx, kindVM, id, vm.Snapshot(), vm.Events(), true)
+}
+
+// UpdateVM saves the machine if the stored one is still at the machine's
+// version, the saved machine's version is one more. A delivery records the
+// sale and the machine's events are appended in the same transaction.
+func (s *sqlStore) UpdateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	return s.updateMachine(ctx, kindVM, id, vm.Snapshot(), vm.Events())
+}
+
+// ChangeVM reads the vending machine, applies change and saves it in a
+// single transaction, holding the lock of the machine's row until then. The
+// replicas changing a machine wait for each other instead of conflicting.
+// change must not use the storage.
+func (s *sqlStore) ChangeVM(ctx context.Context, id string, change func(vm *internalVM.VendingMachine) error) error {
+	return s.changeMachine(ctx, kindVM, id,
+		func(snap internalVM.Snapshot) (internalVM.Snapshot, []internalVM.Event, error) {
+			vm, err := internalVM.Restore(snap)
+			if err != nil {
+				return internalVM.Snapshot{}, nil, err
+			}
+
+			if err := change(vm); err != nil {
+				return internalVM.Snapshot{}, nil, err
+			}
+
+			return vm.Snapshot(), vm.Events(), nil
+		})
+}
+
+// VMEvents returns the events of the vending machine, oldest first.
+func (s *sqlStore) VMEvents(ctx context.Context, id string) ([]internalVM.Event, error) {
+	var found int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM machines WHERE kind = $1 AND id = $2", kindVM, id).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrVMNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read machine: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT type, at, amount, product, number, price FROM machine_events
+		WHERE kind = $1 AND machine_id = $2 ORDER BY id`, kindVM, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []internalVM.Event{}
+	for rows.Next() {
+		var e internalVM.Event
+		if err := rows.Scan(&e.Type, &e.At, &e.Amount, &e.Product, &e.Number, &e.Price); err != nil {
+			return nil, fmt.Errorf("failed to read event: %w", err)
+		}
+		e.At = e.At.UTC()
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// DeleteVM removes the vending machine and its events, deleting a missing
+// machine is a no-op.
+func (s *sqlStore) DeleteVM(ctx context.Context, id string) error {
+	return s.deleteMachine(ctx, kindVM, id)
+}
+
+// ListVMs returns the ids of all the vending machines, sorted.
+func (s *sqlStore) ListVMs(ctx context.Context) ([]string, error) {
+	return s.listMachines(ctx, kindVM)
+}
+
+func (s *sqlStore) GetSM(ctx context.Context, id string) (*statemachine.Machine, error) {
+	snap, err := loadMachine(ctx, s.db, kindSM, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return statemachine.Restore(snap)
+}
+
+// CreateSM stores the state machine under the given id at version 1.
+func (s *sqlStore) CreateSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	return s.createMachine(ctx, kindSM, id, sm.Snapshot(), nil, false)
+}
+
+// ReplaceSM is ReplaceVM for the state machines.
+func (s *sqlStore) ReplaceSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	return s.createMachine(ctx, kindSM, id, sm.Snapshot(), nil, true)
+}
+
+// UpdateSM is UpdateVM for the state machines.
+func (s *sqlStore) UpdateSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	return s.updateMachine(ctx, kindSM, id, sm.Snapshot(), nil)
+}
+
+// ChangeSM is ChangeVM for the state machines.
+func (s *sqlStore) ChangeSM(ctx context.Context, id string, change func(sm *statemachine.Machine) error) error {
+	return s.changeMachine(ctx, kindSM, id,
+		func(snap internalVM.Snapshot) (internalVM.Snapshot, []internalVM.Event, error) {
+			sm, err := statemachine.Restore(snap)
+			if err != nil {
+				return internalVM.Snapshot{}, nil, err
+			}
+
+			if err := change(sm); err != nil {
+				return internalVM.Snapshot{}, nil, err
+			}
+
+			return sm.Snapshot(), nil, nil
+		})
+}
+
+// DeleteSM removes the state machine, deleting a missing machine is a no-op.
+func (s *sqlStore) DeleteSM(ctx context.Context, id string) error {
+	return s.deleteMachine(ctx, kindSM, id)
+}
+
+// ListSMs returns the ids of all the state machines, sorted.
+func (s *sqlStore) ListSMs(ctx context.Context) ([]string, error) {
+	return s.listMachines(ctx, kindSM)
+}
+
+// Sales returns the sales of the machine, oldest first.
+func (s *sqlStore) Sales(ctx context.Context, id string) ([]Sale, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT kind, machine_id, product, price, sold_at FROM sales
+		WHERE machine_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sales: %w", err)
+	}
+	defer rows.Close()
+
+	sales := []Sale{}
+	for rows.Next() {
+		var sale Sale
+		if err := rows.Scan(&sale.Kind, &sale.MachineID, &sale.Product, &sale.Price, &sale.SoldAt); err != nil {
+			return nil, fmt.Errorf("failed to read sale: %w", err)
+		}
+		sales = append(sales, sale)
+	}
+
+	return sales, rows.Err()
+}
+
+func notFound(kind string) error {
+	if kind == kindSM {
+		return ErrSMNotFound
+	}
+
+	return ErrVMNotFound
+}
+
+func exists(kind string) error {
+	if kind == kindSM {
+		return ErrSMExists
+	}
+
+	return ErrVMExists
+}
+
+// loadMachine reads the machine, lock is appended to the query of the
+// machine's row.
+func loadMachine(ctx context.Context, q querier, kind, id, lock string) (internalVM.Snapshot, error) {
+	var snap internalVM.Snapshot
+	err := q.QueryRowContext(ctx, `SELECT state, inserted_amount, selected_product, version FROM machines
+		WHERE kind = $1 AND id = $2 `+lock, kind, id).
+		Scan(&snap.State, &snap.InsertedAmount, &snap.SelectedProduct, &snap.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return internalVM.Snapshot{}, notFound(kind)
+	} else if err != nil {
+		return internalVM.Snapshot{}, fmt.Errorf("failed to read machine: %w", err)
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT product, number, price FROM inventory
+		WHERE kind = $1 AND machine_id = $2 ORDER BY product`, kind, id)
+	if err != nil {
+		return internalVM.Snapshot{}, fmt.Errorf("failed to read inventory: %w", err)
+	}
+	defer rows.Close()
+
+	snap.Inventory = []internalVM.Item{}
+	for rows.Next() {
+		var item internalVM.Item
+		if err := rows.Scan(&item.Name, &item.Number, &item.Price); err != nil {
+			return internalVM.Snapshot{}, fmt.Errorf("failed to read inventory: %w", err)
+		}
+		snap.Inventory = append(snap.Inventory, item)
+	}
+
+	return snap, rows.Err()
+}
+
+// saveInventory writes the inventory of an existing machine, the products
+// are never removed from an inventory.
+func saveInventory(ctx context.Context, q querier, kind, id string, inventory []internalVM.Item) error {
+	for _, item := range inventory {
+		_, err := q.ExecContext(ctx, `INSERT INTO inventory (kind, machine_id, product, number, price)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (kind, machine_id, product) DO UPDATE SET number = excluded.number, price = excluded.price`,
+			kind, id, item.Name, item.Number, item.Price)
+		if err != nil {
+			return fmt.Errorf("failed to save inventory: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// appendEvents appends the events of an existing machine.
+func appendEvents(ctx context.Context, q querier, kind, id string, events []internalVM.Event) error {
+	for _, e := range events {
+		_, err := q.ExecContext(ctx, `INSERT INTO machine_events (kind, machine_id, type, at, amount, product, number, price)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			kind, id, string(e.Type), e.At.UTC(), e.Amount, e.Product, e.Number, e.Price)
+		if err != nil {
+			return fmt.Errorf("failed to append event: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// createMachine inserts the machine at version 1, replace deletes the
+// stored one first.
+func (s *sqlStore) createMachine(ctx context.Context, kind, id string, snap internalVM.Snapshot,
+	events []internalVM.Event, replace bool,
+) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint: errcheck // the error of a rollback after a commit is expected
+
+	if replace {
+		if err := deleteMachine(ctx, tx, kind, id); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO machines
+		(kind, id, state, inserted_amount, selected_product, version, updated_at) VALUES ($1, $2, $3, $4, $5, 1, $6)
+		ON CONFLICT (kind, id) DO NOTHING`,
+		kind, id, string(snap.State), snap.InsertedAmount, snap.SelectedProduct, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create machine: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to create machine: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: %q", exists(kind), id)
+	}
+
+	if err := saveInventory(ctx, tx, kind, id, snap.Inventory); err != nil {
+		return err
+	}
+
+	if err := appendEvents(ctx, tx, kind, id, events); err != nil {
+		return err
+	}
+
+	// the events of a machine restored from a backup carry its sales
+	for _, e := range events {
+		if e.Type != internalVM.ProductDelivered {
+			continue
+		}
+
+		sold := internalVM.Item{Name: e.Product, Number: 1, Price: e.Price}
+		if err := recordSale(ctx, tx, kind, id, sold, e.At.UTC()); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func recordSale(ctx context.Context, q querier, kind, id string, sold internalVM.Item, at time.Time) error {
+	_, err := q.ExecContext(ctx, `INSERT INTO sales (kind, machine_id, product, price, sold_at)
+		VALUES ($1, $2, $3, $4, $5)`, kind, id, sold.Name, sold.Price, at)
+	if err != nil {
+		return fmt.Errorf("failed to record sale: %w", err)
+	}
+
+	return nil
+}
+
+// updateMachine replaces the stored machine with after, which was read at
+// after.Version, bumps the version and appends the events of the changes.
+func (s *sqlStore) updateMachine(ctx context.Context, kind, id string, after internalVM.Snapshot,
+	events []internalVM.Event,
+) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint: errcheck // the error of a rollback after a commit is expected
+
+	// the stored machine tells the sales apart, the update below fails if it
+	// is saved by someone else in between
+	before, err := loadMachine(ctx, tx, kind, id, "")
+	if err != nil {
+		return err
+	}
+
+	if before.Version != after.Version {
+		return fmt.Errorf("%w: %q", ErrVersionConflict, id)
+	}
+
+	if err := saveMachine(ctx, tx, kind, id, before, after, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// changeMachine reads the machine, locking its row, and saves the snapshot
+// and the events change returns in the same transaction.
+func (s *sqlStore) changeMachine(ctx context.Context, kind, id string,
+	change func(snap internalVM.Snapshot) (internalVM.Snapshot, []internalVM.Event, error),
+) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint: errcheck // the error of a rollback after a commit is expected
+
+	before, err := loadMachine(ctx, tx, kind, id, s.lockRow)
+	if err != nil {
+		return err
+	}
+
+	after, events, err := change(before)
+	if err != nil {
+		return err
+	}
+
+	if err := saveMachine(ctx, tx, kind, id, before, after, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// saveMachine replaces the stored machine, read as before, with after if it
+// is still at after.Version, bumps the version, appends the events and
+// records the sales.
+func saveMachine(ctx context.Context, tx *sql.Tx, kind, id string, before, after internalVM.Snapshot,
+	events []internalVM.Event,
+) error {
+	res, err := tx.ExecContext(ctx, `UPDATE machines SET state = $1, inserted_amount = $2, selected_product = $3,
+		version = version + 1, updated_at = $4 WHERE kind = $5 AND id = $6 AND version = $7`,
+		string(after.State), after.InsertedAmount, after.SelectedProduct, time.Now().UTC(), kind, id, after.Version)
+	if err != nil {
+		return fmt.Errorf("failed to save machine: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to save machine: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: %q", ErrVersionConflict, id)
+	}
+
+	if err := saveInventory(ctx, tx, kind, id, after.Inventory); err != nil {
+		return err
+	}
+
+	if err := appendEvents(ctx, tx, kind, id, events); err != nil {
+		return err
+	}
+
+	for _, sold := range salesOf(before, after) {
+		if err := recordSale(ctx, tx, kind, id, sold, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStore) deleteMachine(ctx context.Context, kind, id string) error {
+	return deleteMachine(ctx, s.db, kind, id)
+}
+
+func deleteMachine(ctx context.Context, q querier, kind, id string) error {
+	// the inventory and the events are deleted by the foreign keys
+	if _, err := q.ExecContext(ctx, "DELETE FROM machines WHERE kind = $1 AND id = $2", kind, id); err != nil {
+		return fmt.Errorf("failed to delete machine: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqlStore) listMachines(ctx context.Context, kind string) ([]string, error) {
+	return queryIDs(ctx, s.db, "SELECT id FROM machines WHERE kind = $1 ORDER BY id", kind)
+}
+
+func queryIDs(ctx context.Context, q querier, query string, args ...any) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machines: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to list machines: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) GetMetadata(ctx context.Context, id string) (fleet.Metadata, error) {
+	var (
+		md       fleet.Metadata
+		lat, lon sql.NullFloat64
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT site, lat, lon, model, installed_on, managed FROM machine_metadata
+		WHERE machine_id = $1`, id).Scan(&md.Site, &lat, &lon, &md.Model, &md.InstalledOn, &md.Managed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fleet.Metadata{}, ErrMetadataNotFound
+	} else if err != nil {
+		return fleet.Metadata{}, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	if lat.Valid && lon.Valid {
+		md.Geo = &fleet.Geo{Lat: lat.Float64, Lon: lon.Float64}
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT tag FROM machine_tags WHERE machine_id = $1 ORDER BY position", id)
+	if err != nil {
+		return fleet.Metadata{}, fmt.Errorf("failed to read tags: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return fleet.Metadata{}, fmt.Errorf("failed to read tags: %w", err)
+		}
+		md.Tags = append(md.Tags, tag)
+	}
+
+	return md, rows.Err()
+}
+
+// SetMetadata replaces the metadata of the machine.
+func (s *sqlStore) SetMetadata(ctx context.Context, id string, md fleet.Metadata) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint: errcheck // the error of a rollback after a commit is expected
+
+	var lat, lon sql.NullFloat64
+	if md.Geo != nil {
+		lat = sql.NullFloat64{Float64: md.Geo.Lat, Valid: true}
+		lon = sql.NullFloat64{Float64: md.Geo.Lon, Valid: true}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO machine_metadata (machine_id, site, lat, lon, model, installed_on, managed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (machine_id) DO UPDATE SET site = excluded.site, lat = excluded.lat, lon = excluded.lon,
+			model = excluded.model, installed_on = excluded.installed_on, managed = excluded.managed`,
+		id, md.Site, lat, lon, md.Model, md.InstalledOn, md.Managed)
+	if err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM machine_tags WHERE machine_id = $1", id); err != nil {
+		return fmt.Errorf("failed to save tags: %w", err)
+	}
+
+	for i, tag := range md.Tags {
+		_, err := tx.ExecContext(ctx, "INSERT INTO machine_tags (machine_id, tag, position) VALUES ($1, $2, $3)",
+			id, tag, i)
+		if err != nil {
+			return fmt.Errorf("failed to save tags: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteMetadata forgets the machine, deleting a missing machine is a no-op.
+func (s *sqlStore) DeleteMetadata(ctx context.Context, id string) error {
+	// the tags are deleted by the foreign key
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM machine_metadata WHERE machine_id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+
+	return nil
+}
+
+// ListMachines returns the ids of the machines matching the filter, sorted.
+func (s *sqlStore) ListMachines(ctx context.Context, f fleet.Filter) ([]string, error) {
+	var (
+		where []string
+		args  []any
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Site != "" {
+		where = append(where, "m.site = "+arg(f.Site))
+	}
+	if f.Managed {
+		where = append(where, "m.managed = "+arg(true))
+	}
+	for _, tag := range f.Tags {
+		where = append(where, "EXISTS (SELECT 1 FROM machine_tags t WHERE t.machine_id = m.machine_id AND t.tag = "+
+			arg(tag)+")")
+	}
+
+	query := "SELECT m.machine_id FROM machine_metadata m"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	return queryIDs(ctx, s.db, query+" ORDER BY m.machine_id", args...)
+}
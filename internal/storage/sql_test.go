@@ -0,0 +1,312 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	"vendingmachine/internal/storage"
+	"vendingmachine/internal/storage/storagetest"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// sqlStorage is implemented by the storages backed by an sql database.
+type sqlStorage interface {
+	storagetest.Storage
+	Sales(ctx context.Context, id string) ([]storage.Sale, error)
+	GetMetadata(ctx context.Context, id string) (fleet.Metadata, error)
+	SetMetadata(ctx context.Context, id string, md fleet.Metadata) error
+	DeleteMetadata(ctx context.Context, id string) error
+	ListMachines(ctx context.Context, f fleet.Filter) ([]string, error)
+	ChangeVM(ctx context.Context, id string, change func(vm *internalVM.VendingMachine) error) error
+	ChangeSM(ctx context.Context, id string, change func(sm *statemachine.Machine) error) error
+	Close() error
+}
+
+// testSQLStorage runs the storage contract and the tests shared by the sql
+// storages. empty returns a function opening the storage of an empty
+// database, each call opens it again.
+func testSQLStorage(t *testing.T, empty func(t *testing.T) func(t *testing.T) sqlStorage) {
+	t.Run("contract", func(t *testing.T) {
+		storagetest.Run(t, storagetest.Backend{
+			Empty: func(t *testing.T) func(t *testing.T) storagetest.Storage {
+				open := empty(t)
+				return func(t *testing.T) storagetest.Storage { return open(t) }
+			},
+			Persistent: true,
+		})
+	})
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, open func(t *testing.T) sqlStorage)
+	}{
+		{"persists across reopen", testPersistsAcrossReopen},
+		{"delivery records sale", testDeliveryRecordsSale},
+		{"events fold into the machine", testEventsFold},
+		{"list machines", testListMachines},
+		{"concurrent changes", testConcurrentChanges},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, empty(t))
+		})
+	}
+}
+
+func testPersistsAcrossReopen(t *testing.T, open func(t *testing.T) sqlStorage) {
+	ctx := context.Background()
+
+	s := open(t)
+	vm, err := internalVM.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+	require.ErrorIs(t, s.CreateVM(ctx, "lobby-1", vm), storage.ErrVMExists)
+
+	sm, err := statemachine.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateSM(ctx, "lobby-1", sm))
+
+	require.NoError(t, changeVM(ctx, s, "lobby-1", func(vm *internalVM.VendingMachine) error {
+		return vm.InsertCoin(ctx, 150)
+	}))
+	amount := 120
+	sm, err = s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	require.NoError(t, sm.Transit(ctx, statemachine.Data{InsertedAmount: &amount}))
+	require.NoError(t, s.UpdateSM(ctx, "lobby-1", sm))
+	require.NoError(t, s.SetMetadata(ctx, "lobby-1", fleet.Metadata{
+		Site: "hq", Geo: &fleet.Geo{Lat: 52.5, Lon: 13.4}, Tags: []string{"indoor", "cold"}, Managed: true,
+	}))
+	require.NoError(t, s.Close())
+
+	s = open(t)
+	vm, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Selecting, vm.Snapshot().State)
+	assert.Equal(t, 150, vm.Snapshot().InsertedAmount)
+	assert.Equal(t, int64(2), vm.Snapshot().Version)
+
+	sm, err = s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Selecting, sm.Snapshot().State)
+	assert.Equal(t, 120, sm.Snapshot().InsertedAmount)
+
+	md, err := s.GetMetadata(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, fleet.Metadata{
+		Site: "hq", Geo: &fleet.Geo{Lat: 52.5, Lon: 13.4}, Tags: []string{"indoor", "cold"}, Managed: true,
+	}, md)
+
+	ids, err := s.ListVMs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lobby-1"}, ids)
+}
+
+func testEventsFold(t *testing.T, open func(t *testing.T) sqlStorage) {
+	ctx := context.Background()
+
+	s := open(t)
+	vm, err := internalVM.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+	require.NoError(t, changeVM(ctx, s, "lobby-1", func(vm *internalVM.VendingMachine) error {
+		if err := vm.InsertCoin(ctx, 150); err != nil {
+			return err
+		}
+		return vm.SelectProduct(ctx, "coke")
+	}))
+	require.NoError(t, changeVM(ctx, s, "lobby-1", func(vm *internalVM.VendingMachine) error {
+		if err := vm.DeliverProduct(ctx); err != nil {
+			return err
+		}
+		return vm.SetPrice(ctx, "coffee", 60)
+	}))
+	require.NoError(t, s.Close())
+
+	s = open(t)
+	events, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	require.Len(t, events, len(getDefaultItems())+4)
+	assert.Equal(t, internalVM.PriceChanged, events[len(events)-1].Type)
+
+	stored, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	replayed, err := internalVM.Replay(events)
+	require.NoError(t, err)
+	want := stored.Snapshot()
+	want.Version = 0
+	assert.Equal(t, want, replayed.Snapshot())
+
+	// the events go with their machine
+	require.NoError(t, s.DeleteVM(ctx, "lobby-1"))
+	_, err = s.VMEvents(ctx, "lobby-1")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+	events, err = s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Len(t, events, len(getDefaultItems()))
+}
+
+func testDeliveryRecordsSale(t *testing.T, open func(t *testing.T) sqlStorage) {
+	ctx := context.Background()
+	s := open(t)
+
+	vm, err := internalVM.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+
+	buy := func(vm *internalVM.VendingMachine) error {
+		if err := vm.InsertCoin(ctx, 100); err != nil {
+			return err
+		}
+		if err := vm.SelectProduct(ctx, "coke"); err != nil {
+			return err
+		}
+		return vm.DeliverProduct(ctx)
+	}
+	require.NoError(t, changeVM(ctx, s, "lobby-1", buy))
+
+	sales, err := s.Sales(ctx, "lobby-1")
+	require.NoError(t, err)
+	require.Len(t, sales, 1)
+	assert.Equal(t, "coke", sales[0].Product)
+	assert.Equal(t, 100, sales[0].Price)
+	assert.False(t, sales[0].SoldAt.IsZero())
+
+	vm, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	coke, _ := vm.Snapshot().Item("coke")
+	assert.Equal(t, 0, coke.Number)
+
+	// the coke is sold out, nothing of the failed update is saved
+	err = changeVM(ctx, s, "lobby-1", buy)
+	require.ErrorIs(t, err, internalVM.ErrOutOfStock)
+
+	vm, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Idle, vm.Snapshot().State)
+
+	sales, err = s.Sales(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Len(t, sales, 1)
+}
+
+// changeVM reads the machine, applies fn and saves it, reading it again
+// after a conflict like the handlers do.
+func changeVM(ctx context.Context, s sqlStorage, id string, fn func(vm *internalVM.VendingMachine) error) error {
+	for {
+		vm, err := s.GetVM(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(vm); err != nil {
+			return err
+		}
+
+		err = s.UpdateVM(ctx, id, vm)
+		if !errors.Is(err, storage.ErrVersionConflict) {
+			return err
+		}
+	}
+}
+
+func testConcurrentChanges(t *testing.T, open func(t *testing.T) sqlStorage) {
+	ctx := context.Background()
+	s := open(t)
+
+	vm, err := internalVM.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+	sm, err := statemachine.New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateSM(ctx, "lobby-1", sm))
+
+	const changes = 10
+
+	// the changes wait for each other instead of conflicting
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*changes)
+	for range changes {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- s.ChangeVM(ctx, "lobby-1", func(vm *internalVM.VendingMachine) error {
+				return vm.Restock(ctx, internalVM.Item{Name: "coke", Number: 1})
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- s.ChangeSM(ctx, "lobby-1", func(sm *statemachine.Machine) error {
+				return sm.Restock(ctx, internalVM.Item{Name: "coke", Number: 1})
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	vm, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	coke, _ := vm.Snapshot().Item("coke")
+	assert.Equal(t, 1+changes, coke.Number)
+	assert.Equal(t, int64(1+changes), vm.Snapshot().Version)
+
+	sm, err = s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	coke, _ = sm.Snapshot().Item("coke")
+	assert.Equal(t, 1+changes, coke.Number)
+
+	// a failed change saves nothing
+	err = s.ChangeVM(ctx, "lobby-1", func(vm *internalVM.VendingMachine) error {
+		if err := vm.InsertCoin(ctx, 100); err != nil {
+			return err
+		}
+		return vm.SelectProduct(ctx, "missing")
+	})
+	require.Error(t, err)
+	vm, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Idle, vm.Snapshot().State)
+
+	err = s.ChangeVM(ctx, "missing", func(*internalVM.VendingMachine) error { return nil })
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+}
+
+func testListMachines(t *testing.T, open func(t *testing.T) sqlStorage) {
+	ctx := context.Background()
+	s := open(t)
+
+	require.NoError(t, s.SetMetadata(ctx, "a", fleet.Metadata{Site: "hq", Tags: []string{"cold"}}))
+	require.NoError(t, s.SetMetadata(ctx, "b", fleet.Metadata{Site: "hq", Tags: []string{"cold", "indoor"}}))
+	require.NoError(t, s.SetMetadata(ctx, "c", fleet.Metadata{Site: "dock", Managed: true}))
+
+	_, err := s.GetMetadata(ctx, "missing")
+	require.ErrorIs(t, err, storage.ErrMetadataNotFound)
+
+	find := func(f fleet.Filter) []string {
+		ids, err := s.ListMachines(ctx, f)
+		require.NoError(t, err)
+		return ids
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, find(fleet.Filter{}))
+	assert.Equal(t, []string{"a", "b"}, find(fleet.Filter{Site: "hq", Tags: []string{"cold"}}))
+	assert.Equal(t, []string{"b"}, find(fleet.Filter{Tags: []string{"cold", "indoor"}}))
+	assert.Equal(t, []string{"c"}, find(fleet.Filter{Managed: true}))
+
+	require.NoError(t, s.SetMetadata(ctx, "a", fleet.Metadata{Site: "dock"}))
+	assert.Equal(t, []string{"b"}, find(fleet.Filter{Tags: []string{"cold"}}))
+
+	require.NoError(t, s.DeleteMetadata(ctx, "c"))
+	assert.Equal(t, []string{"a"}, find(fleet.Filter{Site: "dock"}))
+}
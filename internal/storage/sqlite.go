@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	// registers the pure go sqlite driver, no cgo is needed
+	_ "modernc.org/sqlite"
+)
+
+// sqliteOptions enforce the foreign keys, wait for the other writers
+// instead of failing and take the write lock when a transaction begins so
+// that a read followed by a write in the same transaction never fails.
+const sqliteOptions = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+	"&_txlock=immediate&_time_format=sqlite"
+
+// SQLite stores the machines in an SQLite database file, it implements the
+// vending machine, state machine and metadata storages.
+type SQLite struct {
+	sqlStore
+}
+
+// OpenSQLite opens the database file, creating it if it does not exist, and
+// migrates its schema.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?"+sqliteOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+
+	// sqlite allows a single writer, a single connection also keeps the
+	// writers from waiting on each other's busy timeout
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(ctx, db, "sqlite"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite database: %w", err)
+	}
+
+	return &SQLite{sqlStore: sqlStore{db: db, lockRow: ""}}, nil
+}
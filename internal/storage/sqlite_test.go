@@ -0,0 +1,27 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/storage"
+)
+
+func TestSQLite(t *testing.T) {
+	testSQLStorage(t, func(t *testing.T) func(t *testing.T) sqlStorage {
+		path := filepath.Join(t.TempDir(), "vendingmachine.db")
+
+		return func(t *testing.T) sqlStorage {
+			t.Helper()
+
+			s, err := storage.OpenSQLite(context.Background(), path)
+			require.NoError(t, err)
+			t.Cleanup(func() { s.Close() })
+
+			return s
+		}
+	})
+}
@@ -0,0 +1,501 @@
+// Package storagetest is the contract of the machine storages, every
+// storage backend runs it from its own tests.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/statemachine"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// Storage is the vending machine and state machine storages of a backend.
+type Storage interface {
+	GetVM(ctx context.Context, id string) (*internalVM.VendingMachine, error)
+	CreateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	ReplaceVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	UpdateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error
+	VMEvents(ctx context.Context, id string) ([]internalVM.Event, error)
+	DeleteVM(ctx context.Context, id string) error
+	ListVMs(ctx context.Context) ([]string, error)
+	GetSM(ctx context.Context, id string) (*statemachine.Machine, error)
+	CreateSM(ctx context.Context, id string, sm *statemachine.Machine) error
+	ReplaceSM(ctx context.Context, id string, sm *statemachine.Machine) error
+	UpdateSM(ctx context.Context, id string, sm *statemachine.Machine) error
+	DeleteSM(ctx context.Context, id string) error
+	ListSMs(ctx context.Context) ([]string, error)
+}
+
+// Backend opens the storage under test.
+type Backend struct {
+	// Empty empties the backend and returns a function opening its storage.
+	// Each call opens the storage again, like another replica of the server
+	// would, the in memory backends return the same storage every time.
+	Empty func(t *testing.T) func(t *testing.T) Storage
+	// Persistent is set for the backends keeping the machines once their
+	// storage is closed with io.Closer and opened again.
+	Persistent bool
+}
+
+type contractTest struct {
+	name string
+	test func(t *testing.T, open func(t *testing.T) Storage)
+}
+
+// Run runs the contract against the backend.
+func Run(t *testing.T, b Backend) {
+	tests := []contractTest{
+		{"not found", testNotFound},
+		{"exists", testExists},
+		{"updates are visible", testUpdatesVisible},
+		{"version conflict", testVersionConflict},
+		{"replace", testReplace},
+		{"concurrent updates", testConcurrentUpdates},
+		{"concurrent creates", testConcurrentCreates},
+		{"idempotent deletes", testIdempotentDeletes},
+		{"list sorted", testListSorted},
+	}
+	if b.Persistent {
+		tests = append(tests, contractTest{"survives reopen", testSurvivesReopen})
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, b.Empty(t))
+		})
+	}
+}
+
+func items() []internalVM.Item {
+	return []internalVM.Item{
+		{Name: "coke", Number: 1, Price: 100},
+		{Name: "coffee", Number: 2, Price: 50},
+		{Name: "milk", Number: 0, Price: 80},
+	}
+}
+
+// create stores a vending machine and its state machine twin under the id.
+func create(t *testing.T, s Storage, id string) {
+	t.Helper()
+	ctx := context.Background()
+
+	vm, err := internalVM.New(items())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, id, vm))
+
+	sm, err := statemachine.New(items())
+	require.NoError(t, err)
+	require.NoError(t, s.CreateSM(ctx, id, sm))
+}
+
+// changeVM reads the machine, applies fn and saves it, reading it again
+// after a conflict like the handlers do.
+func changeVM(ctx context.Context, s Storage, id string, fn func(vm *internalVM.VendingMachine) error) error {
+	for {
+		vm, err := s.GetVM(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(vm); err != nil {
+			return err
+		}
+
+		err = s.UpdateVM(ctx, id, vm)
+		if !errors.Is(err, storage.ErrVersionConflict) {
+			return err
+		}
+	}
+}
+
+// changeSM is changeVM for the state machines.
+func changeSM(ctx context.Context, s Storage, id string, fn func(sm *statemachine.Machine) error) error {
+	for {
+		sm, err := s.GetSM(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(sm); err != nil {
+			return err
+		}
+
+		err = s.UpdateSM(ctx, id, sm)
+		if !errors.Is(err, storage.ErrVersionConflict) {
+			return err
+		}
+	}
+}
+
+func testNotFound(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+
+	vm, err := internalVM.New(items())
+	require.NoError(t, err)
+	sm, err := statemachine.New(items())
+	require.NoError(t, err)
+
+	_, err = s.GetVM(ctx, "missing")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+	require.ErrorIs(t, s.UpdateVM(ctx, "missing", vm), storage.ErrVMNotFound)
+	_, err = s.VMEvents(ctx, "missing")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+
+	_, err = s.GetSM(ctx, "missing")
+	require.ErrorIs(t, err, storage.ErrSMNotFound)
+	require.NotErrorIs(t, err, storage.ErrVMNotFound)
+	require.ErrorIs(t, s.UpdateSM(ctx, "missing", sm), storage.ErrSMNotFound)
+
+	// a twin does not make the other one exist
+	require.NoError(t, s.CreateVM(ctx, "vm-only", vm))
+	_, err = s.GetSM(ctx, "vm-only")
+	require.ErrorIs(t, err, storage.ErrSMNotFound)
+	require.NoError(t, s.CreateSM(ctx, "sm-only", sm))
+	_, err = s.GetVM(ctx, "sm-only")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+}
+
+func testExists(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	create(t, s, "lobby-1")
+
+	vm, err := internalVM.New(nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, s.CreateVM(ctx, "lobby-1", vm), storage.ErrVMExists)
+
+	sm, err := statemachine.New(nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, s.CreateSM(ctx, "lobby-1", sm), storage.ErrSMExists)
+
+	// the failed creates change nothing
+	stored, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Len(t, stored.Snapshot().Inventory, len(items()))
+}
+
+func testUpdatesVisible(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	create(t, s, "lobby-1")
+
+	vm, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), vm.Snapshot().Version)
+
+	// the reads are copies, the changes are only stored by an update
+	require.NoError(t, vm.InsertCoin(ctx, 150))
+	stored, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Idle, stored.Snapshot().State)
+
+	require.NoError(t, s.UpdateVM(ctx, "lobby-1", vm))
+	stored, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Selecting, stored.Snapshot().State)
+	assert.Equal(t, 150, stored.Snapshot().InsertedAmount)
+	assert.Equal(t, int64(2), stored.Snapshot().Version)
+
+	events, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	require.Len(t, events, len(items())+1)
+	assert.Equal(t, internalVM.CoinInserted, events[len(events)-1].Type)
+
+	amount := 120
+	require.NoError(t, changeSM(ctx, s, "lobby-1", func(sm *statemachine.Machine) error {
+		return sm.Transit(ctx, statemachine.Data{InsertedAmount: &amount})
+	}))
+	sm, err := s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Selecting, sm.Snapshot().State)
+	assert.Equal(t, 120, sm.Snapshot().InsertedAmount)
+	assert.Equal(t, int64(2), sm.Snapshot().Version)
+}
+
+func testVersionConflict(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	create(t, s, "lobby-1")
+
+	first, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	second, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+
+	require.NoError(t, first.SetPrice(ctx, "coke", 120))
+	require.NoError(t, s.UpdateVM(ctx, "lobby-1", first))
+
+	require.NoError(t, second.SetPrice(ctx, "coke", 90))
+	require.ErrorIs(t, s.UpdateVM(ctx, "lobby-1", second), storage.ErrVersionConflict)
+
+	stored, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	coke, _ := stored.Snapshot().Item("coke")
+	assert.Equal(t, 120, coke.Price, "the conflicting update must not be saved")
+	assert.Equal(t, int64(2), stored.Snapshot().Version)
+
+	events, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Len(t, events, len(items())+1, "the events of the conflicting update must not be saved")
+
+	firstSM, err := s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	secondSM, err := s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+
+	require.NoError(t, firstSM.SetPrice(ctx, "coke", 120))
+	require.NoError(t, s.UpdateSM(ctx, "lobby-1", firstSM))
+	require.NoError(t, secondSM.SetPrice(ctx, "coke", 90))
+	require.ErrorIs(t, s.UpdateSM(ctx, "lobby-1", secondSM), storage.ErrVersionConflict)
+}
+
+func testReplace(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	create(t, s, "lobby-1")
+	require.NoError(t, changeVM(ctx, s, "lobby-1", func(vm *internalVM.VendingMachine) error {
+		return vm.InsertCoin(ctx, 100)
+	}))
+	require.NoError(t, changeSM(ctx, s, "lobby-1", func(sm *statemachine.Machine) error {
+		return sm.SetPrice(ctx, "coke", 120)
+	}))
+
+	for _, id := range []string{"lobby-1", "lobby-2"} {
+		vm, err := internalVM.New([]internalVM.Item{{Name: "tea", Number: 3, Price: 70}})
+		require.NoError(t, err)
+		require.NoError(t, s.ReplaceVM(ctx, id, vm))
+
+		sm, err := statemachine.New([]internalVM.Item{{Name: "tea", Number: 3, Price: 70}})
+		require.NoError(t, err)
+		require.NoError(t, s.ReplaceSM(ctx, id, sm))
+
+		stored, err := s.GetVM(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, internalVM.Idle, stored.Snapshot().State)
+		assert.Equal(t, []internalVM.Item{{Name: "tea", Number: 3, Price: 70}}, stored.Snapshot().Inventory)
+		assert.Equal(t, int64(1), stored.Snapshot().Version)
+
+		events, err := s.VMEvents(ctx, id)
+		require.NoError(t, err)
+		assert.Len(t, events, 1, "the events of the replaced machine must be dropped")
+
+		storedSM, err := s.GetSM(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, []internalVM.Item{{Name: "tea", Number: 3, Price: 70}}, storedSM.Snapshot().Inventory)
+		assert.Equal(t, int64(1), storedSM.Snapshot().Version)
+	}
+}
+
+// testConcurrentUpdates updates the machines through two storages, like two
+// replicas of the server sharing the backend would.
+func testConcurrentUpdates(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	replicas := []Storage{open(t), open(t)}
+	s := replicas[0]
+
+	vm, err := internalVM.New(nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CreateVM(ctx, "lobby-1", vm))
+	sm, err := statemachine.New(nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CreateSM(ctx, "lobby-1", sm))
+
+	const restocks = 20
+	restock := internalVM.Item{Name: "coke", Number: 1, Price: 100}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*restocks)
+	for i := range restocks {
+		replica := replicas[i%len(replicas)]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- changeVM(ctx, replica, "lobby-1", func(vm *internalVM.VendingMachine) error {
+				return vm.Restock(ctx, restock)
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- changeSM(ctx, replica, "lobby-1", func(sm *statemachine.Machine) error {
+				return sm.Restock(ctx, restock)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	vm, err = s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	coke, _ := vm.Snapshot().Item("coke")
+	assert.Equal(t, restocks, coke.Number, "no restock must be lost")
+	assert.Equal(t, int64(restocks+1), vm.Snapshot().Version)
+
+	events, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Len(t, events, restocks)
+
+	sm, err = s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	coke, _ = sm.Snapshot().Item("coke")
+	assert.Equal(t, restocks, coke.Number, "no restock must be lost")
+}
+
+func testConcurrentCreates(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	replicas := []Storage{open(t), open(t)}
+
+	const machines = 10
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+	errs := make(chan error, 2*machines)
+	for i := range 2 * machines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			vm, err := internalVM.New(items())
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			// every id is created twice, once by each replica
+			err = replicas[i%len(replicas)].CreateVM(ctx, fmt.Sprintf("lobby-%d", i/2), vm)
+			if errors.Is(err, storage.ErrVMExists) {
+				return
+			} else if err != nil {
+				errs <- err
+				return
+			}
+
+			mu.Lock()
+			created++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, machines, created, "each id must be created once")
+	ids, err := replicas[0].ListVMs(ctx)
+	require.NoError(t, err)
+	assert.Len(t, ids, machines)
+
+	for _, id := range ids {
+		events, err := replicas[0].VMEvents(ctx, id)
+		require.NoError(t, err)
+		assert.Len(t, events, len(items()), "the losing create must not append its events")
+	}
+}
+
+func testIdempotentDeletes(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	create(t, s, "lobby-1")
+
+	for range 2 {
+		require.NoError(t, s.DeleteVM(ctx, "lobby-1"))
+		require.NoError(t, s.DeleteSM(ctx, "lobby-1"))
+	}
+	require.NoError(t, s.DeleteVM(ctx, "missing"))
+	require.NoError(t, s.DeleteSM(ctx, "missing"))
+
+	_, err := s.GetVM(ctx, "lobby-1")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+	_, err = s.VMEvents(ctx, "lobby-1")
+	require.ErrorIs(t, err, storage.ErrVMNotFound)
+	_, err = s.GetSM(ctx, "lobby-1")
+	require.ErrorIs(t, err, storage.ErrSMNotFound)
+
+	vmIDs, err := s.ListVMs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, vmIDs)
+	smIDs, err := s.ListSMs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, smIDs)
+
+	// the id can be taken again, by a machine starting over
+	create(t, s, "lobby-1")
+	vm, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), vm.Snapshot().Version)
+	events, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Len(t, events, len(items()))
+}
+
+func testListSorted(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	for _, id := range []string{"c", "a", "b"} {
+		create(t, s, id)
+	}
+
+	vmIDs, err := s.ListVMs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, vmIDs)
+	smIDs, err := s.ListSMs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, smIDs)
+}
+
+func testSurvivesReopen(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	s := open(t)
+	create(t, s, "lobby-1")
+
+	require.NoError(t, changeVM(ctx, s, "lobby-1", func(vm *internalVM.VendingMachine) error {
+		if err := vm.InsertCoin(ctx, 150); err != nil {
+			return err
+		}
+		return vm.SelectProduct(ctx, "coke")
+	}))
+	amount := 120
+	require.NoError(t, changeSM(ctx, s, "lobby-1", func(sm *statemachine.Machine) error {
+		return sm.Transit(ctx, statemachine.Data{InsertedAmount: &amount})
+	}))
+
+	vm, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	events, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	sm, err := s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+
+	closer, ok := s.(io.Closer)
+	require.True(t, ok, "a persistent storage must be closable")
+	require.NoError(t, closer.Close())
+
+	s = open(t)
+	reopened, err := s.GetVM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.Snapshot(), reopened.Snapshot())
+
+	reopenedEvents, err := s.VMEvents(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, events, reopenedEvents)
+
+	reopenedSM, err := s.GetSM(ctx, "lobby-1")
+	require.NoError(t, err)
+	assert.Equal(t, sm.Snapshot(), reopenedSM.Snapshot())
+}
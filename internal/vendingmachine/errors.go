@@ -7,4 +7,5 @@ var (
 	ErrInvalidProduct    = errors.New("invalid product")
 	ErrInsufficientFunds = errors.New("insufficient funds")
 	ErrOutOfStock        = errors.New("out of stock")
+	ErrInvalidItem       = errors.New("invalid item")
 )
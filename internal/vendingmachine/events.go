@@ -0,0 +1,124 @@
+package vendingmachine
+
+import (
+	"context"
+	"time"
+)
+
+// EventType names a change of a vending machine.
+type EventType string
+
+const (
+	CoinInserted     EventType = "CoinInserted"
+	ProductSelected  EventType = "ProductSelected"
+	ProductDelivered EventType = "ProductDelivered"
+	Aborted          EventType = "Aborted"
+	// Restocked also stocks the inventory of a new machine
+	Restocked    EventType = "Restocked"
+	PriceChanged EventType = "PriceChanged"
+)
+
+// Event is a change of a vending machine. The state of a machine is the fold
+// of its events, oldest first, see Replay.
+type Event struct {
+	Type EventType `json:"type"`
+	At   time.Time `json:"at"`
+	// Amount is the amount of a CoinInserted
+	Amount int `json:"amount,omitempty"`
+	// Product is the product selected, delivered, restocked or repriced
+	Product string `json:"product,omitempty"`
+	// Number is the number of units Restocked
+	Number int `json:"number,omitempty"`
+	// Price is the price of a ProductDelivered, of a PriceChanged or of the
+	// new product of a Restocked
+	Price int `json:"price,omitempty"`
+}
+
+// Replay rebuilds a machine from its events, oldest first.
+func Replay(events []Event, opts ...VMOption) (*VendingMachine, error) {
+	vm, err := New(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		vm.apply(e)
+	}
+
+	return vm, nil
+}
+
+// Until returns the events that happened at or before t.
+func Until(events []Event, t time.Time) []Event {
+	until := make([]Event, 0, len(events))
+	for _, e := range events {
+		// the clocks of the replicas may disagree, so the events are not
+		// assumed to be sorted by time
+		if !e.At.After(t) {
+			until = append(until, e)
+		}
+	}
+
+	return until
+}
+
+// Events returns the events of the changes since the machine was created or
+// restored, the storages append them to the machine's events when saving it.
+func (vm *VendingMachine) Events() []Event {
+	vm.lock(context.Background())
+	defer vm.mu.Unlock()
+
+	return append([]Event(nil), vm.events...)
+}
+
+// record applies the event of a change to the machine and keeps it. The
+// callers hold the lock and have validated the change.
+func (vm *VendingMachine) record(e Event) {
+	now := vm.now
+	if now == nil {
+		now = time.Now
+	}
+
+	e.At = now().UTC()
+	vm.apply(e)
+	vm.events = append(vm.events, e)
+}
+
+// apply folds the event into the machine, the event is a fact so it is not
+// validated.
+func (vm *VendingMachine) apply(e Event) {
+	switch e.Type {
+	case CoinInserted:
+		amount := e.Amount
+		vm.state = Selecting
+		vm.insertedAmount = &amount
+	case ProductSelected:
+		product := e.Product
+		vm.state = Delivering
+		vm.selectedProd = &product
+	case ProductDelivered:
+		vm.state = Idle
+		if prod, ok := vm.prodmap[e.Product]; ok {
+			prod.Number--
+		}
+		if vm.insertedAmount != nil {
+			amount := *vm.insertedAmount - e.Price
+			vm.insertedAmount = &amount
+		}
+		vm.selectedProd = nil
+	case Aborted:
+		vm.state = Idle
+		vm.insertedAmount = nil
+		vm.selectedProd = nil
+	case Restocked:
+		if prod, ok := vm.prodmap[e.Product]; ok {
+			prod.Number += e.Number
+			return
+		}
+		vm.prodmap[e.Product] = &Item{Name: e.Product, Number: e.Number, Price: e.Price}
+	case PriceChanged:
+		if prod, ok := vm.prodmap[e.Product]; ok {
+			prod.Price = e.Price
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package vendingmachine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tick is a clock advancing a minute every time it is read.
+func tick(start time.Time) func() time.Time {
+	now := start
+	return func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	vm, err := New(getDefaultItems(), WithClock(tick(time.Date(2024, 5, 7, 9, 0, 0, 0, time.UTC))))
+	require.NoError(t, err)
+
+	require.NoError(t, vm.InsertCoin(ctx, 100))
+	require.NoError(t, vm.SelectProduct(ctx, "coke"))
+	require.NoError(t, vm.DeliverProduct(ctx))
+	vm.AbortAndReset(ctx)
+	require.NoError(t, vm.Restock(ctx, Item{Name: "milk", Number: 3}))
+	require.NoError(t, vm.Restock(ctx, Item{Name: "tea", Number: 2, Price: 40}))
+	require.NoError(t, vm.SetPrice(ctx, "coke", 120))
+	require.NoError(t, vm.InsertCoin(ctx, 50))
+
+	events := vm.Events()
+	types := make([]EventType, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []EventType{
+		Restocked, Restocked, Restocked,
+		CoinInserted, ProductSelected, ProductDelivered, Aborted, Restocked, Restocked, PriceChanged, CoinInserted,
+	}, types)
+
+	replayed, err := Replay(events)
+	require.NoError(t, err)
+	assert.Equal(t, vm.Snapshot(), replayed.Snapshot())
+
+	// the machine right after the delivery, the events were stamped a minute
+	// apart from 09:01
+	before, err := Replay(Until(events, time.Date(2024, 5, 7, 9, 6, 0, 0, time.UTC)))
+	require.NoError(t, err)
+	snap := before.Snapshot()
+	assert.Equal(t, Idle, snap.State)
+	assert.Equal(t, 0, snap.InsertedAmount)
+	coke, _ := snap.Item("coke")
+	assert.Equal(t, Item{Name: "coke", Number: 0, Price: 100}, coke)
+	_, ok := snap.Item("tea")
+	assert.False(t, ok)
+}
+
+func TestRestoreHasNoEvents(t *testing.T) {
+	vm, err := New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, vm.InsertCoin(context.Background(), 100))
+
+	restored, err := Restore(vm.Snapshot())
+	require.NoError(t, err)
+	assert.Empty(t, restored.Events())
+
+	require.NoError(t, restored.SelectProduct(context.Background(), "coke"))
+	events := restored.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, ProductSelected, events[0].Type)
+	assert.Equal(t, "coke", events[0].Product)
+}
@@ -1,9 +1,12 @@
 package vendingmachine
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 type State string
@@ -33,6 +36,19 @@ type VendingMachine struct {
 
 	// product to properties map
 	prodmap map[string]*Item
+
+	// version is the version of the stored machine, the storages set it
+	version int64
+
+	// observeLock is called with the time each operation waited for the
+	// lock, nil disables the measurement. It is only set on creation, so it
+	// is read without the lock.
+	observeLock func(ctx context.Context, wait time.Duration)
+
+	// events are the events of the changes since the machine was created or
+	// restored, stamped with now, time.Now if nil
+	events []Event
+	now    func() time.Time
 }
 
 type Item struct {
@@ -41,8 +57,8 @@ type Item struct {
 	Price  int    `json:"price"`
 }
 
-// VMOption is used to initialize the VendingMachine instance with custom data
-// should be used for testing purposes only.
+// VMOption is used to initialize the VendingMachine instance with custom data,
+// e.g. for testing or to restore a stored machine.
 type VMOption interface {
 	apply(*VendingMachine)
 }
@@ -71,12 +87,42 @@ func WithSelectedProd(p string) VMOption {
 	})
 }
 
+// WithVersion sets the version of the stored machine.
+func WithVersion(v int64) VMOption {
+	return vmOption(func(vm *VendingMachine) {
+		vm.version = v
+	})
+}
+
+// WithClock sets the clock stamping the events of the machine.
+func WithClock(now func() time.Time) VMOption {
+	return vmOption(func(vm *VendingMachine) {
+		vm.now = now
+	})
+}
+
+// WithEvents sets the events of the changes not saved yet, e.g. to restore a
+// machine along with its events from a backup.
+func WithEvents(events []Event) VMOption {
+	return vmOption(func(vm *VendingMachine) {
+		vm.events = append([]Event(nil), events...)
+	})
+}
+
 func WithProdMap(m map[string]*Item) VMOption {
 	return vmOption(func(vm *VendingMachine) {
 		vm.prodmap = m
 	})
 }
 
+// WithLockObserver reports how long each operation waited for the machine's
+// lock, together with the context of the operation.
+func WithLockObserver(observe func(ctx context.Context, wait time.Duration)) VMOption {
+	return vmOption(func(vm *VendingMachine) {
+		vm.observeLock = observe
+	})
+}
+
 func New(inventory []Item, opts ...VMOption) (*VendingMachine, error) {
 	vm := &VendingMachine{
 		mu:             &sync.Mutex{},
@@ -85,12 +131,46 @@ func New(inventory []Item, opts ...VMOption) (*VendingMachine, error) {
 		prodmap:        make(map[string]*Item),
 	}
 
-	// initialize the inventory
+	// overwrite from the options
+	for _, o := range opts {
+		o.apply(vm)
+	}
+
+	// initialize the inventory, a new machine starts with its restocks
 	for _, item := range inventory {
-		vm.prodmap[item.Name] = &item
+		vm.record(Event{Type: Restocked, Product: item.Name, Number: item.Number, Price: item.Price})
 	}
 
-	// overwrite from the options
+	return vm, nil
+}
+
+// Restore rebuilds a machine from its snapshot, e.g. one read from a storage.
+func Restore(snap Snapshot, opts ...VMOption) (*VendingMachine, error) {
+	restored := []VMOption{WithState(snap.State), WithVersion(snap.Version)}
+
+	switch snap.State {
+	case Idle:
+		if snap.InsertedAmount != 0 {
+			restored = append(restored, WithInsertedAmount(snap.InsertedAmount))
+		}
+	case Selecting:
+		restored = append(restored, WithInsertedAmount(snap.InsertedAmount))
+	case Delivering:
+		if _, ok := snap.Item(snap.SelectedProduct); !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidProduct, snap.SelectedProduct)
+		}
+		restored = append(restored, WithInsertedAmount(snap.InsertedAmount), WithSelectedProd(snap.SelectedProduct))
+	default:
+		return nil, fmt.Errorf("%w: unknown state: %q", ErrBadState, snap.State)
+	}
+
+	vm, err := New(snap.Inventory, restored...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the restored machine has no changes yet
+	vm.events = nil
 	for _, o := range opts {
 		o.apply(vm)
 	}
@@ -98,22 +178,21 @@ func New(inventory []Item, opts ...VMOption) (*VendingMachine, error) {
 	return vm, nil
 }
 
-func (vm *VendingMachine) InsertCoin(amount int) error {
-	vm.mu.Lock()
+func (vm *VendingMachine) InsertCoin(ctx context.Context, amount int) error {
+	vm.lock(ctx)
 	defer vm.mu.Unlock()
 
 	if vm.state != Idle {
 		return fmt.Errorf("%w: cannot insert coin in state: %q", ErrBadState, vm.state)
 	}
 
-	vm.state = Selecting
-	vm.insertedAmount = &amount
+	vm.record(Event{Type: CoinInserted, Amount: amount})
 
 	return nil
 }
 
-func (vm *VendingMachine) SelectProduct(productStr string) error {
-	vm.mu.Lock()
+func (vm *VendingMachine) SelectProduct(ctx context.Context, productStr string) error {
+	vm.lock(ctx)
 	defer vm.mu.Unlock()
 
 	if vm.state != Selecting {
@@ -139,14 +218,13 @@ func (vm *VendingMachine) SelectProduct(productStr string) error {
 			prod.Name, prod.Price, *vm.insertedAmount)
 	}
 
-	vm.state = Delivering
-	vm.selectedProd = &productStr
+	vm.record(Event{Type: ProductSelected, Product: productStr})
 
 	return nil
 }
 
-func (vm *VendingMachine) DeliverProduct() error {
-	vm.mu.Lock()
+func (vm *VendingMachine) DeliverProduct(ctx context.Context) error {
+	vm.lock(ctx)
 	defer vm.mu.Unlock()
 
 	if vm.state != Delivering {
@@ -174,21 +252,119 @@ func (vm *VendingMachine) DeliverProduct() error {
 		return errors.New("not enough money")
 	}
 
-	// reset
-	vm.state = Idle
-	// reduce the number of product in the inventory
-	prod.Number--
-	*vm.insertedAmount -= prod.Price
-	vm.selectedProd = nil
+	// reset, reducing the number of product in the inventory
+	vm.record(Event{Type: ProductDelivered, Product: prod.Name, Price: prod.Price})
 
 	return nil
 }
 
-func (vm *VendingMachine) AbortAndReset() {
-	vm.mu.Lock()
+func (vm *VendingMachine) AbortAndReset(ctx context.Context) {
+	vm.lock(ctx)
+	defer vm.mu.Unlock()
+
+	vm.record(Event{Type: Aborted})
+}
+
+// Restock adds item.Number units of the item to the inventory. Products
+// that are not in the inventory yet are added with item.Price.
+func (vm *VendingMachine) Restock(ctx context.Context, item Item) error {
+	vm.lock(ctx)
 	defer vm.mu.Unlock()
 
-	vm.state = Idle
-	vm.insertedAmount = nil
-	vm.selectedProd = nil
+	if item.Number < 1 {
+		return fmt.Errorf("%w: restock number must be positive: %d", ErrInvalidItem, item.Number)
+	}
+
+	prod, ok := vm.prodmap[item.Name]
+	if !ok {
+		if item.Name == "" || item.Price < 1 {
+			return fmt.Errorf("%w: new product needs a name and a positive price", ErrInvalidItem)
+		}
+		vm.record(Event{Type: Restocked, Product: item.Name, Number: item.Number, Price: item.Price})
+		return nil
+	}
+
+	vm.record(Event{Type: Restocked, Product: prod.Name, Number: item.Number})
+
+	return nil
+}
+
+func (vm *VendingMachine) SetPrice(ctx context.Context, productStr string, price int) error {
+	vm.lock(ctx)
+	defer vm.mu.Unlock()
+
+	if price < 1 {
+		return fmt.Errorf("%w: price must be positive: %d", ErrInvalidItem, price)
+	}
+
+	prod, ok := vm.prodmap[productStr]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidProduct, productStr)
+	}
+
+	vm.record(Event{Type: PriceChanged, Product: prod.Name, Price: price})
+
+	return nil
+}
+
+// Snapshot is a point in time copy of the vending machine's state.
+type Snapshot struct {
+	State           State  `json:"state"`
+	InsertedAmount  int    `json:"inserted_amount"`
+	SelectedProduct string `json:"selected_product,omitempty"`
+	Inventory       []Item `json:"inventory"`
+	// Version is the version of the stored machine, it changes every time
+	// the machine is saved and is zero for a machine never stored
+	Version int64 `json:"version"`
+}
+
+// Item returns the inventory item with the given name.
+func (s Snapshot) Item(name string) (Item, bool) {
+	for _, item := range s.Inventory {
+		if item.Name == name {
+			return item, true
+		}
+	}
+
+	return Item{}, false
+}
+
+func (vm *VendingMachine) Snapshot() Snapshot {
+	vm.lock(context.Background())
+	defer vm.mu.Unlock()
+
+	s := Snapshot{
+		State:     vm.state,
+		Inventory: make([]Item, 0, len(vm.prodmap)),
+		Version:   vm.version,
+	}
+
+	if vm.insertedAmount != nil {
+		s.InsertedAmount = *vm.insertedAmount
+	}
+
+	if vm.selectedProd != nil {
+		s.SelectedProduct = *vm.selectedProd
+	}
+
+	for _, item := range vm.prodmap {
+		s.Inventory = append(s.Inventory, *item)
+	}
+
+	sort.Slice(s.Inventory, func(i, j int) bool {
+		return s.Inventory[i].Name < s.Inventory[j].Name
+	})
+
+	return s
+}
+
+func (vm *VendingMachine) lock(ctx context.Context) {
+	if vm.observeLock == nil {
+		vm.mu.Lock()
+		return
+	}
+
+	start := time.Now()
+	vm.mu.Lock()
+	vm.observeLock(ctx, time.Since(start))
 }
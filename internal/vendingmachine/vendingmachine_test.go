@@ -1,6 +1,7 @@
 package vendingmachine
 
 import (
+	"context"
 	"reflect"
 	"sync"
 	"testing"
@@ -23,16 +24,16 @@ func TestInsert(t *testing.T) {
 	require.NoError(t, err)
 
 	amount := 50
-	require.NoError(t, vm.InsertCoin(amount))
+	require.NoError(t, vm.InsertCoin(context.Background(), amount))
 	assert.Equal(t, Selecting, vm.state)
 	assert.Equal(t, amount, *vm.insertedAmount)
 	assert.Nil(t, vm.selectedProd)
 
 	// check can not insert in states other than idle
 	vm.state = Selecting
-	require.ErrorIs(t, vm.InsertCoin(amount), ErrBadState)
+	require.ErrorIs(t, vm.InsertCoin(context.Background(), amount), ErrBadState)
 	vm.state = Delivering
-	require.ErrorIs(t, vm.InsertCoin(amount), ErrBadState)
+	require.ErrorIs(t, vm.InsertCoin(context.Background(), amount), ErrBadState)
 }
 
 func TestSelectProduct(t *testing.T) {
@@ -46,7 +47,7 @@ func TestSelectProduct(t *testing.T) {
 	}
 
 	prod := "coffee"
-	require.NoError(t, vm.SelectProduct(prod))
+	require.NoError(t, vm.SelectProduct(context.Background(), prod))
 	assert.Equal(t, Delivering, vm.state)
 	assert.Equal(t, prod, *vm.selectedProd)
 	assert.Equal(t, amount, *vm.insertedAmount, "inserted amount should stay the same after selecting")
@@ -58,7 +59,7 @@ func TestSelectProduct(t *testing.T) {
 		selectedProd:   nil,
 		prodmap:        getDefaultProdMap(),
 	}
-	require.ErrorIs(t, vm.SelectProduct("invalid-product"), ErrInvalidProduct)
+	require.ErrorIs(t, vm.SelectProduct(context.Background(), "invalid-product"), ErrInvalidProduct)
 	assert.Equal(t, Selecting, vm.state)
 	assert.Nil(t, vm.selectedProd)
 	assert.Equal(t, amount, *vm.insertedAmount)
@@ -71,7 +72,7 @@ func TestSelectProduct(t *testing.T) {
 		selectedProd:   nil,
 		prodmap:        getDefaultProdMap(),
 	}
-	require.ErrorIs(t, vm.SelectProduct("milk"), ErrOutOfStock)
+	require.ErrorIs(t, vm.SelectProduct(context.Background(), "milk"), ErrOutOfStock)
 	assert.Equal(t, Selecting, vm.state)
 	assert.Nil(t, vm.selectedProd)
 	assert.Equal(t, amount, *vm.insertedAmount)
@@ -84,7 +85,7 @@ func TestSelectProduct(t *testing.T) {
 		selectedProd:   nil,
 		prodmap:        getDefaultProdMap(),
 	}
-	require.ErrorIs(t, vm.SelectProduct("coke"), ErrInsufficientFunds)
+	require.ErrorIs(t, vm.SelectProduct(context.Background(), "coke"), ErrInsufficientFunds)
 	assert.Equal(t, Selecting, vm.state)
 	assert.Nil(t, vm.selectedProd)
 	assert.Equal(t, amount, *vm.insertedAmount)
@@ -92,9 +93,9 @@ func TestSelectProduct(t *testing.T) {
 
 	// check can not select in states other than selecting
 	vm.state = Idle
-	require.ErrorIs(t, vm.SelectProduct("prod"), ErrBadState)
+	require.ErrorIs(t, vm.SelectProduct(context.Background(), "prod"), ErrBadState)
 	vm.state = Delivering
-	require.ErrorIs(t, vm.SelectProduct("prod"), ErrBadState)
+	require.ErrorIs(t, vm.SelectProduct(context.Background(), "prod"), ErrBadState)
 }
 
 func TestDeliverProduct(t *testing.T) {
@@ -108,7 +109,7 @@ func TestDeliverProduct(t *testing.T) {
 		prodmap:        getDefaultProdMap(),
 	}
 
-	require.NoError(t, vm.DeliverProduct())
+	require.NoError(t, vm.DeliverProduct(context.Background()))
 	assert.Equal(t, Idle, vm.state)
 	assert.Nil(t, vm.selectedProd)
 	assert.Equal(t, 20, *vm.insertedAmount)
@@ -116,9 +117,9 @@ func TestDeliverProduct(t *testing.T) {
 
 	// check can not deliver in states other than delivering
 	vm.state = Idle
-	require.ErrorIs(t, vm.DeliverProduct(), ErrBadState)
+	require.ErrorIs(t, vm.DeliverProduct(context.Background()), ErrBadState)
 	vm.state = Selecting
-	require.ErrorIs(t, vm.DeliverProduct(), ErrBadState)
+	require.ErrorIs(t, vm.DeliverProduct(context.Background()), ErrBadState)
 }
 
 func getDefaultItems() []Item {
@@ -162,3 +163,49 @@ func getDefaultProdMap() map[string]*Item {
 
 	return prodmap
 }
+
+func TestRestock(t *testing.T) {
+	vm, err := New(getDefaultItems())
+	require.NoError(t, err)
+
+	require.NoError(t, vm.Restock(context.Background(), Item{Name: "milk", Number: 3}))
+	assert.Equal(t, 3, vm.prodmap["milk"].Number)
+	assert.Equal(t, 80, vm.prodmap["milk"].Price, "restocking should not change the price")
+
+	require.NoError(t, vm.Restock(context.Background(), Item{Name: "tea", Number: 2, Price: 40}))
+	assert.Equal(t, &Item{Name: "tea", Number: 2, Price: 40}, vm.prodmap["tea"])
+
+	require.ErrorIs(t, vm.Restock(context.Background(), Item{Name: "coke", Number: 0}), ErrInvalidItem)
+	require.ErrorIs(t, vm.Restock(context.Background(), Item{Name: "juice", Number: 1}), ErrInvalidItem)
+}
+
+func TestSetPrice(t *testing.T) {
+	vm, err := New(getDefaultItems())
+	require.NoError(t, err)
+
+	require.NoError(t, vm.SetPrice(context.Background(), "coke", 120))
+	assert.Equal(t, 120, vm.prodmap["coke"].Price)
+
+	require.ErrorIs(t, vm.SetPrice(context.Background(), "invalid-product", 10), ErrInvalidProduct)
+	require.ErrorIs(t, vm.SetPrice(context.Background(), "coke", 0), ErrInvalidItem)
+}
+
+func TestRestore(t *testing.T) {
+	vm, err := New(getDefaultItems())
+	require.NoError(t, err)
+	require.NoError(t, vm.InsertCoin(context.Background(), 100))
+	require.NoError(t, vm.SelectProduct(context.Background(), "coke"))
+
+	restored, err := Restore(vm.Snapshot())
+	require.NoError(t, err)
+	assert.Equal(t, vm.Snapshot(), restored.Snapshot())
+
+	require.NoError(t, restored.DeliverProduct(context.Background()))
+	require.NoError(t, vm.DeliverProduct(context.Background()))
+	assert.Equal(t, vm.Snapshot(), restored.Snapshot())
+
+	_, err = Restore(Snapshot{State: "Broken"})
+	require.ErrorIs(t, err, ErrBadState)
+	_, err = Restore(Snapshot{State: Delivering, SelectedProduct: "gone"})
+	require.ErrorIs(t, err, ErrInvalidProduct)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength bounds the request ids accepted from the clients
+	maxRequestIDLength = 128
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+type LogConfig struct {
+	// Level is one of debug, info, warn or error
+	Level string
+	// Format is either json or text
+	Format    string
+	AddSource bool
+	// LevelVar, if set, is set to the level and used by the logger so that
+	// the level can be changed later
+	LevelVar *slog.LevelVar
+}
+
+// NewLogger returns a logger writing to w as configured.
+func NewLogger(w io.Writer, cfg LogConfig) (*slog.Logger, error) {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	levelVar := cfg.LevelVar
+	if levelVar == nil {
+		levelVar = &slog.LevelVar{}
+	}
+	levelVar.Set(level)
+
+	opts := &slog.HandlerOptions{
+		AddSource: cfg.AddSource,
+		Level:     levelVar,
+	}
+
+	switch cfg.Format {
+	case logFormatJSON, "":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected %q or %q", cfg.Format, logFormatJSON, logFormatText)
+	}
+}
+
+// parseLogLevel parses one of debug, info, warn or error, empty is info.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return level, nil
+	}
+
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("failed to parse log level: %w", err)
+	}
+
+	return level, nil
+}
+
+type loggerKey struct{}
+
+// requestLog is shared by the access log middleware and the routes, which
+// fill in the machine the request targets once it is known.
+type requestLog struct {
+	machineID string
+}
+
+type requestLogKey struct{}
+
+// loggerFromContext returns the request scoped logger, or the default
+// logger outside of a request.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+
+	return slog.Default()
+}
+
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggingMiddleware assigns each request an id, taken from the X-Request-ID
+// header if the client sent a valid one, injects a logger carrying it into
+// the request's context and writes one access log line per request.
+func LoggingMiddleware(logger *slog.Logger, rt *Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		_, route := rt.mux.Handler(r)
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteAddr = r.RemoteAddr
+		}
+
+		l := logger.With(
+			slog.String("request_id", requestID),
+			slog.String("route", route),
+			slog.String("remote_addr", remoteAddr),
+		)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			l = l.With(slog.String("trace_id", sc.TraceID().String()))
+		}
+
+		reqLog := &requestLog{}
+		ctx := withLogger(r.Context(), l)
+		ctx = context.WithValue(ctx, requestLogKey{}, reqLog)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if rec.statusCode() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.statusCode()),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if reqLog.machineID != "" {
+			attrs = append(attrs, slog.String("machine_id", reqLog.machineID))
+		}
+
+		l.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// MachineLogMiddleware adds the machine targeted by the request to the
+// request's logger, it runs after routing so that the path values are set.
+func MachineLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		machineID := machineIDFromContext(r.Context())
+		if machineID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reqLog, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+			reqLog.machineID = machineID
+		}
+
+		l := loggerFromContext(r.Context()).With(slog.String("machine_id", machineID))
+		next.ServeHTTP(w, r.WithContext(withLogger(r.Context(), l)))
+	})
+}
+
+// validRequestID accepts the ids made of printable ascii characters only,
+// so that clients can not inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r < '!' || r > '~'
+	})
+}
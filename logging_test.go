@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogConfig{Level: "info", Format: "json"})
+	require.NoError(t, err)
+
+	h := NewHandler(getVMStorageMock(t), getSMStorageMock(t))
+	rt := NewRouter()
+	rt.Use(MachineLogMiddleware)
+	registerRoutes(rt, h)
+	srv := LoggingMiddleware(logger, rt, rt.mux)
+
+	t.Run("propagates the request id", func(t *testing.T) {
+		buf.Reset()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/insert",
+			strings.NewReader(`{"machine_id":"123","inserted_amount":100}`))
+		r.Header.Set(requestIDHeader, "abc-123")
+		srv.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "abc-123", w.Header().Get(requestIDHeader))
+
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, "request", line["msg"])
+		assert.Equal(t, "abc-123", line["request_id"])
+		assert.Equal(t, "/insert", line["route"])
+		assert.Equal(t, "123", line["machine_id"])
+		assert.Equal(t, "192.0.2.1", line["remote_addr"])
+		assert.EqualValues(t, http.StatusOK, line["status"])
+		assert.Contains(t, line, "duration")
+	})
+
+	t.Run("replaces invalid request ids", func(t *testing.T) {
+		buf.Reset()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/machines/123", nil)
+		r.Header.Set(requestIDHeader, "bad id\n")
+		srv.ServeHTTP(w, r)
+
+		id := w.Header().Get(requestIDHeader)
+		assert.NotEqual(t, "bad id\n", id)
+		assert.True(t, validRequestID(id))
+		assert.Contains(t, buf.String(), `"machine_id":"123"`)
+	})
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := NewLogger(&buf, LogConfig{Level: "warn", Format: "text"})
+	require.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "msg=shown")
+
+	_, err = NewLogger(&buf, LogConfig{Level: "loud"})
+	require.Error(t, err)
+
+	_, err = NewLogger(&buf, LogConfig{Format: "xml"})
+	require.Error(t, err)
+}
@@ -5,25 +5,58 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"vendingmachine/internal/storage"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	grpccreds "google.golang.org/grpc/credentials"
+	"gopkg.in/yaml.v2"
+
+	"vendingmachine/internal/auth"
+	"vendingmachine/internal/certs"
+	"vendingmachine/internal/events"
+)
+
+const (
+	// defaultTLSReloadInterval is how often the tls files are checked for
+	// changes if the config does not say.
+	defaultTLSReloadInterval = 30 * time.Second
+
+	// configPollInterval is how often the config file is checked for changes.
+	configPollInterval = 5 * time.Second
+
+	defaultConfigPath = "./config.yaml"
+
+	// shutdownFlushTimeout bounds flushing the storage and the traces once
+	// the servers are stopped, the shutdown timeout may be over by then.
+	shutdownFlushTimeout = 5 * time.Second
 )
 
 func main() {
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-		Level:     slog.LevelError,
-	})))
+	// replaced by the configured logger once the config is loaded
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	// the subcommands have their own flags
+	if len(os.Args) > 1 && (os.Args[1] == cmdBackup || os.Args[1] == cmdRestore) {
+		if err := runCommand(context.Background(), os.Args[1], os.Args[2:]); err != nil {
+			slog.Error("failed to "+os.Args[1], slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	var yamlPath string
-	defaultYamlConfigPath := "./config.yaml"
-	flag.StringVar(&yamlPath, "configpath", defaultYamlConfigPath,
-		fmt.Sprintf("path to config yaml file, default: %s", defaultYamlConfigPath))
+	flag.StringVar(&yamlPath, "configpath", defaultConfigPath,
+		fmt.Sprintf("path to config yaml file, default: %s", defaultConfigPath))
+	checkConfig := flag.Bool("check-config", false,
+		"validate the config, print it merged with the env with the secrets redacted and exit")
 	flag.Parse()
 
 	cfg, err := loadConfig(yamlPath)
@@ -32,51 +65,304 @@ func main() {
 		os.Exit(1)
 	}
 
-	vmStorage := storage.NewInMemoryVMStorage()
-	smStorage := storage.NewInMemorySMStorage()
+	if *checkConfig {
+		if err := yaml.NewEncoder(os.Stdout).Encode(cfg.Redacted()); err != nil {
+			slog.Error("failed to print config", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	logLevel := &slog.LevelVar{}
+	logger, err := NewLogger(os.Stdout, LogConfig{
+		Level:     cfg.Log.Level,
+		Format:    cfg.Log.Format,
+		AddSource: cfg.Log.AddSource,
+		LevelVar:  logLevel,
+	})
+	if err != nil {
+		slog.Error("failed to set up logging", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	stores, err := openStorages(context.Background(), cfg)
+	if err != nil {
+		slog.Error("failed to open storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	broker := events.NewBroker(cfg.Events.BufferSize)
+
+	health := NewHealth()
+	// the in memory storages start empty and the databases are read on
+	// demand, there is nothing to recover
+	health.SetRecovered()
+
+	keys, err := newKeyStore(cfg)
+	if err != nil {
+		slog.Error("failed to load api keys", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	certIdentities, err := newCertIdentities(cfg)
+	if err != nil {
+		slog.Error("failed to load client certificates", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	tlsReloader, err := newTLSReloader(cfg)
+	if err != nil {
+		slog.Error("failed to set up tls", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	jwtManager, err := newJWTManager(cfg)
+	if err != nil {
+		slog.Error("failed to load jwt config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	var limiter *RateLimiter
+	if cfg.RateLimit.Enabled {
+		limiter = NewRateLimiter(rateLimitConfig(cfg))
+	}
+
+	var tracerProvider trace.TracerProvider = noop.NewTracerProvider()
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Enabled {
+		tracerProvider, shutdownTracing, err = NewTracerProvider(context.Background(), TracingConfig{
+			ServiceName:  cfg.Tracing.ServiceName,
+			Exporter:     cfg.Tracing.Exporter,
+			OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+			OTLPInsecure: cfg.Tracing.OTLPInsecure,
+			FilePath:     cfg.Tracing.FilePath,
+			SampleRatio:  *cfg.Tracing.SampleRatio,
+		})
+		if err != nil {
+			slog.Error("failed to set up tracing", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	metrics := NewMetrics()
+	if limiter != nil {
+		metrics.ObserveRateLimiter(limiter)
+	}
+
+	handler := NewHandler(stores.vm, stores.sm,
+		WithMetadataStorage(stores.metadata),
+		WithEventBroker(broker),
+		WithMetrics(metrics),
+		WithHealth(health),
+		WithTracerProvider(tracerProvider),
+		WithSessionConfig(sessionConfig(cfg)),
+		WithKeyStore(keys),
+		WithJWT(jwtManager, tokenConfig(cfg)),
+		WithRateLimiter(limiter),
+		WithFleetFile(cfg.Fleet.File),
+	)
 
-	handler := NewHandler(vmStorage, smStorage)
+	if cfg.Fleet.File != "" {
+		res, err := handler.ReconcileFleet(context.Background()) //nolint: govet // shadowing is not a problem here
+		if err != nil {
+			slog.Error("failed to load fleet", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		slog.Info("loaded fleet", slog.Int("created", len(res.Created)), slog.Int("changed", len(res.Changed)))
+		if len(res.Conflicts) > 0 {
+			slog.Warn("fleet machines conflict with machines created through the api",
+				slog.Any("machine_ids", res.Conflicts))
+		}
+	}
 
-	// routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/addvm", handler.AddVMHandler)
-	mux.HandleFunc("/insert", handler.InsertCoinHandler)
-	mux.HandleFunc("/select", handler.SelectProductHandler)
-	mux.HandleFunc("/abort", handler.AbortOrderHandler)
+	// the gauges of the machines are only updated by the operations otherwise
+	err = handler.ObserveMachines(context.Background())
+	if err != nil {
+		slog.Error("failed to observe machines", slog.String("error", err.Error()))
+	}
+
+	rt := NewRouter()
+	rt.Use(MachineLogMiddleware)
+	registerRoutes(rt, handler)
 
-	// statemachine routes
-	mux.HandleFunc("/sm/insert", handler.TransitionHandler)
-	mux.HandleFunc("/sm/select", handler.TransitionHandler)
+	var root http.Handler = rt.mux
+	var grpcOpts []grpc.ServerOption
+	var authenticator *Authenticator
+	if cfg.Auth.Enabled {
+		authenticator = NewAuthenticator(keys, jwtManager, certIdentities)
+		root = AuthMiddleware(authenticator, rt)
+		grpcOpts = append(grpcOpts, GRPCAuthOptions(authenticator)...)
+	}
+
+	if limiter != nil {
+		rt.Use(limiter.IdentityMiddleware)
+		rt.Use(limiter.MachineMiddleware)
+		// limit the client ips before authenticating so that guessing keys
+		// is limited too, and the callers once authenticated
+		root = limiter.ClientMiddleware(root)
+		grpcOpts = append(limiter.GRPCOptions(), grpcOpts...)
+		grpcOpts = append(grpcOpts, limiter.GRPCIdentityOptions()...)
+	}
+
+	// wrap everything else so that the rejected requests are counted too
+	root = metrics.Middleware(rt, root)
+	root = LoggingMiddleware(logger, rt, root)
+	root = TracingMiddleware(tracerProvider, rt, root)
 
 	// serve
 	srv := http.Server{
 		Addr:              fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Server.Port),
-		Handler:           mux,
+		Handler:           root,
 		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeoutSeconds) * time.Second,
 	}
 
 	serverCtx, cancel := context.WithCancelCause(context.Background())
 
+	if tlsReloader != nil {
+		srv.TLSConfig = tlsReloader.TLSConfig()
+		grpcOpts = append(grpcOpts, grpc.Creds(grpccreds.NewTLS(tlsReloader.TLSConfig())))
+
+		interval := time.Duration(cfg.Server.TLS.ReloadIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultTLSReloadInterval
+		}
+
+		go tlsReloader.Watch(serverCtx, interval, func(err error) {
+			if err != nil {
+				slog.Error("failed to reload tls certificates, keeping the current ones",
+					slog.String("error", err.Error()))
+				return
+			}
+			slog.Info("reloaded tls certificates")
+		})
+	}
+
+	configReloader := NewConfigReloader(yamlPath, cfg, reloadTargets{
+		logLevel:      logLevel,
+		keys:          keys,
+		authenticator: authenticator,
+		limiter:       limiter,
+		handler:       handler,
+	}.apply)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go configReloader.Watch(serverCtx, configPollInterval, hangups, func(res ReloadResult, err error) {
+		if err != nil {
+			slog.Error("failed to reload config, keeping the current one", slog.String("error", err.Error()))
+			return
+		}
+		slog.Info("reloaded config", slog.Any("result", res))
+		if len(res.RestartRequired) > 0 {
+			slog.Warn("config changes require a restart", slog.Any("fields", res.RestartRequired))
+		}
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// a second signal kills the process without waiting
+		signal.Stop(signals)
+		slog.Info("shutting down", slog.String("signal", sig.String()))
+		cancel(fmt.Errorf("received %s", sig))
+	}()
+
 	go func() {
-		log.Printf("listening on %s\n", srv.Addr)
-		err := srv.ListenAndServe() //nolint: govet // shadowing is not a problem here
+		slog.Info("listening", slog.String("addr", srv.Addr), slog.Bool("tls", srv.TLSConfig != nil))
+
+		var err error //nolint: govet // shadowing is not a problem here
+		if srv.TLSConfig != nil {
+			// the certificates are provided by the tls config
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			fmt.Fprintf(os.Stderr, "error listening and serving: %v\n", err)
+			slog.Error("failed to listen and serve", slog.String("error", err.Error()))
 		}
 
 		cancel(err)
 	}()
 
+	var grpcSrv *grpc.Server
+	if cfg.Server.GRPCPort != "" {
+		grpcSrv = NewGRPCServer(handler, grpcOpts...)
+		grpcAddr := fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Server.GRPCPort)
+
+		go func() {
+			lis, err := net.Listen("tcp", grpcAddr) //nolint: govet // shadowing is not a problem here
+			if err != nil {
+				slog.Error("failed to listen on grpc address", slog.String("error", err.Error()))
+				cancel(err)
+				return
+			}
+
+			slog.Info("grpc listening", slog.String("addr", grpcAddr))
+			if err := grpcSrv.Serve(lis); err != nil { //nolint: govet // shadowing is not a problem here
+				slog.Error("failed to serve grpc", slog.String("error", err.Error()))
+				cancel(err)
+			}
+		}()
+	}
+
 	doneCh := make(chan struct{})
 
 	// graceful shutdown
 	go func() {
 		<-serverCtx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(),
-			time.Duration(cfg.Server.ShutdownTimeoutSeconds)*time.Second)
+
+		// the timeouts may have been reloaded
+		current := configReloader.Current()
+
+		health.SetShuttingDown()
+		handler.StopPurchases()
+		// keep serving while the load balancer notices that we are not ready
+		time.Sleep(time.Duration(current.Server.ShutdownDrainSeconds) * time.Second)
+
+		// the purchases, the sessions and the servers share the shutdown
+		// timeout, the servers are stopped forcibly once it is over
+		shutdownTimeout := time.Duration(current.Server.ShutdownTimeoutSeconds) * time.Second
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
+
+		// the purchases in progress are given the time left to finish while
+		// the server still serves them, the rest are refunded
+		summary, err := handler.FinishPurchases(shutdownCtx) //nolint: govet // shadowing is not a problem here
+		if err != nil {
+			slog.Error("failed to finish purchases", slog.String("error", err.Error()))
+		}
+		slog.Info("purchases finished", slog.Any("summary", summary))
+
+		// the event streams and the websocket sessions never end on their own
+		broker.Close()
+		if err := handler.CloseSessions(shutdownCtx); err != nil { //nolint: govet // shadowing is not a problem here
+			slog.Error("failed to close sessions", slog.String("error", err.Error()))
+		}
+
 		if err := srv.Shutdown(shutdownCtx); err != nil { //nolint: govet // shadowing is not a problem here
-			fmt.Fprintf(os.Stderr, "error shutting down http server: %v\n", err)
+			slog.Error("failed to shut down http server", slog.String("error", err.Error()))
+			_ = srv.Close()
+		}
+
+		if grpcSrv != nil {
+			stopGRPC(shutdownCtx, grpcSrv)
+		}
+
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+		defer cancelFlush()
+
+		if err := handler.FlushStorage(flushCtx); err != nil { //nolint: govet // shadowing is not a problem here
+			slog.Error("failed to flush storage", slog.String("error", err.Error()))
+		}
+
+		if err := stores.close(); err != nil { //nolint: govet // shadowing is not a problem here
+			slog.Error("failed to close storage", slog.String("error", err.Error()))
+		}
+
+		if err := shutdownTracing(flushCtx); err != nil { //nolint: govet // shadowing is not a problem here
+			slog.Error("failed to flush traces", slog.String("error", err.Error()))
 		}
 
 		close(doneCh)
@@ -84,3 +370,126 @@ func main() {
 
 	<-doneCh
 }
+
+// stopGRPC lets the grpc calls in progress finish until the context is
+// done, then closes their connections.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Error("failed to stop grpc server gracefully", slog.String("error", ctx.Err().Error()))
+		srv.Stop()
+		<-stopped
+	}
+}
+
+func newKeyStore(cfg *Config) (*auth.KeyStore, error) {
+	ks, err := auth.NewKeyStore(configuredKeys(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key store: %w", err)
+	}
+
+	return ks, nil
+}
+
+func configuredKeys(cfg *Config) []auth.Key {
+	keys := make([]auth.Key, 0, len(cfg.Auth.APIKeys))
+	for _, k := range cfg.Auth.APIKeys {
+		keys = append(keys, auth.Key{Name: k.Name, Hash: k.Hash, Role: auth.Role(k.Role)})
+	}
+
+	return keys
+}
+
+func rateLimitConfig(cfg *Config) RateLimitConfig {
+	return RateLimitConfig{
+		ClientRate:        cfg.RateLimit.Client.RequestsPerSecond,
+		ClientBurst:       cfg.RateLimit.Client.Burst,
+		MachineRate:       cfg.RateLimit.Machine.RequestsPerSecond,
+		MachineBurst:      cfg.RateLimit.Machine.Burst,
+		TrustForwardedFor: cfg.RateLimit.TrustForwardedFor,
+		ExemptPaths:       []string{"/healthz", "/readyz"},
+	}
+}
+
+func sessionConfig(cfg *Config) SessionConfig {
+	return SessionConfig{
+		AllowedOrigins: cfg.Session.AllowedOrigins,
+		IdleTimeout:    time.Duration(cfg.Session.IdleTimeoutSeconds) * time.Second,
+	}
+}
+
+func tokenConfig(cfg *Config) TokenConfig {
+	return TokenConfig{
+		DefaultTTL: time.Duration(cfg.Auth.JWT.TokenTTLSeconds) * time.Second,
+		MaxTTL:     time.Duration(cfg.Auth.JWT.MaxTokenTTLSeconds) * time.Second,
+	}
+}
+
+// newJWTManager returns nil if neither an HS256 secret nor a jwks file is configured.
+func newJWTManager(cfg *Config) (*auth.JWTManager, error) {
+	if cfg.Auth.JWT.HS256Secret == "" && cfg.Auth.JWT.JWKSFile == "" {
+		return nil, nil //nolint: nilnil // bearer tokens are disabled
+	}
+
+	m, err := auth.NewJWTManager(auth.JWTConfig{
+		HS256Secret: []byte(cfg.Auth.JWT.HS256Secret),
+		JWKSFile:    cfg.Auth.JWT.JWKSFile,
+		Issuer:      cfg.Auth.JWT.Issuer,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jwt manager: %w", err)
+	}
+
+	return m, nil
+}
+
+// newCertIdentities maps the common names of the client certificates to identities.
+func newCertIdentities(cfg *Config) (map[string]auth.Identity, error) {
+	ids := make(map[string]auth.Identity, len(cfg.Auth.ClientCerts))
+	for _, c := range cfg.Auth.ClientCerts {
+		role := auth.Role(c.Role)
+		if c.CommonName == "" || !role.Valid() {
+			return nil, fmt.Errorf("client certificate %q needs a common name and a valid role", c.CommonName)
+		}
+
+		if _, ok := ids[c.CommonName]; ok {
+			return nil, fmt.Errorf("duplicate client certificate %q", c.CommonName)
+		}
+
+		ids[c.CommonName] = auth.Identity{Name: c.CommonName, Role: role, MachineID: c.MachineID}
+	}
+
+	return ids, nil
+}
+
+// newTLSReloader returns nil if tls is disabled.
+func newTLSReloader(cfg *Config) (*certs.Reloader, error) {
+	if !cfg.Server.TLS.Enabled {
+		return nil, nil //nolint: nilnil // tls is disabled
+	}
+
+	minVersion, err := certs.ParseVersion(cfg.Server.TLS.MinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse min tls version: %w", err)
+	}
+
+	r, err := certs.NewReloader(certs.Config{
+		CertFile:          cfg.Server.TLS.CertFile,
+		KeyFile:           cfg.Server.TLS.KeyFile,
+		ClientCAFile:      cfg.Server.TLS.ClientCAFile,
+		RequireClientCert: cfg.Server.TLS.RequireClientCert,
+		MinVersion:        minVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificates: %w", err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vendingmachine/internal/metrics"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// unmatchedRoute labels the requests that did not match any route, so that
+// scanning random paths does not create a series per path.
+const unmatchedRoute = "unmatched"
+
+// Metrics are the server metrics exposed in the Prometheus text format.
+type Metrics struct {
+	registry *metrics.Registry
+
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+
+	sales     *metrics.CounterVec
+	revenue   *metrics.CounterVec
+	state     *metrics.GaugeVec
+	stock     *metrics.GaugeVec
+	conflicts *metrics.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		registry: r,
+		requests: r.Counter("vendingmachine_http_requests_total",
+			"Number of http requests by route and status.", "route", "status"),
+		latency: r.Histogram("vendingmachine_http_request_duration_seconds",
+			"Latency of the http requests by route and status.", metrics.DefaultBuckets(), "route", "status"),
+		sales: r.Counter("vendingmachine_sales_total",
+			"Number of products delivered by machine and product.", "machine", "product"),
+		revenue: r.Counter("vendingmachine_revenue_total",
+			"Sum of the prices of the products delivered by machine and product.", "machine", "product"),
+		state: r.Gauge("vendingmachine_machine_state",
+			"Current state of each machine by kind, 1 for the state the machine is in and 0 otherwise.",
+			"machine", "kind", "state"),
+		stock: r.Gauge("vendingmachine_stock",
+			"Number of items left by machine, kind of machine and product.", "machine", "kind", "product"),
+		conflicts: r.Counter("vendingmachine_version_conflicts_total",
+			"Number of changes applied again because the machine was saved in between by kind of machine.", "kind"),
+	}
+}
+
+// Middleware counts the requests and measures their latency, the route is
+// the pattern of the route the request matched.
+func (m *Metrics) Middleware(rt *Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := rt.mux.Handler(r)
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := strconv.Itoa(rec.statusCode())
+		m.requests.Inc(route, status)
+		m.latency.Observe(time.Since(start).Seconds(), route, status)
+	})
+}
+
+// ObserveRateLimiter exposes the counters of the rate limiter.
+func (m *Metrics) ObserveRateLimiter(rl *RateLimiter) {
+	requests := m.registry.Counter("vendingmachine_rate_limit_requests_total",
+		"Number of requests checked by the rate limiters by limiter and result.", "limiter", "result")
+	keys := m.registry.Gauge("vendingmachine_rate_limit_keys",
+		"Number of clients, callers or machines currently being limited by limiter.", "limiter")
+
+	m.registry.OnCollect(func() {
+		stats := rl.Stats()
+		requests.Set(float64(stats.Client.Allowed), "client", "allowed")
+		requests.Set(float64(stats.Client.Rejected), "client", "rejected")
+		requests.Set(float64(stats.Identity.Allowed), "identity", "allowed")
+		requests.Set(float64(stats.Identity.Rejected), "identity", "rejected")
+		requests.Set(float64(stats.Machine.Allowed), "machine", "allowed")
+		requests.Set(float64(stats.Machine.Rejected), "machine", "rejected")
+		keys.Set(float64(stats.Client.Keys), "client")
+		keys.Set(float64(stats.Identity.Keys), "identity")
+		keys.Set(float64(stats.Machine.Keys), "machine")
+	})
+}
+
+// observeMachine updates the state and stock of the machine, the kind
+// tells the vending machine and its state machine twin apart.
+func (m *Metrics) observeMachine(id, kind string, snap internalVM.Snapshot) {
+	for _, state := range []internalVM.State{internalVM.Idle, internalVM.Selecting, internalVM.Delivering} {
+		var value float64
+		if snap.State == state {
+			value = 1
+		}
+		m.state.Set(value, id, kind, string(state))
+	}
+
+	for _, item := range snap.Inventory {
+		m.stock.Set(float64(item.Number), id, kind, item.Name)
+	}
+}
+
+// ObserveMachines sets the state and stock of the stored machines, e.g. on
+// startup, the operations keep them up to date afterwards.
+func (s *Handler) ObserveMachines(ctx context.Context) error {
+	refs, err := s.machineRefs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		snap, err := s.snapshotOf(ctx, ref)
+		if isNotFound(err) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get machine %q: %w", ref.id, err)
+		}
+
+		s.metrics.observeMachine(ref.id, ref.kind, snap)
+	}
+
+	return nil
+}
+
+func (m *Metrics) observeSale(id string, item internalVM.Item) {
+	m.sales.Inc(id, item.Name)
+	m.revenue.Add(float64(item.Price), id, item.Name)
+}
+
+// forgetMachine removes the series of a deleted machine.
+func (m *Metrics) forgetMachine(id string) {
+	m.state.DeleteMatching("machine", id)
+	m.stock.DeleteMatching("machine", id)
+	m.sales.DeleteMatching("machine", id)
+	m.revenue.DeleteMatching("machine", id)
+}
+
+func (m *Metrics) observeConflict(kind string) {
+	m.conflicts.Inc(kind)
+}
+
+func (s *Handler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	s.metrics.registry.Handler().ServeHTTP(w, r)
+}
+
+// statusRecorder records the status code of the response. It keeps the
+// flushing and hijacking of the wrapped writer working for the event
+// streams and the websocket sessions.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	// a hijacked connection switched protocols
+	rec.status = http.StatusSwitchingProtocols
+
+	return h.Hijack()
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// statusCode is 200 if the handler did not write anything.
+func (rec *statusRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
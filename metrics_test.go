@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), WithMetrics(m))
+	rt := NewRouter()
+	registerRoutes(rt, h)
+	srv := m.Middleware(rt, rt.mux)
+
+	inventory := []internalVM.Item{{Name: "coke", Number: 2, Price: 100}}
+	res, err := h.addVM(context.Background(), "", fleet.Metadata{}, inventory)
+	require.NoError(t, err)
+
+	for _, req := range []struct{ path, body string }{
+		{"/insert", `{"machine_id":"` + res.VMID + `","inserted_amount":150}`},
+		{"/select", `{"machine_id":"` + res.VMID + `","selected_product":"coke"}`},
+	} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	assert.Contains(t, body, `vendingmachine_http_requests_total{route="/insert",status="200"} 1`)
+	assert.Contains(t, body, `vendingmachine_http_request_duration_seconds_count{route="/select",status="200"} 1`)
+	assert.Contains(t, body, `vendingmachine_sales_total{machine="`+res.VMID+`",product="coke"} 1`)
+	assert.Contains(t, body, `vendingmachine_revenue_total{machine="`+res.VMID+`",product="coke"} 100`)
+	assert.Contains(t, body, `vendingmachine_machine_state{machine="`+res.VMID+`",kind="vm",state="Idle"} 1`)
+	assert.Contains(t, body, `vendingmachine_stock{machine="`+res.VMID+`",kind="vm",product="coke"} 1`)
+	assert.Contains(t, body, `vendingmachine_stock{machine="`+res.VMID+`",kind="sm",product="coke"} 2`)
+}
+
+func TestObserveMachines(t *testing.T) {
+	vmStorage := storage.NewInMemoryVMStorage()
+	smStorage := storage.NewInMemorySMStorage()
+	h := NewHandler(vmStorage, smStorage)
+	inventory := []internalVM.Item{{Name: "coke", Number: 2, Price: 100}}
+	res, err := h.addVM(context.Background(), "", fleet.Metadata{}, inventory)
+	require.NoError(t, err)
+
+	// a restarted server reads the machines from the storage
+	m := NewMetrics()
+	h = NewHandler(vmStorage, smStorage, WithMetrics(m))
+	require.NoError(t, h.ObserveMachines(context.Background()))
+
+	w := httptest.NewRecorder()
+	h.MetricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `vendingmachine_machine_state{machine="`+res.VMID+`",kind="vm",state="Idle"} 1`)
+	assert.Contains(t, body, `vendingmachine_machine_state{machine="`+res.VMID+`",kind="sm",state="Idle"} 1`)
+	assert.Contains(t, body, `vendingmachine_stock{machine="`+res.VMID+`",kind="sm",product="coke"} 2`)
+}
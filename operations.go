@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"vendingmachine/internal/events"
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// The operations below are shared by the http and grpc transports, they
+// return the domain and storage sentinel errors which each transport maps
+// to its own status codes.
+
+var (
+	errNoAmount  = errors.New("inserted amount must be positive")
+	errNoProduct = errors.New("no product was selected")
+	// errVersionMismatch is returned when the machine is not at the version
+	// the client expects, e.g. from If-Match
+	errVersionMismatch = errors.New("machine is not at the expected version")
+	// errNoHistory is returned when a machine is rebuilt at a time before it
+	// was created
+	errNoHistory = errors.New("machine has no events before the time")
+)
+
+// maxChangeAttempts bounds how many times a change is applied to a machine
+// that the other requests keep saving in between.
+const maxChangeAttempts = 5
+
+// addVM creates a machine that is not managed by the fleet file.
+func (s *Handler) addVM(ctx context.Context, id string, md fleet.Metadata, inventory []internalVM.Item,
+) (AddVMResponse, error) {
+	if id == "" {
+		id = uuid.New().String()
+	} else if !fleet.ValidID(id) {
+		return AddVMResponse{}, fleet.ErrInvalidID
+	}
+
+	var v ValidationError
+	validateMetadata(&v, "metadata", md)
+	validateItems(&v, "inventory", inventory, false)
+	if len(v.Fields) > 0 {
+		return AddVMResponse{}, &v
+	}
+
+	md.Managed = false
+	if err := s.createMachine(ctx, id, md, inventory); err != nil {
+		return AddVMResponse{}, err
+	}
+
+	return AddVMResponse{VMID: id, SMID: id}, nil
+}
+
+// createMachine creates a vending machine and a state machine sharing the id
+// and their metadata.
+func (s *Handler) createMachine(ctx context.Context, id string, md fleet.Metadata, inventory []internalVM.Item,
+) error {
+	vm, err := internalVM.New(inventory)
+	if err != nil {
+		return fmt.Errorf("failed to create vending machine: %w", err)
+	}
+
+	sm, err := statemachine.New(inventory)
+	if err != nil {
+		return fmt.Errorf("failed to create state machine: %w", err)
+	}
+
+	if err := s.createVM(ctx, id, vm); err != nil {
+		return fmt.Errorf("failed to save vending machine: %w", err)
+	}
+
+	if err := s.createSM(ctx, id, sm); err != nil {
+		// do not leave half a machine behind
+		if deleteErr := s.deleteVM(ctx, id); deleteErr != nil {
+			err = errors.Join(err, deleteErr)
+		}
+		return fmt.Errorf("failed to save state machine: %w", err)
+	}
+
+	if err := s.setMetadata(ctx, id, md); err != nil {
+		err = errors.Join(err, s.deleteVM(ctx, id), s.deleteSM(ctx, id))
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	s.observeMachines(id, vm, sm)
+
+	return nil
+}
+
+func (s *Handler) insertCoin(ctx context.Context, id string, amount int) (internalVM.Snapshot, error) {
+	if amount <= 0 {
+		return internalVM.Snapshot{}, errNoAmount
+	}
+
+	if err := s.checkSession(ctx, id); err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	if s.draining.Load() {
+		return internalVM.Snapshot{}, errShuttingDown
+	}
+
+	before, after, err := s.changeVM(ctx, id, "vendingmachine.InsertCoin",
+		func(ctx context.Context, vm *internalVM.VendingMachine) error { return vm.InsertCoin(ctx, amount) })
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	s.publishTransition(id, kindVM, before, after)
+	s.metrics.observeMachine(id, kindVM, after)
+
+	return after, nil
+}
+
+// selectProduct selects and delivers the product. Both steps are saved in
+// a single update, a failure must not leave the machine delivering with
+// the customer's credit.
+func (s *Handler) selectProduct(ctx context.Context, id, product string) (internalVM.Snapshot, error) {
+	if product == "" {
+		return internalVM.Snapshot{}, errNoProduct
+	}
+
+	if err := s.checkSession(ctx, id); err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	var selected internalVM.Snapshot
+	before, after, err := s.changeVM(ctx, id, "vendingmachine.Purchase",
+		func(ctx context.Context, vm *internalVM.VendingMachine) error {
+			_, snap, err := s.traceChange(ctx, id, "vendingmachine.SelectProduct", vm,
+				func(ctx context.Context) error { return vm.SelectProduct(ctx, product) }, attrProduct(product))
+			if err != nil {
+				return err
+			}
+			selected = snap
+
+			_, _, err = s.traceChange(ctx, id, "vendingmachine.DeliverProduct", vm, vm.DeliverProduct,
+				attrProduct(product))
+
+			return err
+		},
+		attrProduct(product))
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	s.publishTransition(id, kindVM, before, selected)
+	s.publishTransition(id, kindVM, selected, after)
+	s.metrics.observeMachine(id, kindVM, after)
+
+	return after, nil
+}
+
+// abortOrder aborts the purchase and returns the credit refunded.
+func (s *Handler) abortOrder(ctx context.Context, id string) (internalVM.Snapshot, int, error) {
+	if err := s.checkSession(ctx, id); err != nil {
+		return internalVM.Snapshot{}, 0, err
+	}
+
+	before, after, err := s.changeVM(ctx, id, "vendingmachine.AbortAndReset", abortAndReset)
+	if err != nil {
+		return internalVM.Snapshot{}, 0, err
+	}
+
+	s.events.Publish(id, events.Aborted, events.Data{Kind: kindVM, State: string(internalVM.Idle)})
+	s.metrics.observeMachine(id, kindVM, after)
+
+	return after, before.InsertedAmount, nil
+}
+
+func (s *Handler) transition(ctx context.Context, id string, data statemachine.Data) (internalVM.Snapshot, error) {
+	var v ValidationError
+	TransitionRequest{ID: id, Data: data}.validate(&v)
+	if len(v.Fields) > 0 {
+		return internalVM.Snapshot{}, &v
+	}
+
+	before, after, err := s.changeSM(ctx, id, "statemachine.Transit",
+		func(ctx context.Context, sm *statemachine.Machine) error {
+			// a transition from idle starts a new purchase
+			if sm.Snapshot().State == internalVM.Idle && s.draining.Load() {
+				return errShuttingDown
+			}
+
+			return sm.Transit(ctx, data)
+		})
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	s.publishTransition(id, kindSM, before, after)
+	s.metrics.observeMachine(id, kindSM, after)
+
+	return after, nil
+}
+
+const (
+	kindVM = "vm"
+	kindSM = "sm"
+)
+
+// machine is implemented by both the vending machine and the state machine.
+type machine interface {
+	AbortAndReset(ctx context.Context)
+	Restock(ctx context.Context, item internalVM.Item) error
+	SetPrice(ctx context.Context, product string, price int) error
+	Snapshot() internalVM.Snapshot
+}
+
+func abortAndReset[M machine](ctx context.Context, m M) error {
+	m.AbortAndReset(ctx)
+	return nil
+}
+
+// machineRef tells apart the vending machine and the state machine sharing an id.
+type machineRef struct {
+	id   string
+	kind string
+}
+
+func machineKind(m machine) string {
+	if _, ok := m.(*statemachine.Machine); ok {
+		return kindSM
+	}
+
+	return kindVM
+}
+
+// vmChanger is implemented by the storages applying a change in the
+// transaction reading the machine, e.g. Postgres holding the lock of the
+// machine's row, so that the replicas changing a machine do not conflict.
+type vmChanger interface {
+	ChangeVM(ctx context.Context, id string, change func(vm *internalVM.VendingMachine) error) error
+}
+
+// smChanger is vmChanger for the state machines.
+type smChanger interface {
+	ChangeSM(ctx context.Context, id string, change func(sm *statemachine.Machine) error) error
+}
+
+// changeVM reads the vending machine, applies change and saves it. If the
+// machine was saved by another request in between, it is read again and the
+// change applied again. The change is traced as a span with the given name,
+// the snapshots are taken before and after the change.
+func (s *Handler) changeVM(ctx context.Context, id, name string,
+	change func(ctx context.Context, vm *internalVM.VendingMachine) error, attrs ...attribute.KeyValue,
+) (internalVM.Snapshot, internalVM.Snapshot, error) {
+	return s.retryConflicts(kindVM, func() (internalVM.Snapshot, internalVM.Snapshot, error) {
+		if c, ok := s.vmStorage.(vmChanger); ok {
+			var before, after internalVM.Snapshot
+			err := s.changeStoredVM(ctx, c, id, func(ctx context.Context, vm *internalVM.VendingMachine) error {
+				var err error
+				before, after, err = s.traceChange(ctx, id, name, vm, func(ctx context.Context) error {
+					return change(ctx, vm)
+				}, attrs...)
+
+				return err
+			})
+			if err != nil {
+				return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+			}
+
+			after.Version++
+
+			return before, after, nil
+		}
+
+		vm, err := s.getVM(ctx, id)
+		if err != nil {
+			return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+		}
+
+		before, after, err := s.traceChange(ctx, id, name, vm, func(ctx context.Context) error {
+			return change(ctx, vm)
+		}, attrs...)
+		if err != nil {
+			return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+		}
+
+		if err := s.updateVM(ctx, id, vm); err != nil {
+			return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+		}
+
+		// the storage saved the next version
+		after.Version++
+
+		return before, after, nil
+	})
+}
+
+// changeSM is changeVM for the state machine.
+func (s *Handler) changeSM(ctx context.Context, id, name string,
+	change func(ctx context.Context, sm *statemachine.Machine) error, attrs ...attribute.KeyValue,
+) (internalVM.Snapshot, internalVM.Snapshot, error) {
+	return s.retryConflicts(kindSM, func() (internalVM.Snapshot, internalVM.Snapshot, error) {
+		if c, ok := s.smStorage.(smChanger); ok {
+			var before, after internalVM.Snapshot
+			err := s.changeStoredSM(ctx, c, id, func(ctx context.Context, sm *statemachine.Machine) error {
+				var err error
+				before, after, err = s.traceChange(ctx, id, name, sm, func(ctx context.Context) error {
+					return change(ctx, sm)
+				}, attrs...)
+
+				return err
+			})
+			if err != nil {
+				return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+			}
+
+			after.Version++
+
+			return before, after, nil
+		}
+
+		sm, err := s.getSM(ctx, id)
+		if err != nil {
+			return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+		}
+
+		before, after, err := s.traceChange(ctx, id, name, sm, func(ctx context.Context) error {
+			return change(ctx, sm)
+		}, attrs...)
+		if err != nil {
+			return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+		}
+
+		if err := s.updateSM(ctx, id, sm); err != nil {
+			return internalVM.Snapshot{}, internalVM.Snapshot{}, err
+		}
+
+		after.Version++
+
+		return before, after, nil
+	})
+}
+
+// retryConflicts calls attempt until it does not fail with a version
+// conflict, at most maxChangeAttempts times. The conflicts are counted, they
+// are how concurrent requests on a machine contend.
+func (s *Handler) retryConflicts(kind string, attempt func() (internalVM.Snapshot, internalVM.Snapshot, error),
+) (internalVM.Snapshot, internalVM.Snapshot, error) {
+	var (
+		before, after internalVM.Snapshot
+		err           error
+	)
+	for range maxChangeAttempts {
+		before, after, err = attempt()
+		if !errors.Is(err, storage.ErrVersionConflict) {
+			break
+		}
+		s.metrics.observeConflict(kind)
+	}
+
+	return before, after, err
+}
+
+func (s *Handler) traceChange(ctx context.Context, id, name string, m machine, change func(ctx context.Context) error,
+	attrs ...attribute.KeyValue,
+) (internalVM.Snapshot, internalVM.Snapshot, error) {
+	before := m.Snapshot()
+	ctx, span := s.startDomainSpan(ctx, name, id, before, attrs...)
+	err := change(ctx)
+	after := m.Snapshot()
+	endDomainSpan(span, after, err)
+
+	return before, after, err
+}
+
+// changeMachine is changeVM or changeSM depending on the kind of the machine.
+func (s *Handler) changeMachine(ctx context.Context, ref machineRef, name string,
+	change func(ctx context.Context, m machine) error, attrs ...attribute.KeyValue,
+) (internalVM.Snapshot, internalVM.Snapshot, error) {
+	if ref.kind == kindSM {
+		return s.changeSM(ctx, ref.id, name,
+			func(ctx context.Context, sm *statemachine.Machine) error { return change(ctx, sm) }, attrs...)
+	}
+
+	return s.changeVM(ctx, ref.id, name,
+		func(ctx context.Context, vm *internalVM.VendingMachine) error { return change(ctx, vm) }, attrs...)
+}
+
+// changeMachines applies change to the vending machine and its state machine
+// twin, each in its own storage update, and observes them. The returned
+// snapshot is the vending machine's or, without one, the state machine's.
+// A non zero version is the version the returned machine must be at before
+// the change, otherwise nothing is changed.
+func (s *Handler) changeMachines(ctx context.Context, id, name string, version int64,
+	change func(ctx context.Context, m machine) error, attrs ...attribute.KeyValue,
+) (internalVM.Snapshot, error) {
+	var snaps []internalVM.Snapshot
+
+	for _, ref := range []machineRef{{id: id, kind: kindVM}, {id: id, kind: kindSM}} {
+		apply := change
+		if version != 0 && len(snaps) == 0 {
+			apply = func(ctx context.Context, m machine) error {
+				if m.Snapshot().Version != version {
+					return errVersionMismatch
+				}
+
+				return change(ctx, m)
+			}
+		}
+
+		_, after, err := s.changeMachine(ctx, ref, name, apply, attrs...)
+		if isNotFound(err) && (ref.kind == kindVM || len(snaps) > 0) {
+			continue
+		} else if err != nil {
+			return internalVM.Snapshot{}, err
+		}
+
+		s.metrics.observeMachine(id, ref.kind, after)
+		snaps = append(snaps, after)
+	}
+
+	return snaps[0], nil
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, storage.ErrVMNotFound) || errors.Is(err, storage.ErrSMNotFound)
+}
+
+// findMachine returns the vending machine or, failing that, the state
+// machine with the given id.
+func (s *Handler) findMachine(ctx context.Context, id string) (machine, error) {
+	machines, err := s.findMachines(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return machines[0], nil
+}
+
+// findMachines returns the vending machine and the state machine sharing
+// the id, the vending machine first. The machines are only read, the
+// changes must go through changeMachines.
+func (s *Handler) findMachines(ctx context.Context, id string) ([]machine, error) {
+	var machines []machine
+
+	vm, err := s.getVM(ctx, id)
+	if err == nil {
+		machines = append(machines, vm)
+	} else if !errors.Is(err, storage.ErrVMNotFound) {
+		return nil, err
+	}
+
+	sm, err := s.getSM(ctx, id)
+	if err == nil {
+		machines = append(machines, sm)
+	} else if !errors.Is(err, storage.ErrSMNotFound) {
+		return nil, err
+	}
+
+	// the id names no machine, whichever twin is missing
+	if len(machines) == 0 {
+		return nil, storage.ErrVMNotFound
+	}
+
+	return machines, nil
+}
+
+func (s *Handler) observeMachines(id string, machines ...machine) {
+	for _, m := range machines {
+		s.metrics.observeMachine(id, machineKind(m), m.Snapshot())
+	}
+}
+
+func (s *Handler) machineState(ctx context.Context, id string) (internalVM.Snapshot, error) {
+	m, err := s.findMachine(ctx, id)
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	return m.Snapshot(), nil
+}
+
+// machineHistory returns the events of the vending machine between from and
+// to, a zero time leaves that end open.
+func (s *Handler) machineHistory(ctx context.Context, id string, from, to time.Time) ([]internalVM.Event, error) {
+	history, err := s.vmEvents(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	between := make([]internalVM.Event, 0, len(history))
+	for _, e := range history {
+		if (from.IsZero() || !e.At.Before(from)) && (to.IsZero() || !e.At.After(to)) {
+			between = append(between, e)
+		}
+	}
+
+	return between, nil
+}
+
+// machineAt rebuilds the vending machine from the events up to t.
+func (s *Handler) machineAt(ctx context.Context, id string, t time.Time) (internalVM.Snapshot, error) {
+	history, err := s.vmEvents(ctx, id)
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	until := internalVM.Until(history, t)
+	if len(until) == 0 {
+		return internalVM.Snapshot{}, fmt.Errorf("%w: %s", errNoHistory, t.Format(time.RFC3339))
+	}
+
+	vm, err := internalVM.Replay(until)
+	if err != nil {
+		return internalVM.Snapshot{}, fmt.Errorf("failed to replay events: %w", err)
+	}
+
+	return vm.Snapshot(), nil
+}
+
+// restock and reprice apply to both the vending machine and its state
+// machine twin, the returned snapshot is the vending machine's. A non zero
+// version must be the version of the vending machine.
+func (s *Handler) restock(ctx context.Context, id string, items []internalVM.Item, version int64,
+) (internalVM.Snapshot, error) {
+	after, err := s.changeMachines(ctx, id, "machine.Restock", version, func(ctx context.Context, m machine) error {
+		for _, item := range items {
+			if err := m.Restock(ctx, item); err != nil {
+				return fmt.Errorf("failed to restock %q: %w", item.Name, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	for _, item := range items {
+		stocked, _ := after.Item(item.Name)
+		s.events.Publish(id, events.StockChanged, events.Data{
+			Product: stocked.Name,
+			Price:   stocked.Price,
+			Stock:   &stocked.Number,
+		})
+	}
+
+	return after, nil
+}
+
+func (s *Handler) reprice(ctx context.Context, id, product string, price int, version int64,
+) (internalVM.Snapshot, error) {
+	after, err := s.changeMachines(ctx, id, "machine.SetPrice", version,
+		func(ctx context.Context, m machine) error { return m.SetPrice(ctx, product, price) }, attrProduct(product))
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	s.events.Publish(id, events.PriceChanged, events.Data{Product: product, Price: price})
+
+	return after, nil
+}
+
+// deleteMachine deletes both the vending machine and its state machine twin.
+func (s *Handler) deleteMachine(ctx context.Context, id string) error {
+	machines, err := s.findMachines(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range machines {
+		if machineKind(m) == kindVM {
+			err = s.deleteVM(ctx, id)
+		} else {
+			err = s.deleteSM(ctx, id)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.deleteMetadata(ctx, id); err != nil {
+		return err
+	}
+
+	s.metrics.forgetMachine(id)
+	s.events.Forget(id)
+
+	return nil
+}
+
+// machineMetadata returns the metadata of the machine, a machine without
+// metadata has the zero metadata.
+func (s *Handler) machineMetadata(ctx context.Context, id string) (fleet.Metadata, error) {
+	if _, err := s.findMachine(ctx, id); err != nil {
+		return fleet.Metadata{}, err
+	}
+
+	md, err := s.getMetadata(ctx, id)
+	if err != nil && !errors.Is(err, storage.ErrMetadataNotFound) {
+		return fleet.Metadata{}, err
+	}
+
+	return md, nil
+}
+
+// updateMetadata replaces the metadata of the machine, whether it is
+// managed by the fleet file is kept.
+func (s *Handler) updateMetadata(ctx context.Context, id string, md fleet.Metadata) (fleet.Metadata, error) {
+	current, err := s.machineMetadata(ctx, id)
+	if err != nil {
+		return fleet.Metadata{}, err
+	}
+
+	md.Managed = current.Managed
+	if err := s.setMetadata(ctx, id, md); err != nil {
+		return fleet.Metadata{}, err
+	}
+
+	return md, nil
+}
+
+// listMachineMetadata returns the metadata of the machines matching the
+// filter, sorted by id.
+func (s *Handler) listMachineMetadata(ctx context.Context, f fleet.Filter) ([]MachineMetadata, error) {
+	ids, err := s.listMachines(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make([]MachineMetadata, 0, len(ids))
+	for _, id := range ids {
+		md, err := s.getMetadata(ctx, id)
+		if errors.Is(err, storage.ErrMetadataNotFound) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		machines = append(machines, MachineMetadata{ID: id, Metadata: md})
+	}
+
+	return machines, nil
+}
+
+// bulkApply applies fn to every machine matching the filter, a machine
+// failing does not stop the others.
+func (s *Handler) bulkApply(ctx context.Context, f fleet.Filter, fn func(id string) error) (BulkResult, error) {
+	ids, err := s.listMachines(ctx, f)
+	if err != nil {
+		return BulkResult{}, err
+	}
+
+	res := BulkResult{Updated: []string{}, Failed: []BulkFailure{}}
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			res.Failed = append(res.Failed, BulkFailure{MachineID: id, Error: err.Error()})
+			continue
+		}
+		res.Updated = append(res.Updated, id)
+	}
+
+	return res, nil
+}
+
+func (s *Handler) bulkRestock(ctx context.Context, f fleet.Filter, items []internalVM.Item) (BulkResult, error) {
+	return s.bulkApply(ctx, f, func(id string) error {
+		_, err := s.restock(ctx, id, items, 0)
+		return err
+	})
+}
+
+func (s *Handler) bulkReprice(ctx context.Context, f fleet.Filter, product string, price int) (BulkResult, error) {
+	return s.bulkApply(ctx, f, func(id string) error {
+		_, err := s.reprice(ctx, id, product, price, 0)
+		return err
+	})
+}
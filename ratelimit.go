@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"vendingmachine/internal/auth"
+	"vendingmachine/internal/ratelimit"
+)
+
+// RateLimiter limits the requests per client ip, per authenticated caller
+// and per targeted machine. The clients are limited by their ip before
+// being authenticated, so that guessing credentials is limited too.
+type RateLimiter struct {
+	client *ratelimit.Limiter
+	// identity limits the authenticated callers, whichever ip they call from
+	identity *ratelimit.Limiter
+	machine  *ratelimit.Limiter
+	// trustForwardedFor uses the X-Forwarded-For header as the client ip,
+	// only enable it behind a proxy that sets the header
+	trustForwardedFor bool
+	// exemptPaths are never limited, e.g. the health probes
+	exemptPaths map[string]bool
+}
+
+type RateLimitConfig struct {
+	ClientRate        float64
+	ClientBurst       int
+	MachineRate       float64
+	MachineBurst      int
+	TrustForwardedFor bool
+	ExemptPaths       []string
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{
+		client:            ratelimit.New(cfg.ClientRate, cfg.ClientBurst),
+		identity:          ratelimit.New(cfg.ClientRate, cfg.ClientBurst),
+		machine:           ratelimit.New(cfg.MachineRate, cfg.MachineBurst),
+		trustForwardedFor: cfg.TrustForwardedFor,
+		exemptPaths:       make(map[string]bool, len(cfg.ExemptPaths)),
+	}
+
+	for _, p := range cfg.ExemptPaths {
+		rl.exemptPaths[p] = true
+	}
+
+	return rl
+}
+
+// SetLimits changes the rates and bursts, the other fields of the config
+// only take effect on a new limiter.
+func (rl *RateLimiter) SetLimits(cfg RateLimitConfig) {
+	rl.client.SetLimits(cfg.ClientRate, cfg.ClientBurst)
+	rl.identity.SetLimits(cfg.ClientRate, cfg.ClientBurst)
+	rl.machine.SetLimits(cfg.MachineRate, cfg.MachineBurst)
+}
+
+// ClientMiddleware limits the requests of each client ip, it runs before
+// authenticating.
+func (rl *RateLimiter) ClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.exemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, wait := rl.client.Allow(rl.clientKey(r)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdentityMiddleware limits the requests of each authenticated caller, it
+// runs after routing so that the caller is authenticated.
+func (rl *RateLimiter) IdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := auth.FromContext(r.Context()); ok {
+			if ok, wait := rl.identity.Allow(id.Name); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MachineMiddleware limits the requests targeting each machine, it runs
+// after routing so that the machine id of the request is available.
+func (rl *RateLimiter) MachineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if machineID := machineIDFromContext(r.Context()); machineID != "" {
+			if ok, wait := rl.machine.Allow(machineID); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GRPCOptions returns the interceptors applying the client ip and machine
+// limits to the grpc server, they must run before authenticating. The
+// machine is limited on the requests carrying a machine id, for the streams
+// on the first request received.
+func (rl *RateLimiter) GRPCOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (any, error) {
+			if err := rl.allowGRPCClient(ctx); err != nil {
+				return nil, err
+			}
+
+			if err := rl.allowGRPCMachine(req); err != nil {
+				return nil, err
+			}
+
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo,
+			handler grpc.StreamHandler,
+		) error {
+			if err := rl.allowGRPCClient(ss.Context()); err != nil {
+				return err
+			}
+
+			return handler(srv, &machineLimitedStream{ServerStream: ss, rl: rl})
+		}),
+	}
+}
+
+// machineLimitedStream applies the machine limit to the first request of a
+// stream, the machine id is only known once it is received.
+type machineLimitedStream struct {
+	grpc.ServerStream
+	rl       *RateLimiter
+	received bool
+}
+
+func (s *machineLimitedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if s.received {
+		return nil
+	}
+
+	s.received = true
+
+	return s.rl.allowGRPCMachine(m)
+}
+
+// GRPCIdentityOptions returns the interceptors limiting the authenticated
+// callers of the grpc server, they must run after authenticating.
+func (rl *RateLimiter) GRPCIdentityOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (any, error) {
+			if err := rl.allowGRPCIdentity(ctx); err != nil {
+				return nil, err
+			}
+
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo,
+			handler grpc.StreamHandler,
+		) error {
+			if err := rl.allowGRPCIdentity(ss.Context()); err != nil {
+				return err
+			}
+
+			return handler(srv, ss)
+		}),
+	}
+}
+
+func (rl *RateLimiter) allowGRPCClient(ctx context.Context) error {
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	if ok, wait := rl.client.Allow(clientKey("", remoteAddr)); !ok {
+		return status.Errorf(codes.ResourceExhausted, "too many requests, retry after %s", wait)
+	}
+
+	return nil
+}
+
+func (rl *RateLimiter) allowGRPCMachine(req any) error {
+	if r, ok := req.(interface{ GetMachineId() string }); ok && r.GetMachineId() != "" {
+		if ok, wait := rl.machine.Allow(r.GetMachineId()); !ok {
+			return status.Errorf(codes.ResourceExhausted, "too many requests for machine %q, retry after %s",
+				r.GetMachineId(), wait)
+		}
+	}
+
+	return nil
+}
+
+func (rl *RateLimiter) allowGRPCIdentity(ctx context.Context) error {
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	if ok, wait := rl.identity.Allow(id.Name); !ok {
+		return status.Errorf(codes.ResourceExhausted, "too many requests, retry after %s", wait)
+	}
+
+	return nil
+}
+
+func (rl *RateLimiter) clientKey(r *http.Request) string {
+	var forwardedFor string
+	if rl.trustForwardedFor {
+		// a proxy may add its own header rather than append to the last one
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwardedFor = values[len(values)-1]
+		}
+	}
+
+	return clientKey(forwardedFor, r.RemoteAddr)
+}
+
+// clientKey identifies the client by its ip. The credentials are not
+// verified yet, so they can not tell the clients apart. The trusted proxy
+// appends the ip it received the request from to X-Forwarded-For, the
+// entries before it are sent by the client and can not be trusted.
+func clientKey(forwardedFor, remoteAddr string) string {
+	if forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		return "ip:" + strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	return "ip:" + ip
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+type RateLimitStats struct {
+	Client   ratelimit.Stats `json:"client"`
+	Identity ratelimit.Stats `json:"identity"`
+	Machine  ratelimit.Stats `json:"machine"`
+}
+
+func (rl *RateLimiter) Stats() RateLimitStats {
+	return RateLimitStats{
+		Client:   rl.client.Stats(),
+		Identity: rl.identity.Stats(),
+		Machine:  rl.machine.Stats(),
+	}
+}
+
+func (s *Handler) RateLimitStatsHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.limiter == nil {
+		http.Error(w, "rate limiting is disabled", http.StatusNotFound)
+		return
+	}
+
+	encode(w, http.StatusOK, s.limiter.Stats())
+}
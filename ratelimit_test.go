@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	vendingmachinev1 "vendingmachine/api/vendingmachine/v1"
+	"vendingmachine/internal/auth"
+	"vendingmachine/internal/storage"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		ClientRate:   0.5,
+		ClientBurst:  3,
+		MachineRate:  0.5,
+		MachineBurst: 2,
+	})
+	h := NewHandler(getVMStorageMock(t), getSMStorageMock(t), WithRateLimiter(limiter))
+	rt := NewRouter()
+	registerRoutes(rt, h)
+	rt.Use(limiter.MachineMiddleware)
+	srv := limiter.ClientMiddleware(rt.mux)
+
+	abort := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/abort", strings.NewReader(`{"machine_id":"123"}`))
+		r.Header.Set(apiKeyHeader, key)
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, abort("a").Code)
+	require.Equal(t, http.StatusOK, abort("a").Code)
+
+	// the machine is limited even though the client is not
+	w := abort("a")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	// the client is limited regardless of the machine
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v1/ratelimit", nil)
+	r.Header.Set(apiKeyHeader, "a")
+	srv.ServeHTTP(w, r)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	w = httptest.NewRecorder()
+	h.RateLimitStatsHandler(w, httptest.NewRequest(http.MethodGet, "/v1/ratelimit", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats RateLimitStats
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.EqualValues(t, 3, stats.Client.Allowed)
+	assert.EqualValues(t, 1, stats.Client.Rejected)
+	assert.EqualValues(t, 2, stats.Machine.Allowed)
+	assert.EqualValues(t, 1, stats.Machine.Rejected)
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		ClientRate:   0.5,
+		ClientBurst:  2,
+		MachineRate:  0.5,
+		MachineBurst: 10,
+	})
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	t.Run("unverified credentials", func(t *testing.T) {
+		srv := limiter.ClientMiddleware(ok)
+		codes := make([]int, 0, 3)
+		for _, key := range []string{"guess-1", "guess-2", "guess-3"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v1/machines", nil)
+			r.Header.Set(apiKeyHeader, key)
+			srv.ServeHTTP(w, r)
+			codes = append(codes, w.Code)
+		}
+
+		assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+	})
+
+	t.Run("authenticated caller", func(t *testing.T) {
+		srv := limiter.IdentityMiddleware(ok)
+		codes := make([]int, 0, 3)
+		for _, ip := range []string{"198.51.100.1:1234", "198.51.100.2:1234", "198.51.100.3:1234"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v1/machines", nil)
+			r.RemoteAddr = ip
+			srv.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), auth.Identity{Name: "kiosk"})))
+			codes = append(codes, w.Code)
+		}
+
+		assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+	})
+}
+
+func TestClientKeyForwardedFor(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		ClientRate:        1,
+		ClientBurst:       1,
+		MachineRate:       1,
+		MachineBurst:      1,
+		TrustForwardedFor: true,
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/machines", nil)
+	r.Header.Add("X-Forwarded-For", "203.0.113.7, 198.51.100.1")
+	assert.Equal(t, "ip:198.51.100.1", limiter.clientKey(r), "the entries sent by the client must be ignored")
+
+	r.Header.Add("X-Forwarded-For", "198.51.100.2")
+	assert.Equal(t, "ip:198.51.100.2", limiter.clientKey(r))
+}
+
+func TestRateLimiterGRPCStream(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		ClientRate:   0.5,
+		ClientBurst:  10,
+		MachineRate:  0.5,
+		MachineBurst: 1,
+	})
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewGRPCServer(h, limiter.GRPCOptions()...)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := vendingmachinev1.NewVendingMachineServiceClient(conn)
+	ctx := context.Background()
+
+	created, err := client.CreateMachine(ctx, &vendingmachinev1.CreateMachineRequest{
+		Inventory: []*vendingmachinev1.Item{{Name: "coke", Number: 1, Price: 100}},
+	})
+	require.NoError(t, err)
+
+	_, err = client.GetState(ctx, &vendingmachinev1.GetStateRequest{MachineId: created.GetMachineId()})
+	require.NoError(t, err)
+
+	// the stream is limited on the machine id of its request
+	stream, err := client.StreamEvents(ctx, &vendingmachinev1.StreamEventsRequest{
+		MachineId: created.GetMachineId(),
+	})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
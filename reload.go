@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"vendingmachine/internal/auth"
+)
+
+// ReloadResult lists the config fields, by their yaml path, that differ
+// from the config in effect.
+type ReloadResult struct {
+	// Applied are the fields that took effect
+	Applied []string `json:"applied"`
+	// RestartRequired are the fields that differ from the config the
+	// server was started with and only take effect after a restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+func (r ReloadResult) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Any("applied", r.Applied),
+		slog.Any("restart_required", r.RestartRequired),
+	)
+}
+
+// ConfigApplier applies the fields of the config that are safe to change
+// at runtime, it must apply nothing if it returns an error.
+type ConfigApplier func(cfg *Config) error
+
+// ConfigReloader reloads the config file when it changes or on demand,
+// e.g. on SIGHUP, and keeps the current config if the new one is invalid.
+type ConfigReloader struct {
+	mu      sync.Mutex
+	path    string
+	apply   ConfigApplier
+	modTime time.Time
+
+	// started is the config the server was started with
+	started *Config
+	current atomic.Pointer[Config]
+}
+
+func NewConfigReloader(path string, cfg *Config, apply ConfigApplier) *ConfigReloader {
+	r := &ConfigReloader{
+		mu:      sync.Mutex{},
+		path:    path,
+		apply:   apply,
+		started: cfg,
+	}
+	r.current.Store(cfg)
+
+	if info, err := os.Stat(path); err == nil {
+		r.modTime = info.ModTime()
+	}
+
+	return r
+}
+
+// Current returns the last config applied, its fields requiring a restart
+// may not be in effect.
+func (r *ConfigReloader) Current() *Config {
+	return r.current.Load()
+}
+
+// Reload reads and applies the config file.
+func (r *ConfigReloader) Reload() (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime = info.ModTime()
+	}
+
+	next, err := loadConfig(r.path)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	if err := r.apply(next); err != nil {
+		return ReloadResult{}, fmt.Errorf("failed to apply config: %w", err)
+	}
+
+	var res ReloadResult
+	for _, field := range diffConfig(r.current.Load(), next) {
+		if r.reloadable(field) {
+			res.Applied = append(res.Applied, field)
+		}
+	}
+	for _, field := range diffConfig(r.started, next) {
+		if !r.reloadable(field) {
+			res.RestartRequired = append(res.RestartRequired, field)
+		}
+	}
+
+	r.current.Store(next)
+
+	return res, nil
+}
+
+// Watch reloads the config every time the file's modification time changes,
+// checking every interval, or a value is received on reload. It blocks
+// until the context is done.
+func (r *ConfigReloader) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal,
+	onReload func(ReloadResult, error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+
+		onReload(r.Reload())
+	}
+}
+
+// changed reports whether the file was modified since it was last loaded,
+// a missing file, e.g. while it is being replaced, is not a change.
+func (r *ConfigReloader) changed() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !info.ModTime().Equal(r.modTime)
+}
+
+// reloadable reports whether the config field, by its yaml path, is
+// applied without restarting. The limits are only applied if the server was
+// started with rate limiting, there is no limiter to apply them to otherwise.
+func (r *ConfigReloader) reloadable(field string) bool {
+	if strings.HasPrefix(field, "rate_limit.") && !r.started.RateLimit.Enabled {
+		return false
+	}
+
+	switch field {
+	case "server.shutdown_timeout_seconds",
+		"server.shutdown_drain_seconds",
+		"log.level",
+		"session.allowed_origins",
+		"session.idle_timeout_seconds",
+		"auth.api_keys",
+		"auth.client_certs",
+		"auth.jwt.token_ttl_seconds",
+		"auth.jwt.max_token_ttl_seconds",
+		"rate_limit.client.requests_per_second",
+		"rate_limit.client.burst",
+		"rate_limit.machine.requests_per_second",
+		"rate_limit.machine.burst":
+		return true
+	default:
+		return false
+	}
+}
+
+// diffConfig returns the yaml paths of the fields that differ, slices are
+// compared as a whole.
+func diffConfig(a, b *Config) []string {
+	var fields []string
+	diffStruct("", reflect.ValueOf(*a), reflect.ValueOf(*b), &fields)
+
+	return fields
+}
+
+func diffStruct(prefix string, a, b reflect.Value, fields *[]string) {
+	for i := range a.NumField() {
+		name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("yaml"), ",")
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct {
+			diffStruct(name, fa, fb, fields)
+			continue
+		}
+
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			*fields = append(*fields, name)
+		}
+	}
+}
+
+// reloadTargets are what the reloadable config fields act on.
+type reloadTargets struct {
+	logLevel *slog.LevelVar
+	keys     *auth.KeyStore
+	// authenticator is nil when auth is disabled
+	authenticator *Authenticator
+	// limiter is nil when rate limiting is disabled
+	limiter *RateLimiter
+	handler *Handler
+}
+
+// apply validates everything before changing anything, the api keys are
+// replaced last of the fallible steps as they may clash with the keys
+// created through the api.
+func (t reloadTargets) apply(cfg *Config) error {
+	level, err := parseLogLevel(cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	certIdentities, err := newCertIdentities(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := t.keys.ReplaceConfigured(configuredKeys(cfg)); err != nil {
+		return fmt.Errorf("failed to replace api keys: %w", err)
+	}
+
+	t.logLevel.Set(level)
+
+	if t.authenticator != nil {
+		t.authenticator.SetCertIdentities(certIdentities)
+	}
+
+	if t.limiter != nil {
+		t.limiter.SetLimits(rateLimitConfig(cfg))
+	}
+
+	t.handler.SetSessionConfig(sessionConfig(cfg))
+	t.handler.SetTokenConfig(tokenConfig(cfg))
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/auth"
+)
+
+func writeConfig(t *testing.T, path, port, level, keyHash string) {
+	t.Helper()
+
+	yaml := fmt.Sprintf(`server:
+  port: %q
+log:
+  level: %q
+auth:
+  api_keys:
+    - name: "ops"
+      hash: %q
+      role: "operator"
+rate_limit:
+  client:
+    requests_per_second: 1
+    burst: 1
+`, port, level, keyHash)
+
+	require.NoError(t, os.WriteFile(path, []byte(yaml), 0o600))
+}
+
+func TestConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "8080", "info", auth.HashKey("old"))
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+
+	keys, err := newKeyStore(cfg)
+	require.NoError(t, err)
+	logLevel := &slog.LevelVar{}
+	handler := NewHandler(nil, nil, WithKeyStore(keys))
+
+	r := NewConfigReloader(path, cfg, reloadTargets{
+		logLevel: logLevel,
+		keys:     keys,
+		limiter:  NewRateLimiter(rateLimitConfig(cfg)),
+		handler:  handler,
+	}.apply)
+
+	writeConfig(t, path, "9999", "debug", auth.HashKey("new"))
+	res, err := r.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log.level", "auth.api_keys"}, res.Applied)
+	assert.Equal(t, []string{"server.port"}, res.RestartRequired)
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	_, err = keys.Authenticate("new")
+	require.NoError(t, err)
+
+	// an invalid config is not applied at all
+	writeConfig(t, path, "8080", "loud", auth.HashKey("newer"))
+	_, err = r.Reload()
+	require.Error(t, err)
+	assert.Equal(t, "debug", r.Current().Log.Level)
+	_, err = keys.Authenticate("new")
+	require.NoError(t, err)
+
+	// the port keeps requiring a restart until it is reverted
+	writeConfig(t, path, "9999", "info", auth.HashKey("new"))
+	res, err = r.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log.level"}, res.Applied)
+	assert.Equal(t, []string{"server.port"}, res.RestartRequired)
+}
+
+func TestConfigReloaderWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "8080", "info", auth.HashKey("key"))
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+
+	applied := make(chan *Config, 1)
+	r := NewConfigReloader(path, cfg, func(cfg *Config) error {
+		applied <- cfg
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hangups := make(chan os.Signal, 1)
+	go r.Watch(ctx, 10*time.Millisecond, hangups, func(ReloadResult, error) {})
+
+	// reloaded on a hangup even if the file did not change
+	hangups <- os.Interrupt
+	select {
+	case got := <-applied:
+		assert.Equal(t, "info", got.Log.Level)
+	case <-time.After(time.Second):
+		require.FailNow(t, "config not reloaded on hangup")
+	}
+
+	writeConfig(t, path, "8080", "warn", auth.HashKey("key"))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	select {
+	case got := <-applied:
+		assert.Equal(t, "warn", got.Log.Level)
+	case <-time.After(time.Second):
+		require.FailNow(t, "config not reloaded on change")
+	}
+}
+
+func TestConfigReloaderRateLimitDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "8080", "info", auth.HashKey("key"))
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+	require.False(t, cfg.RateLimit.Enabled)
+
+	r := NewConfigReloader(path, cfg, func(*Config) error { return nil })
+
+	// the server was started without a limiter to apply the limits to
+	yaml := `rate_limit:
+  client:
+    requests_per_second: 2
+    burst: 1
+`
+	require.NoError(t, os.WriteFile(path, []byte(yaml), 0o600))
+	res, err := r.Reload()
+	require.NoError(t, err)
+	assert.NotContains(t, res.Applied, "rate_limit.client.requests_per_second")
+	assert.Contains(t, res.RestartRequired, "rate_limit.client.requests_per_second")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxPeekBytes caps how much of a request body is buffered to find the
+// machine it targets.
+const maxPeekBytes = maxBodyBytes
+
+// requestMachineID returns the id of the machine targeted by the request,
+// either from the {id} path wildcard or from the machine_id field of the
+// json body. The body is restored so that handlers can decode it again.
+func requestMachineID(r *http.Request) (string, error) {
+	if id := r.PathValue("id"); id != "" {
+		return id, nil
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPeekBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+	var v struct {
+		MachineID string `json:"machine_id"`
+	}
+	// bodies that are not json are left for the handler to reject
+	_ = json.Unmarshal(body, &v)
+
+	return v.MachineID, nil
+}
+
+type machineIDKey struct{}
+
+// withMachineID stores the id of the machine targeted by the request, the
+// router reads it once so that the middlewares do not read the body again.
+func withMachineID(ctx context.Context, machineID string) context.Context {
+	return context.WithValue(ctx, machineIDKey{}, machineID)
+}
+
+// machineIDFromContext returns the id of the machine targeted by the
+// request, empty if the request does not target a machine.
+func machineIDFromContext(ctx context.Context) string {
+	machineID, _ := ctx.Value(machineIDKey{}).(string)
+	return machineID
+}
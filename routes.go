@@ -0,0 +1,47 @@
+package main
+
+import "vendingmachine/internal/auth"
+
+func registerRoutes(rt *Router, h *Handler) {
+	// customer routes
+	rt.HandleFunc("/insert", auth.RoleCustomer, h.InsertCoinHandler)
+	rt.HandleFunc("/select", auth.RoleCustomer, h.SelectProductHandler)
+	rt.HandleFunc("/abort", auth.RoleCustomer, h.AbortOrderHandler)
+
+	// statemachine routes
+	rt.HandleFunc("/sm/insert", auth.RoleCustomer, h.TransitionHandler)
+	rt.HandleFunc("/sm/select", auth.RoleCustomer, h.TransitionHandler)
+
+	// streaming routes
+	rt.HandleFunc("GET /v1/machines/{id}/events", auth.RoleCustomer, h.EventsHandler)
+	rt.HandleFunc("GET /v1/machines/{id}/session", auth.RoleCustomer, h.SessionHandler)
+
+	// operator routes
+	rt.HandleFunc("/addvm", auth.RoleOperator, h.AddVMHandler)
+	rt.HandleFunc("GET /v1/machines", auth.RoleOperator, h.ListMachinesHandler)
+	rt.HandleFunc("GET /v1/machines/{id}", auth.RoleCustomer, h.GetMachineHandler)
+	rt.HandleFunc("GET /v1/machines/{id}/metadata", auth.RoleOperator, h.GetMetadataHandler)
+	rt.HandleFunc("GET /v1/machines/{id}/history", auth.RoleOperator, h.HistoryHandler)
+	rt.HandleFunc("GET /v1/machines/{id}/history/state", auth.RoleOperator, h.MachineAtHandler)
+	rt.HandleFunc("PUT /v1/machines/{id}/metadata", auth.RoleOperator, h.UpdateMetadataHandler)
+	rt.HandleFunc("POST /v1/machines/{id}/restock", auth.RoleOperator, h.RestockHandler)
+	rt.HandleFunc("POST /v1/machines/{id}/reprice", auth.RoleOperator, h.RepriceHandler)
+	rt.HandleFunc("DELETE /v1/machines/{id}", auth.RoleOperator, h.DeleteMachineHandler)
+	rt.HandleFunc("POST /v1/tokens", auth.RoleOperator, h.CreateTokenHandler)
+	rt.HandleFunc("GET /v1/ratelimit", auth.RoleOperator, h.RateLimitStatsHandler)
+	rt.HandleFunc("POST /v1/fleet/reconcile", auth.RoleOperator, h.ReconcileFleetHandler)
+	rt.HandleFunc("POST /v1/fleet/restock", auth.RoleOperator, h.BulkRestockHandler)
+	rt.HandleFunc("POST /v1/fleet/reprice", auth.RoleOperator, h.BulkRepriceHandler)
+
+	// monitoring routes
+	rt.HandleFunc("GET /metrics", auth.RoleAnonymous, h.MetricsHandler)
+	rt.HandleFunc("GET /healthz", auth.RoleAnonymous, h.HealthzHandler)
+	rt.HandleFunc("GET /readyz", auth.RoleAnonymous, h.ReadyzHandler)
+
+	// admin routes
+	rt.HandleFunc("GET /v1/admin/keys", auth.RoleAdmin, h.ListKeysHandler)
+	rt.HandleFunc("POST /v1/admin/keys", auth.RoleAdmin, h.CreateKeyHandler)
+	rt.HandleFunc("DELETE /v1/admin/keys/{name}", auth.RoleAdmin, h.DeleteKeyHandler)
+	rt.HandleFunc("GET /v1/admin/backup", auth.RoleAdmin, h.BackupHandler)
+	rt.HandleFunc("POST /v1/admin/restore", auth.RoleAdmin, h.RestoreHandler)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+const (
+	defaultSessionIdleTimeout = 2 * time.Minute
+	sessionWriteTimeout       = 5 * time.Second
+)
+
+// session message types sent by the client.
+const (
+	sessionInsert = "insert"
+	sessionSelect = "select"
+	sessionCancel = "cancel"
+)
+
+// session message types sent by the server.
+const (
+	sessionState    = "state"
+	sessionCredit   = "credit"
+	sessionDelivery = "delivery"
+	sessionError    = "error"
+)
+
+type SessionCommand struct {
+	Type    string `json:"type"`
+	Amount  int    `json:"amount,omitempty"`
+	Product string `json:"product,omitempty"`
+}
+
+type SessionUpdate struct {
+	Type    string           `json:"type"`
+	State   internalVM.State `json:"state,omitempty"`
+	Credit  int              `json:"credit"`
+	Product string           `json:"product,omitempty"`
+	Refund  int              `json:"refund,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+var errSessionActive = errors.New("machine is in use by an active session")
+
+// sessionRegistry keeps track of the machines that currently have an
+// active customer session, at most one session is allowed per machine.
+type sessionRegistry struct {
+	mu sync.Mutex
+	// active maps the machines to the connection of their session, nil
+	// until the connection is upgraded
+	active map[string]*websocket.Conn
+	// closed is set by closeAll, the sessions started afterwards are
+	// refused
+	closed bool
+	// running counts the sessions until they are released
+	running sync.WaitGroup
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		mu:     sync.Mutex{},
+		active: make(map[string]*websocket.Conn),
+	}
+}
+
+func (r *sessionRegistry) acquire(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errShuttingDown
+	}
+
+	if _, ok := r.active[id]; ok {
+		return errSessionActive
+	}
+	r.active[id] = nil
+	r.running.Add(1)
+
+	return nil
+}
+
+// attach sets the connection of an acquired session, it fails once the
+// sessions are closed.
+func (r *sessionRegistry) attach(id string, conn *websocket.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+	r.active[id] = conn
+
+	return true
+}
+
+func (r *sessionRegistry) release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.active, id)
+	r.running.Done()
+}
+
+// closeAll tells the clients that the server is going away and closes the
+// connections, the sessions end once their reads fail.
+func (r *sessionRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, conn := range r.active {
+		if conn == nil {
+			continue
+		}
+
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, errShuttingDown.Error())
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(sessionWriteTimeout))
+		_ = conn.Close()
+	}
+}
+
+func (r *sessionRegistry) isActive(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.active[id]
+
+	return ok
+}
+
+// SessionConfig configures the websocket customer sessions.
+type SessionConfig struct {
+	// AllowedOrigins are the browser origins, besides the server's own host,
+	// that kiosk frontends may connect from
+	AllowedOrigins []string
+	IdleTimeout    time.Duration
+}
+
+func WithSessionConfig(cfg SessionConfig) HandlerOption {
+	return func(h *Handler) {
+		h.sessionCfg = cfg
+	}
+}
+
+// SetSessionConfig changes the config of the sessions started from now on.
+func (s *Handler) SetSessionConfig(cfg SessionConfig) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	s.sessionCfg = cfg
+}
+
+func (s *Handler) sessionConfig() SessionConfig {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+
+	return s.sessionCfg
+}
+
+func (s *Handler) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+
+			u, err := url.Parse(origin)
+			if err != nil {
+				return false
+			}
+
+			return u.Host == r.Host || slices.Contains(s.sessionConfig().AllowedOrigins, origin)
+		},
+	}
+}
+
+// SessionHandler upgrades the connection to a websocket on which a single
+// customer drives a vending machine by sending insert, select and cancel
+// commands and receives state, credit and delivery updates.
+func (s *Handler) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	vm, err := s.getVM(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrVMNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if s.draining.Load() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := s.sessions.acquire(id); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	defer s.sessions.release(id)
+
+	conn, err := s.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		return
+	}
+	defer conn.Close()
+
+	if !s.sessions.attach(id, conn) {
+		return
+	}
+
+	// a customer walking away must not leave their credit in the machine
+	defer s.refundAbandoned(r.Context(), id)
+
+	idleTimeout := s.sessionConfig().IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultSessionIdleTimeout
+	}
+
+	if err := writeSessionUpdate(conn, stateUpdate(vm.Snapshot())); err != nil {
+		return
+	}
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+
+		var cmd SessionCommand
+		if err := conn.ReadJSON(&cmd); err != nil {
+			return
+		}
+
+		for _, u := range s.runSessionCommand(r.Context(), id, cmd) {
+			if err := writeSessionUpdate(conn, u); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Handler) runSessionCommand(ctx context.Context, id string, cmd SessionCommand) []SessionUpdate {
+	vm, err := s.getVM(ctx, id)
+	if err != nil {
+		return []SessionUpdate{errorUpdate(err, internalVM.Snapshot{})}
+	}
+	current := vm.Snapshot()
+
+	ctx = withSession(ctx, id)
+
+	switch cmd.Type {
+	case sessionInsert:
+		after, err := s.insertCoin(ctx, id, cmd.Amount)
+		if err != nil {
+			return []SessionUpdate{errorUpdate(err, current)}
+		}
+
+		return []SessionUpdate{
+			{Type: sessionCredit, State: after.State, Credit: after.InsertedAmount},
+			stateUpdate(after),
+		}
+	case sessionSelect:
+		after, err := s.selectProduct(ctx, id, cmd.Product)
+		if err != nil {
+			return []SessionUpdate{errorUpdate(err, current)}
+		}
+
+		return []SessionUpdate{
+			{Type: sessionDelivery, State: after.State, Credit: after.InsertedAmount, Product: cmd.Product},
+			stateUpdate(after),
+		}
+	case sessionCancel:
+		after, refund, err := s.abortOrder(ctx, id)
+		if err != nil {
+			return []SessionUpdate{errorUpdate(err, current)}
+		}
+
+		return []SessionUpdate{
+			{Type: sessionCredit, State: after.State, Credit: after.InsertedAmount, Refund: refund},
+			stateUpdate(after),
+		}
+	default:
+		return []SessionUpdate{errorUpdate(fmt.Errorf("unknown command: %q", cmd.Type), current)}
+	}
+}
+
+// refundAbandoned aborts the purchase of a customer whose session ended
+// while the machine was still holding their credit.
+func (s *Handler) refundAbandoned(ctx context.Context, id string) {
+	// the connection is gone, the refund must happen anyway, the session
+	// is released only once it is done
+	ctx = withSession(context.WithoutCancel(ctx), id)
+
+	vm, err := s.getVM(ctx, id)
+	if err != nil || vm.Snapshot().State == internalVM.Idle {
+		return
+	}
+
+	_, refund, err := s.abortOrder(ctx, id)
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to abort abandoned session", slog.String("machine_id", id),
+			slog.String("error", err.Error()))
+		return
+	}
+
+	loggerFromContext(ctx).Info("aborted abandoned session", slog.String("machine_id", id),
+		slog.Int("refund", refund))
+}
+
+// sessionKey marks the context of the commands sent by the customer session
+// of the machine whose id it holds.
+type sessionKey struct{}
+
+func withSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+// checkSession fails if the machine has an active customer session and the
+// command was not sent by it.
+func (s *Handler) checkSession(ctx context.Context, id string) error {
+	if session, ok := ctx.Value(sessionKey{}).(string); ok && session == id {
+		return nil
+	}
+
+	if s.sessions.isActive(id) {
+		return errSessionActive
+	}
+
+	return nil
+}
+
+func writeSessionUpdate(conn *websocket.Conn, u SessionUpdate) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(sessionWriteTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
+	if err := conn.WriteJSON(u); err != nil {
+		return fmt.Errorf("failed to write session update: %w", err)
+	}
+
+	return nil
+}
+
+func stateUpdate(snap internalVM.Snapshot) SessionUpdate {
+	return SessionUpdate{Type: sessionState, State: snap.State, Credit: snap.InsertedAmount}
+}
+
+func errorUpdate(err error, snap internalVM.Snapshot) SessionUpdate {
+	return SessionUpdate{Type: sessionError, State: snap.State, Credit: snap.InsertedAmount, Error: err.Error()}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+func TestSessionHandler(t *testing.T) {
+	h := NewHandler(getVMStorageMock(t), getSMStorageMock(t))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/machines/{id}/session", h.SessionHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/machines/123/session"
+
+	conn, res, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	defer conn.Close()
+
+	var u SessionUpdate
+	require.NoError(t, conn.ReadJSON(&u))
+	assert.Equal(t, SessionUpdate{Type: sessionState, State: internalVM.Idle}, u)
+
+	t.Run("single session per machine", func(t *testing.T) {
+		_, res, err := websocket.DefaultDialer.Dial(url, nil) //nolint: govet // shadowing is not a problem here
+		require.Error(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusConflict, res.StatusCode)
+	})
+
+	t.Run("other clients are rejected", func(t *testing.T) {
+		_, err := h.insertCoin(context.Background(), "123", 100)
+		require.ErrorIs(t, err, errSessionActive)
+
+		_, _, err = h.abortOrder(context.Background(), "123")
+		require.ErrorIs(t, err, errSessionActive)
+
+		// the session of another machine is no more allowed
+		_, _, err = h.abortOrder(withSession(context.Background(), "456"), "123")
+		require.ErrorIs(t, err, errSessionActive)
+	})
+
+	t.Run("no amount", func(t *testing.T) {
+		var failed SessionUpdate
+		require.NoError(t, conn.WriteJSON(SessionCommand{Type: sessionInsert}))
+		require.NoError(t, conn.ReadJSON(&failed))
+		assert.Equal(t, SessionUpdate{Type: sessionError, State: internalVM.Idle, Error: errNoAmount.Error()}, failed)
+	})
+
+	t.Run("insert and select", func(t *testing.T) {
+		require.NoError(t, conn.WriteJSON(SessionCommand{Type: sessionInsert, Amount: 120}))
+		require.NoError(t, conn.ReadJSON(&u))
+		assert.Equal(t, SessionUpdate{Type: sessionCredit, State: internalVM.Selecting, Credit: 120}, u)
+		require.NoError(t, conn.ReadJSON(&u))
+		assert.Equal(t, sessionState, u.Type)
+
+		require.NoError(t, conn.WriteJSON(SessionCommand{Type: sessionSelect, Product: "coke"}))
+		require.NoError(t, conn.ReadJSON(&u))
+		assert.Equal(t, SessionUpdate{Type: sessionDelivery, State: internalVM.Idle, Credit: 20, Product: "coke"}, u)
+		require.NoError(t, conn.ReadJSON(&u))
+		assert.Equal(t, sessionState, u.Type)
+	})
+
+	t.Run("invalid command", func(t *testing.T) {
+		require.NoError(t, conn.WriteJSON(SessionCommand{Type: sessionSelect, Product: "coke"}))
+		require.NoError(t, conn.ReadJSON(&u))
+		assert.Equal(t, sessionError, u.Type)
+		assert.Contains(t, u.Error, "bad state")
+	})
+}
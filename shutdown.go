@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"vendingmachine/internal/events"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+// purchasePollInterval is how often the machines are checked for finished
+// purchases while shutting down.
+const purchasePollInterval = 100 * time.Millisecond
+
+// flusher is implemented by the storage backends that buffer writes.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Refund is the credit returned to a customer whose purchase was aborted
+// by the shutdown.
+type Refund struct {
+	MachineID string `json:"machine_id"`
+	// Kind is either vm or sm
+	Kind   string           `json:"kind"`
+	State  internalVM.State `json:"state"`
+	Amount int              `json:"amount"`
+}
+
+// ShutdownSummary describes how the purchases in progress ended.
+type ShutdownSummary struct {
+	// Finished is the number of purchases completed or aborted by their
+	// customers while shutting down
+	Finished int
+	Refunds  []Refund
+}
+
+// StopPurchases rejects new sessions and new purchases, the purchases in
+// progress can still be completed.
+func (s *Handler) StopPurchases() {
+	s.draining.Store(true)
+}
+
+// FinishPurchases waits until no machine is in the middle of a purchase,
+// aborting and refunding the purchases still in progress when the context
+// is done. StopPurchases must be called first so that no purchase starts
+// in the meantime.
+func (s *Handler) FinishPurchases(ctx context.Context) (ShutdownSummary, error) {
+	var summary ShutdownSummary
+
+	busy, err := s.busyMachines(ctx)
+	if err != nil {
+		return summary, err
+	}
+
+	ticker := time.NewTicker(purchasePollInterval)
+	defer ticker.Stop()
+
+	for len(busy) > 0 {
+		select {
+		case <-ctx.Done():
+			summary.Refunds = s.refundAll(busy)
+			return summary, nil
+		case <-ticker.C:
+		}
+
+		for ref := range busy {
+			snap, err := s.snapshotOf(ctx, ref)
+			if isNotFound(err) || err == nil && snap.State == internalVM.Idle {
+				delete(busy, ref)
+				summary.Finished++
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+// snapshotOf reads the current state of the machine.
+func (s *Handler) snapshotOf(ctx context.Context, ref machineRef) (internalVM.Snapshot, error) {
+	if ref.kind == kindSM {
+		sm, err := s.getSM(ctx, ref.id)
+		if err != nil {
+			return internalVM.Snapshot{}, err
+		}
+
+		return sm.Snapshot(), nil
+	}
+
+	vm, err := s.getVM(ctx, ref.id)
+	if err != nil {
+		return internalVM.Snapshot{}, err
+	}
+
+	return vm.Snapshot(), nil
+}
+
+// CloseSessions closes the websocket sessions, the credit left in their
+// machines is refunded, and waits until they end or the context is done.
+// The http server does not track the hijacked connections of the sessions.
+func (s *Handler) CloseSessions(ctx context.Context) error {
+	s.sessions.closeAll()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for the sessions to end: %w", ctx.Err())
+	}
+}
+
+// busyMachines returns the machines that are in the middle of a purchase.
+func (s *Handler) busyMachines(ctx context.Context) (map[machineRef]struct{}, error) {
+	refs, err := s.machineRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	busy := make(map[machineRef]struct{})
+	for _, ref := range refs {
+		snap, err := s.snapshotOf(ctx, ref)
+		if isNotFound(err) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get machine %q: %w", ref.id, err)
+		}
+
+		if snap.State != internalVM.Idle {
+			busy[ref] = struct{}{}
+		}
+	}
+
+	return busy, nil
+}
+
+// machineRefs lists the vending machines and the state machines.
+func (s *Handler) machineRefs(ctx context.Context) ([]machineRef, error) {
+	vmIDs, err := s.vmStorage.ListVMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vending machines: %w", err)
+	}
+
+	smIDs, err := s.smStorage.ListSMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list state machines: %w", err)
+	}
+
+	refs := make([]machineRef, 0, len(vmIDs)+len(smIDs))
+	for _, id := range vmIDs {
+		refs = append(refs, machineRef{id: id, kind: kindVM})
+	}
+	for _, id := range smIDs {
+		refs = append(refs, machineRef{id: id, kind: kindSM})
+	}
+
+	return refs, nil
+}
+
+// refundAll aborts the purchases of the machines, returning the credit
+// each customer gets back.
+func (s *Handler) refundAll(busy map[machineRef]struct{}) []Refund {
+	refunds := make([]Refund, 0, len(busy))
+	for ref := range busy {
+		// the context of the shutdown is done, the refund must happen anyway
+		before, after, err := s.changeMachine(context.Background(), ref, "machine.AbortAndReset", abortAndReset)
+		if err != nil {
+			slog.Error("failed to refund purchase", slog.String("machine_id", ref.id), slog.String("kind", ref.kind),
+				slog.String("error", err.Error()))
+			continue
+		}
+
+		if before.State == internalVM.Idle {
+			continue
+		}
+
+		s.events.Publish(ref.id, events.Aborted, events.Data{Kind: ref.kind, State: string(internalVM.Idle)})
+		s.metrics.observeMachine(ref.id, ref.kind, after)
+
+		refunds = append(refunds, Refund{
+			MachineID: ref.id,
+			Kind:      ref.kind,
+			State:     before.State,
+			Amount:    before.InsertedAmount,
+		})
+	}
+
+	return refunds
+}
+
+// FlushStorage flushes the storages that buffer writes.
+func (s *Handler) FlushStorage(ctx context.Context) error {
+	var errs []error
+	for _, st := range []any{s.vmStorage, s.smStorage} {
+		if f, ok := st.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("failed to flush storage: %w", err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// LogValue logs the summary with the total refunded amount.
+func (s ShutdownSummary) LogValue() slog.Value {
+	var total int
+	refunds := make([]any, 0, len(s.Refunds))
+	for _, r := range s.Refunds {
+		total += r.Amount
+		// the twins share the id
+		refunds = append(refunds, slog.Group(r.MachineID+"/"+r.Kind,
+			slog.String("state", string(r.State)),
+			slog.Int("amount", r.Amount)))
+	}
+
+	return slog.GroupValue(
+		slog.Int("finished", s.Finished),
+		slog.Int("refunded", len(s.Refunds)),
+		slog.Int("refunded_amount", total),
+		slog.Group("refunds", refunds...),
+	)
+}
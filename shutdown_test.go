@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+func TestFinishPurchases(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	inventory := []internalVM.Item{{Name: "coke", Number: 5, Price: 100}}
+
+	finishing, err := h.addVM(ctx, "", fleet.Metadata{}, inventory)
+	require.NoError(t, err)
+	abandoned, err := h.addVM(ctx, "", fleet.Metadata{}, inventory)
+	require.NoError(t, err)
+	idle, err := h.addVM(ctx, "", fleet.Metadata{}, inventory)
+	require.NoError(t, err)
+
+	_, err = h.insertCoin(ctx, finishing.VMID, 100)
+	require.NoError(t, err)
+	_, err = h.insertCoin(ctx, abandoned.VMID, 150)
+	require.NoError(t, err)
+
+	h.StopPurchases()
+
+	_, err = h.insertCoin(ctx, idle.VMID, 100)
+	require.ErrorIs(t, err, errShuttingDown)
+
+	selected := make(chan error, 1)
+	go func() {
+		time.Sleep(2 * purchasePollInterval)
+		_, err := h.selectProduct(ctx, finishing.VMID, "coke")
+		selected <- err
+	}()
+
+	finishCtx, cancel := context.WithTimeout(ctx, 10*purchasePollInterval)
+	defer cancel()
+
+	summary, err := h.FinishPurchases(finishCtx)
+	require.NoError(t, err)
+	require.NoError(t, <-selected)
+
+	assert.Equal(t, 1, summary.Finished)
+	assert.Equal(t, []Refund{
+		{MachineID: abandoned.VMID, Kind: kindVM, State: internalVM.Selecting, Amount: 150},
+	}, summary.Refunds)
+
+	snap, err := h.machineState(ctx, abandoned.VMID)
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Idle, snap.State)
+}
+
+func TestCloseSessions(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage())
+	res, err := h.addVM(ctx, "", fleet.Metadata{}, []internalVM.Item{{Name: "coke", Number: 1, Price: 100}})
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/machines/{id}/session", h.SessionHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/machines/" + res.VMID + "/session"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	defer conn.Close()
+
+	var u SessionUpdate
+	require.NoError(t, conn.ReadJSON(&u))
+	require.NoError(t, conn.WriteJSON(SessionCommand{Type: sessionInsert, Amount: 50}))
+	require.NoError(t, conn.ReadJSON(&u))
+	require.Equal(t, sessionCredit, u.Type)
+
+	closeCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	require.NoError(t, h.CloseSessions(closeCtx))
+
+	// the client is told why the session ended
+	for err == nil {
+		err = conn.ReadJSON(&u)
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+
+	// the credit left in the machine was refunded
+	snap, err := h.machineState(ctx, res.VMID)
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Idle, snap.State)
+
+	_, resp, err = websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
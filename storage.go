@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"vendingmachine/internal/storage"
+)
+
+const (
+	backendMemory   = "memory"
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+)
+
+// storages are the storages of the configured backend.
+type storages struct {
+	vm       VMStorage
+	sm       SMStorage
+	metadata MetadataStorage
+	// close releases the backend once the storages are flushed
+	close func() error
+}
+
+// openStorages opens the configured backend, a database backend implements
+// every storage.
+func openStorages(ctx context.Context, cfg *Config) (storages, error) {
+	switch cfg.Storage.Backend {
+	case backendSQLite:
+		db, err := storage.OpenSQLite(ctx, cfg.Storage.SQLite.Path)
+		if err != nil {
+			return storages{}, fmt.Errorf("failed to open sqlite storage: %w", err)
+		}
+
+		return storages{vm: db, sm: db, metadata: db, close: db.Close}, nil
+	case backendPostgres:
+		db, err := storage.OpenPostgres(ctx, cfg.Storage.Postgres.DSN)
+		if err != nil {
+			return storages{}, fmt.Errorf("failed to open postgres storage: %w", err)
+		}
+
+		return storages{vm: db, sm: db, metadata: db, close: db.Close}, nil
+	default:
+		stores := storages{
+			vm:       storage.NewInMemoryVMStorage(),
+			sm:       storage.NewInMemorySMStorage(),
+			metadata: storage.NewInMemoryMetadataStorage(),
+			close:    func() error { return nil },
+		}
+		if shards := cfg.Storage.Memory.Shards; shards > 0 {
+			stores.vm = storage.NewShardedVMStorage(shards)
+			stores.sm = storage.NewShardedSMStorage(shards)
+		}
+
+		return stores, nil
+	}
+}
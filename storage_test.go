@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+func TestOpenStoragesSQLite(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{}
+	cfg.Storage.Backend = backendSQLite
+	cfg.Storage.SQLite.Path = filepath.Join(t.TempDir(), "vm.db")
+	require.NoError(t, cfg.Validate())
+
+	stores, err := openStorages(ctx, cfg)
+	require.NoError(t, err)
+
+	h := NewHandler(stores.vm, stores.sm, WithMetadataStorage(stores.metadata))
+	_, err = h.addVM(ctx, "hq-1", fleet.Metadata{Site: "hq"}, []internalVM.Item{{Name: "coke", Number: 2, Price: 100}})
+	require.NoError(t, err)
+	_, err = h.insertCoin(ctx, "hq-1", 100)
+	require.NoError(t, err)
+	_, err = h.selectProduct(ctx, "hq-1", "coke")
+	require.NoError(t, err)
+	require.NoError(t, stores.close())
+
+	stores, err = openStorages(ctx, cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, stores.close()) })
+
+	h = NewHandler(stores.vm, stores.sm, WithMetadataStorage(stores.metadata))
+	vm, err := h.getVM(ctx, "hq-1")
+	require.NoError(t, err)
+	snap := vm.Snapshot()
+	assert.Equal(t, internalVM.Idle, snap.State)
+	assert.Equal(t, []internalVM.Item{{Name: "coke", Number: 1, Price: 100}}, snap.Inventory)
+
+	md, err := h.machineMetadata(ctx, "hq-1")
+	require.NoError(t, err)
+	assert.Equal(t, "hq", md.Site)
+}
+
+func TestOpenStoragesSharded(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{}
+	cfg.Storage.Memory.Shards = 4
+	require.NoError(t, cfg.Validate())
+
+	stores, err := openStorages(ctx, cfg)
+	require.NoError(t, err)
+	require.IsType(t, &storage.ShardedVMStorage{}, stores.vm)
+	require.IsType(t, &storage.ShardedSMStorage{}, stores.sm)
+
+	h := NewHandler(stores.vm, stores.sm, WithMetadataStorage(stores.metadata))
+	for _, id := range []string{"hq-2", "hq-1", "hq-3"} {
+		_, err = h.addVM(ctx, id, fleet.Metadata{}, []internalVM.Item{{Name: "coke", Number: 2, Price: 100}})
+		require.NoError(t, err)
+	}
+	_, err = h.insertCoin(ctx, "hq-1", 100)
+	require.NoError(t, err)
+
+	snap, err := h.machineState(ctx, "hq-1")
+	require.NoError(t, err)
+	assert.Equal(t, internalVM.Selecting, snap.State)
+
+	ids, err := stores.vm.ListVMs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hq-1", "hq-2", "hq-3"}, ids)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/statemachine"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+const tracerName = "vendingmachine"
+
+const (
+	exporterOTLP = "otlp"
+	exporterFile = "file"
+)
+
+const (
+	attrMachineIDKey   = attribute.Key("vendingmachine.machine_id")
+	attrProductKey     = attribute.Key("vendingmachine.product")
+	attrStateBeforeKey = attribute.Key("vendingmachine.state_before")
+	attrStateAfterKey  = attribute.Key("vendingmachine.state_after")
+)
+
+// TracingConfig selects where the spans are exported to.
+type TracingConfig struct {
+	ServiceName string
+	// Exporter is either otlp or file
+	Exporter string
+	// OTLPEndpoint is the host:port of the OTLP/HTTP collector
+	OTLPEndpoint string
+	OTLPInsecure bool
+	// FilePath receives the spans as JSON lines for offline analysis
+	FilePath string
+	// SampleRatio is the fraction of the traces started by the server that
+	// are sampled, the sampling decision of incoming traces is kept
+	SampleRatio float64
+}
+
+// NewTracerProvider returns a tracer provider exporting the spans as
+// configured. The returned function flushes the pending spans and closes
+// the exporter.
+func NewTracerProvider(ctx context.Context, cfg TracingConfig) (*sdktrace.TracerProvider, func(context.Context) error,
+	error,
+) {
+	var (
+		exporter sdktrace.SpanExporter
+		closeFn  = func() error { return nil }
+	)
+
+	switch cfg.Exporter {
+	case exporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+		}
+		exporter = exp
+	case exporterFile:
+		f, err := os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) //nolint: mnd // file mode
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		exporter = exp
+		closeFn = f.Close
+	default:
+		return nil, nil, fmt.Errorf("unknown trace exporter %q, expected %q or %q", cfg.Exporter, exporterOTLP, exporterFile)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+
+	shutdown := func(ctx context.Context) error {
+		if err := tp.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to shut down tracer provider: %w", err)
+		}
+
+		if err := closeFn(); err != nil {
+			return fmt.Errorf("failed to close trace file: %w", err)
+		}
+
+		return nil
+	}
+
+	return tp, shutdown, nil
+}
+
+// TracingMiddleware starts a server span for each request, continuing the
+// trace of the W3C traceparent header if the request carries one.
+func TracingMiddleware(tp trace.TracerProvider, rt *Router, next http.Handler) http.Handler {
+	tracer := tp.Tracer(tracerName)
+	propagator := propagation.TraceContext{}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := rt.mux.Handler(r)
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.statusCode()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	})
+}
+
+func WithTracerProvider(tp trace.TracerProvider) HandlerOption {
+	return func(h *Handler) {
+		h.tracer = tp.Tracer(tracerName)
+	}
+}
+
+func attrMachineID(id string) attribute.KeyValue {
+	return attrMachineIDKey.String(id)
+}
+
+func attrProduct(product string) attribute.KeyValue {
+	return attrProductKey.String(product)
+}
+
+// startDomainSpan starts the span of an operation on a machine, the state
+// after the operation is recorded by endDomainSpan.
+func (s *Handler) startDomainSpan(ctx context.Context, name, id string, before internalVM.Snapshot,
+	attrs ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	attrs = append(attrs, attrMachineID(id), attrStateBeforeKey.String(string(before.State)))
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func endDomainSpan(span trace.Span, after internalVM.Snapshot, err error) {
+	span.SetAttributes(attrStateAfterKey.String(string(after.State)))
+	recordError(span, err)
+	span.End()
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// The storage calls below are wrapped in spans, the operations must call
+// them instead of calling the storage directly.
+
+func (s *Handler) getVM(ctx context.Context, id string) (*internalVM.VendingMachine, error) {
+	ctx, span := s.tracer.Start(ctx, "storage.GetVM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	vm, err := s.vmStorage.GetVM(ctx, id)
+	recordError(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+func (s *Handler) createVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	ctx, span := s.tracer.Start(ctx, "storage.CreateVM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.vmStorage.CreateVM(ctx, id, vm)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) replaceVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	ctx, span := s.tracer.Start(ctx, "storage.ReplaceVM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.vmStorage.ReplaceVM(ctx, id, vm)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) updateVM(ctx context.Context, id string, vm *internalVM.VendingMachine) error {
+	ctx, span := s.tracer.Start(ctx, "storage.UpdateVM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.vmStorage.UpdateVM(ctx, id, vm)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) changeStoredVM(ctx context.Context, c vmChanger, id string,
+	change func(ctx context.Context, vm *internalVM.VendingMachine) error,
+) error {
+	ctx, span := s.tracer.Start(ctx, "storage.ChangeVM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := c.ChangeVM(ctx, id, func(vm *internalVM.VendingMachine) error { return change(ctx, vm) })
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) vmEvents(ctx context.Context, id string) ([]internalVM.Event, error) {
+	ctx, span := s.tracer.Start(ctx, "storage.VMEvents", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	history, err := s.vmStorage.VMEvents(ctx, id)
+	recordError(span, err)
+
+	return history, err
+}
+
+func (s *Handler) deleteVM(ctx context.Context, id string) error {
+	ctx, span := s.tracer.Start(ctx, "storage.DeleteVM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.vmStorage.DeleteVM(ctx, id)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) getSM(ctx context.Context, id string) (*statemachine.Machine, error) {
+	ctx, span := s.tracer.Start(ctx, "storage.GetSM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	sm, err := s.smStorage.GetSM(ctx, id)
+	recordError(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+func (s *Handler) createSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	ctx, span := s.tracer.Start(ctx, "storage.CreateSM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.smStorage.CreateSM(ctx, id, sm)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) replaceSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	ctx, span := s.tracer.Start(ctx, "storage.ReplaceSM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.smStorage.ReplaceSM(ctx, id, sm)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) updateSM(ctx context.Context, id string, sm *statemachine.Machine) error {
+	ctx, span := s.tracer.Start(ctx, "storage.UpdateSM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.smStorage.UpdateSM(ctx, id, sm)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) changeStoredSM(ctx context.Context, c smChanger, id string,
+	change func(ctx context.Context, sm *statemachine.Machine) error,
+) error {
+	ctx, span := s.tracer.Start(ctx, "storage.ChangeSM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := c.ChangeSM(ctx, id, func(sm *statemachine.Machine) error { return change(ctx, sm) })
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) deleteSM(ctx context.Context, id string) error {
+	ctx, span := s.tracer.Start(ctx, "storage.DeleteSM", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.smStorage.DeleteSM(ctx, id)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) getMetadata(ctx context.Context, id string) (fleet.Metadata, error) {
+	ctx, span := s.tracer.Start(ctx, "storage.GetMetadata", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	md, err := s.metadata.GetMetadata(ctx, id)
+	recordError(span, err)
+
+	return md, err
+}
+
+func (s *Handler) setMetadata(ctx context.Context, id string, md fleet.Metadata) error {
+	ctx, span := s.tracer.Start(ctx, "storage.SetMetadata", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.metadata.SetMetadata(ctx, id, md)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) deleteMetadata(ctx context.Context, id string) error {
+	ctx, span := s.tracer.Start(ctx, "storage.DeleteMetadata", trace.WithAttributes(attrMachineID(id)))
+	defer span.End()
+
+	err := s.metadata.DeleteMetadata(ctx, id)
+	recordError(span, err)
+
+	return err
+}
+
+func (s *Handler) listMachines(ctx context.Context, f fleet.Filter) ([]string, error) {
+	ctx, span := s.tracer.Start(ctx, "storage.ListMachines")
+	defer span.End()
+
+	ids, err := s.metadata.ListMachines(ctx, f)
+	recordError(span, err)
+
+	return ids, err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"vendingmachine/internal/fleet"
+	"vendingmachine/internal/storage"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	h := NewHandler(storage.NewInMemoryVMStorage(), storage.NewInMemorySMStorage(), WithTracerProvider(tp))
+	rt := NewRouter()
+	registerRoutes(rt, h)
+	srv := TracingMiddleware(tp, rt, rt.mux)
+
+	inventory := []internalVM.Item{{Name: "coke", Number: 1, Price: 100}}
+	res, err := h.addVM(context.Background(), "", fleet.Metadata{}, inventory)
+	require.NoError(t, err)
+	_, err = h.insertCoin(context.Background(), res.VMID, 100)
+	require.NoError(t, err)
+	exporter.Reset()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/select",
+		strings.NewReader(`{"machine_id":"`+res.VMID+`","selected_product":"coke"}`))
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	srv.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		assert.Equal(t, traceID, s.SpanContext.TraceID().String(), "span %q is not part of the incoming trace", s.Name)
+		spans[s.Name] = s
+	}
+
+	for _, name := range []string{"/select", "decode", "storage.UpdateVM", "vendingmachine.SelectProduct",
+		"vendingmachine.DeliverProduct"} {
+		assert.Contains(t, spans, name)
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range spans["vendingmachine.SelectProduct"].Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, res.VMID, attrs["vendingmachine.machine_id"])
+	assert.Equal(t, "coke", attrs["vendingmachine.product"])
+	assert.Equal(t, "Selecting", attrs["vendingmachine.state_before"])
+	assert.Equal(t, "Delivering", attrs["vendingmachine.state_after"])
+}
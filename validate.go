@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"vendingmachine/internal/fleet"
+	internalVM "vendingmachine/internal/vendingmachine"
+)
+
+const (
+	maxLatitude  = 90
+	maxLongitude = 180
+)
+
+var errInvalidRequest = errors.New("invalid request")
+
+// FieldError describes why a field of a request is invalid. Field is the
+// json path of the field, e.g. inventory[1].price.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", errInvalidRequest, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return errInvalidRequest
+}
+
+// check records the message for the field if ok is false.
+func (e *ValidationError) check(ok bool, field, message string) {
+	if !ok {
+		e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+	}
+}
+
+// validator is implemented by the request types, validate records every
+// invalid field instead of stopping at the first one.
+type validator interface {
+	validate(v *ValidationError)
+}
+
+// validateItems checks the items of an inventory, restock allows leaving
+// out the price of the products the machine already has.
+func validateItems(v *ValidationError, field string, items []internalVM.Item, restock bool) {
+	seen := make(map[string]bool, len(items))
+	for i, item := range items {
+		prefix := fmt.Sprintf("%s[%d].", field, i)
+
+		v.check(item.Name != "", prefix+"name", "must not be empty")
+		v.check(item.Name == "" || !seen[item.Name], prefix+"name", fmt.Sprintf("duplicate product %q", item.Name))
+		seen[item.Name] = true
+
+		if restock {
+			v.check(item.Number > 0, prefix+"number", "must be positive")
+			v.check(item.Price >= 0, prefix+"price", "must not be negative")
+		} else {
+			v.check(item.Number >= 0, prefix+"number", "must not be negative")
+			v.check(item.Price > 0, prefix+"price", "must be positive")
+		}
+	}
+}
+
+// validateMetadata checks the metadata of a machine, field is empty when
+// the metadata are the whole request.
+func validateMetadata(v *ValidationError, field string, md fleet.Metadata) {
+	prefix := ""
+	if field != "" {
+		prefix = field + "."
+	}
+
+	if md.Geo != nil {
+		v.check(md.Geo.Lat >= -maxLatitude && md.Geo.Lat <= maxLatitude, prefix+"geo.lat",
+			"must be between -90 and 90")
+		v.check(md.Geo.Lon >= -maxLongitude && md.Geo.Lon <= maxLongitude, prefix+"geo.lon",
+			"must be between -180 and 180")
+	}
+
+	if md.InstalledOn != "" {
+		_, err := time.Parse(time.DateOnly, md.InstalledOn)
+		v.check(err == nil, prefix+"installed_on", "must be a date, e.g. 2024-03-01")
+	}
+
+	seen := make(map[string]bool, len(md.Tags))
+	for i, tag := range md.Tags {
+		name := fmt.Sprintf("%stags[%d]", prefix, i)
+		v.check(tag != "", name, "must not be empty")
+		v.check(tag == "" || !seen[tag], name, fmt.Sprintf("duplicate tag %q", tag))
+		seen[tag] = true
+	}
+}
+
+// decodeError replies to a request that could not be decoded, listing the
+// invalid fields if the request failed validation.
+func decodeError(w http.ResponseWriter, err error) {
+	var (
+		verr    *ValidationError
+		tooLong *http.MaxBytesError
+	)
+
+	switch {
+	case errors.As(err, &verr):
+		encode(w, http.StatusBadRequest, verr)
+	case errors.As(err, &tooLong):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeValidation(t *testing.T) {
+	t.Run("lists every invalid field", func(t *testing.T) {
+		h := NewHandler(nil, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/addvm",
+			strings.NewReader(`{"inventory":[{"name":"coke","number":1,"price":-5},{"name":"coke","number":-1,"price":10}]}`))
+		h.AddVMHandler(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var res ValidationError
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		assert.Equal(t, []FieldError{
+			{Field: "inventory[0].price", Message: "must be positive"},
+			{Field: "inventory[1].name", Message: `duplicate product "coke"`},
+			{Field: "inventory[1].number", Message: "must not be negative"},
+		}, res.Fields)
+	})
+
+	t.Run("negative amount and empty machine id", func(t *testing.T) {
+		h := NewHandler(nil, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/insert",
+			strings.NewReader(`{"machine_id":"","inserted_amount":-100}`))
+		h.InsertCoinHandler(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), `"field":"machine_id"`)
+		assert.Contains(t, w.Body.String(), `"field":"inserted_amount"`)
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		h := NewHandler(nil, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/abort",
+			strings.NewReader(`{"machine_id":"123","machineid":"123"}`))
+		h.AbortOrderHandler(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unknown field")
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		h := NewHandler(nil, nil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/abort",
+			strings.NewReader(`{"machine_id":"`+strings.Repeat("1", maxBodyBytes)+`"}`))
+		h.AbortOrderHandler(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+}